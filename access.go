@@ -0,0 +1,225 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+// clientAccess decides which clients may use alpaca. Without it, anyone who
+// can reach the listener gets to use the proxy with the user's credentials.
+// The zero value (and nil) lets every client in.
+type clientAccess struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+	// users maps each user name to the SHA-256 hash of its password, so
+	// that passwords of any length can be compared in constant time.
+	users map[string][sha256.Size]byte
+}
+
+// newClientAccess parses the `clients:` section of the config. Allow and
+// deny entries are CIDR prefixes (or single addresses), and credentials are
+// in "user:password" form.
+func newClientAccess(cfg clientsConfig) (*clientAccess, error) {
+	allow, err := parsePrefixes(cfg.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parsePrefixes(cfg.Deny)
+	if err != nil {
+		return nil, err
+	}
+	ca := &clientAccess{allow: allow, deny: deny}
+	for _, credentials := range cfg.Credentials {
+		user, password, ok := strings.Cut(credentials, ":")
+		if !ok || user == "" {
+			return nil, errors.New("invalid client credentials (expected user:password)")
+		}
+		if ca.users == nil {
+			ca.users = make(map[string][sha256.Size]byte)
+		}
+		ca.users[user] = sha256.Sum256([]byte(password))
+	}
+	return ca, nil
+}
+
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if addr, err := netip.ParseAddr(value); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client address range %q", value)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// allowed reports whether a client at remoteAddr (as in http.Request's
+// RemoteAddr) may connect. The deny list is checked first; then, if there is
+// an allow list, the client must be on it. Clients on a unix socket don't
+// have an IP address, and are always allowed (the socket's permissions
+// decide who can connect).
+func (ca *clientAccess) allowed(remoteAddr string) bool {
+	if ca == nil {
+		return true
+	}
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return true
+	}
+	addr := addrPort.Addr().Unmap()
+	for _, prefix := range ca.deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(ca.allow) == 0 {
+		return true
+	}
+	for _, prefix := range ca.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// needsCredentials reports whether clients have to authenticate to alpaca.
+func (ca *clientAccess) needsCredentials() bool {
+	return ca != nil && len(ca.users) > 0
+}
+
+// Valid checks a client's user name and password. It implements the
+// CredentialStore interface of the SOCKS5 server.
+func (ca *clientAccess) Valid(user, password, _ string) bool {
+	if !ca.needsCredentials() {
+		return true
+	}
+	want, ok := ca.users[user]
+	got := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(want[:], got[:]) == 1 && ok
+}
+
+// authorized checks the Proxy-Authorization header that a client sent to
+// alpaca. The header is removed later by deleteRequestHeaders, before the
+// request is sent on, so it never reaches the upstream proxy.
+func (ca *clientAccess) authorized(req *http.Request) bool {
+	if !ca.needsCredentials() {
+		return true
+	}
+	// Borrow http.Request's parsing of Basic credentials.
+	r := http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}
+	user, password, ok := r.BasicAuth()
+	return ok && ca.Valid(user, password, req.RemoteAddr)
+}
+
+// reloadableAccess holds the clientAccess that's currently in effect, which
+// is replaced whenever the config is reloaded.
+type reloadableAccess struct {
+	current atomic.Pointer[clientAccess]
+}
+
+func (ra *reloadableAccess) swap(ca *clientAccess) {
+	ra.current.Store(ca)
+}
+
+func (ra *reloadableAccess) Valid(user, password, addr string) bool {
+	return ra.current.Load().Valid(user, password, addr)
+}
+
+// WrapHandler turns away clients that aren't allowed in, and asks for
+// credentials on proxy requests from clients that haven't sent them. Only
+// proxy requests need credentials, since clients (e.g. browsers fetching the
+// PAC file) don't send Proxy-Authorization to an origin server.
+func (ra *reloadableAccess) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ca := ra.current.Load()
+		if !ca.allowed(req.RemoteAddr) {
+			slog.Warn("Rejected request from client that isn't allowed",
+				"client", req.RemoteAddr)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		isProxyRequest := req.Method == http.MethodConnect || req.URL.Scheme != ""
+		if isProxyRequest && !ca.authorized(req) {
+			if req.Header.Get("Proxy-Authorization") != "" {
+				slog.Warn("Rejected request with invalid client credentials",
+					"client", req.RemoteAddr)
+			}
+			w.Header().Set("Proxy-Authenticate", `Basic realm="alpaca"`)
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// listener wraps l so that connections from clients that aren't allowed in
+// are closed as soon as they're accepted. It's used for the SOCKS5 listener,
+// which doesn't go through WrapHandler.
+func (ra *reloadableAccess) listener(l net.Listener) net.Listener {
+	return &accessListener{l, ra, false}
+}
+
+// anonymousListener is like listener, for the transparent listener, whose
+// clients don't know that there's a proxy and so can't send credentials.
+// While clients need credentials, all of its connections are closed. (The
+// config doesn't allow both, but a listener from systemd isn't covered by
+// that.)
+func (ra *reloadableAccess) anonymousListener(l net.Listener) net.Listener {
+	return &accessListener{l, ra, true}
+}
+
+type accessListener struct {
+	net.Listener
+	access    *reloadableAccess
+	anonymous bool
+}
+
+func (l *accessListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ca := l.access.current.Load()
+		switch {
+		case !ca.allowed(conn.RemoteAddr().String()):
+			slog.Warn("Rejected connection from client that isn't allowed",
+				"client", conn.RemoteAddr().String())
+		case l.anonymous && ca.needsCredentials():
+			slog.Warn("Rejected connection from client that can't send credentials",
+				"client", conn.RemoteAddr().String())
+		default:
+			return conn, nil
+		}
+		_ = conn.Close()
+	}
+}
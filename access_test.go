@@ -0,0 +1,225 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+func TestClientAccessAllowed(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		allow, deny []string
+		remoteAddr  string
+		want        bool
+	}{
+		{"NoRules", nil, nil, "203.0.113.1:1234", true},
+		{"Allowed", []string{"192.0.2.0/24"}, nil, "192.0.2.7:1234", true},
+		{"NotAllowed", []string{"192.0.2.0/24"}, nil, "203.0.113.1:1234", false},
+		{"SingleAddress", []string{"192.0.2.7"}, nil, "192.0.2.7:1234", true},
+		{"Denied", nil, []string{"192.0.2.0/24"}, "192.0.2.7:1234", false},
+		{"DenyWins", []string{"192.0.2.0/24"}, []string{"192.0.2.7/32"},
+			"192.0.2.7:1234", false},
+		{"IPv6", []string{"2001:db8::/32"}, nil, "[2001:db8::1]:1234", true},
+		{"IPv4Mapped", []string{"192.0.2.0/24"}, nil, "[::ffff:192.0.2.7]:1234", true},
+		{"UnixSocket", []string{"192.0.2.0/24"}, nil, "@", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ca, err := newClientAccess(clientsConfig{Allow: test.allow, Deny: test.deny})
+			require.NoError(t, err)
+			assert.Equal(t, test.want, ca.allowed(test.remoteAddr))
+		})
+	}
+}
+
+func TestNewClientAccessInvalid(t *testing.T) {
+	for _, cfg := range []clientsConfig{
+		{Allow: []string{"192.0.2.0/33"}},
+		{Deny: []string{"example.test"}},
+		{Credentials: []string{"nopassword"}},
+		{Credentials: []string{":password"}},
+	} {
+		_, err := newClientAccess(cfg)
+		assert.Error(t, err, "%+v", cfg)
+	}
+}
+
+func TestClientAccessValid(t *testing.T) {
+	ca, err := newClientAccess(clientsConfig{Credentials: []string{"malory:guest:1"}})
+	require.NoError(t, err)
+	assert.True(t, ca.Valid("malory", "guest:1", ""))
+	assert.False(t, ca.Valid("malory", "guest", ""))
+	assert.False(t, ca.Valid("mallory", "guest:1", ""))
+	// Without credentials, anyone is let in.
+	assert.True(t, (*clientAccess)(nil).Valid("anyone", "", ""))
+}
+
+func TestClientAccessHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// The client's credentials are for alpaca, not for the server.
+		assert.Empty(t, req.Header.Get("Proxy-Authorization"))
+	}))
+	defer server.Close()
+	var access reloadableAccess
+	proxyServer := httptest.NewServer(createServer(newDirectProxy(), &access, limits{}, false).Handler)
+	defer proxyServer.Close()
+
+	for _, test := range []struct {
+		name   string
+		cfg    clientsConfig
+		user   *url.Userinfo
+		status int
+	}{
+		{"NoRules", clientsConfig{}, nil, http.StatusOK},
+		{"Denied", clientsConfig{Deny: []string{"127.0.0.0/8", "::1"}}, nil,
+			http.StatusForbidden},
+		{"NoCredentials", clientsConfig{Credentials: []string{"malory:guest"}}, nil,
+			http.StatusProxyAuthRequired},
+		{"WrongCredentials", clientsConfig{Credentials: []string{"malory:guest"}},
+			url.UserPassword("malory", "wrong"), http.StatusProxyAuthRequired},
+		{"Credentials", clientsConfig{Credentials: []string{"malory:guest"}},
+			url.UserPassword("malory", "guest"), http.StatusOK},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ca, err := newClientAccess(test.cfg)
+			require.NoError(t, err)
+			access.swap(ca)
+			proxyURL, err := url.Parse(proxyServer.URL)
+			require.NoError(t, err)
+			proxyURL.User = test.user
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+			resp, err := client.Get(server.URL)
+			require.NoError(t, err)
+			defer resp.Body.Close() //nolint:errcheck
+			assert.Equal(t, test.status, resp.StatusCode)
+			if test.status == http.StatusProxyAuthRequired {
+				assert.Equal(t, `Basic realm="alpaca"`, resp.Header.Get("Proxy-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestClientAccessSocks(t *testing.T) {
+	target := echoServer(t)
+	ca, err := newClientAccess(clientsConfig{Credentials: []string{"malory:guest"}})
+	require.NoError(t, err)
+	var access reloadableAccess
+	access.swap(ca)
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close() //nolint:errcheck
+	go func() { _ = newSocksServer(dial, &access).Serve(access.listener(l)) }()
+
+	for _, test := range []struct {
+		name string
+		auth *proxy.Auth
+		ok   bool
+	}{
+		{"NoCredentials", nil, false},
+		{"WrongCredentials", &proxy.Auth{User: "malory", Password: "wrong"}, false},
+		{"Credentials", &proxy.Auth{User: "malory", Password: "guest"}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client, err := proxy.SOCKS5("tcp", l.Addr().String(), test.auth, proxy.Direct)
+			require.NoError(t, err)
+			conn, err := client.Dial("tcp", target.Addr().String())
+			if !test.ok {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer conn.Close() //nolint:errcheck
+			_, err = conn.Write([]byte("hello"))
+			require.NoError(t, err)
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(conn, buf)
+			require.NoError(t, err)
+			assert.Equal(t, "hello", string(buf))
+		})
+	}
+
+	t.Run("Denied", func(t *testing.T) {
+		ca, err := newClientAccess(clientsConfig{Deny: []string{"127.0.0.1"}})
+		require.NoError(t, err)
+		access.swap(ca)
+		auth := &proxy.Auth{User: "malory", Password: "guest"}
+		client, err := proxy.SOCKS5("tcp", l.Addr().String(), auth, proxy.Direct)
+		require.NoError(t, err)
+		_, err = client.Dial("tcp", target.Addr().String())
+		assert.Error(t, err)
+	})
+}
+
+func TestClientAccessTransparent(t *testing.T) {
+	ca, err := newClientAccess(clientsConfig{Credentials: []string{"malory:guest"}})
+	require.NoError(t, err)
+	var access reloadableAccess
+	access.swap(ca)
+
+	// A redirected HTTP request is in origin form, but it's still a
+	// proxy request, so it needs credentials.
+	reached := false
+	handler := createServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		reached = true
+	}), &access, limits{}, false).Handler
+	req := httptest.NewRequest(http.MethodGet, "/path", nil)
+	req.Host = "target.test"
+	req = req.WithContext(context.WithValue(req.Context(), contextKeyOriginalDst,
+		netip.MustParseAddrPort("192.0.2.1:80")))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusProxyAuthRequired, w.Code)
+	assert.False(t, reached)
+
+	// Connections to the transparent listener (including TLS ones,
+	// which never get to the handler) are refused outright.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	al := access.anonymousListener(l)
+	defer al.Close() //nolint:errcheck
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := al.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close() //nolint:errcheck
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF, "connection should have been closed")
+
+	// Without credentials, they're let in.
+	access.swap(&clientAccess{})
+	conn, err = net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close() //nolint:errcheck
+	server := <-accepted
+	_ = server.Close()
+}
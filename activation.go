@@ -0,0 +1,84 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by socket activation
+// (SD_LISTEN_FDS_START in sd-daemon.h).
+const listenFDsStart = 3
+
+// activatedListener is a listening socket that was passed to alpaca by
+// systemd, along with its name (FileDescriptorName= in the socket unit).
+type activatedListener struct {
+	name string
+	net.Listener
+}
+
+// activationListeners returns the listeners passed to alpaca by systemd's
+// socket activation (see sd_listen_fds(3)), or nil if it wasn't started by
+// socket activation. The environment variables are unset, so that they
+// aren't inherited by child processes (such as the Kerberos helpers).
+func activationListeners() ([]activatedListener, error) {
+	listeners, err := listenFDs(os.Getenv, os.Getpid(), listenFDsStart)
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		_ = os.Unsetenv(name)
+	}
+	return listeners, err
+}
+
+// listenFDs implements activationListeners, taking the file descriptors
+// starting at first.
+func listenFDs(getenv func(string) string, pid, first int) ([]activatedListener, error) {
+	if getenv("LISTEN_PID") != strconv.Itoa(pid) {
+		// Either not socket-activated, or the variables were meant for
+		// another process (e.g. our parent).
+		return nil, nil
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %q", getenv("LISTEN_FDS"))
+	}
+	var names []string
+	if value := getenv("LISTEN_FDNAMES"); value != "" {
+		names = strings.Split(value, ":")
+	}
+	listeners := make([]activatedListener, 0, n)
+	for i := range n {
+		name := "unknown"
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(first+i), name)
+		// net.FileListener dups the file descriptor (with close-on-exec
+		// set), so the original can be closed.
+		l, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			for _, al := range listeners {
+				_ = al.Close()
+			}
+			return nil, fmt.Errorf("error using socket %q from systemd: %w", name, err)
+		}
+		listeners = append(listeners, activatedListener{name, l})
+	}
+	return listeners, nil
+}
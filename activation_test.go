@@ -0,0 +1,86 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenFDs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close() //nolint:errcheck
+	f, err := l.(*net.TCPListener).File()
+	require.NoError(t, err)
+	// listenFDs takes ownership of the file descriptor, so pass it a
+	// duplicate that f won't close.
+	fd, err := syscall.Dup(int(f.Fd()))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	env := map[string]string{
+		"LISTEN_PID":     "42",
+		"LISTEN_FDS":     "1",
+		"LISTEN_FDNAMES": "socks",
+	}
+	listeners, err := listenFDs(func(name string) string { return env[name] }, 42, fd)
+	require.NoError(t, err)
+	require.Len(t, listeners, 1)
+	defer listeners[0].Close() //nolint:errcheck
+	assert.Equal(t, "socks", listeners[0].name)
+	assert.Equal(t, l.Addr().String(), listeners[0].Addr().String())
+
+	// The listener is usable after the passed-in file descriptor has been
+	// closed.
+	go func() {
+		conn, err := listeners[0].Accept()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	_ = conn.Close()
+}
+
+func TestListenFDsNotActivated(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		env  map[string]string
+	}{
+		{"NoVariables", map[string]string{}},
+		{"OtherProcess", map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1"}},
+		{"NoSockets", map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "0"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			getenv := func(name string) string { return test.env[name] }
+			listeners, err := listenFDs(getenv, 42, listenFDsStart)
+			require.NoError(t, err)
+			assert.Empty(t, listeners)
+		})
+	}
+}
+
+func TestListenFDsInvalid(t *testing.T) {
+	env := map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "lots"}
+	_, err := listenFDs(func(name string) string { return env[name] }, 42, listenFDsStart)
+	assert.Error(t, err)
+}
@@ -15,13 +15,19 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/md5"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
+	"unicode/utf16"
 
 	"github.com/samuong/go-ntlmssp"
 )
@@ -38,43 +44,185 @@ func (a authenticator) scheme() string { return "NTLM" }
 func (a authenticator) applicableTo(string) bool { return true }
 
 func (a authenticator) do(req *http.Request, rt http.RoundTripper) (*http.Response, error) {
+	ctx := req.Context()
 	hostname, _ := os.Hostname() // in case of error, just use the zero value ("") as hostname
 	negotiate, err := ntlmssp.NewNegotiateMessage(a.domain, hostname)
 	if err != nil {
-		log.Printf("Error creating NTLM Type 1 (Negotiate) message: %v", err)
+		slog.ErrorContext(ctx, "Error creating NTLM Type 1 (Negotiate) message", "error", err)
 		return nil, err
 	}
 	req.Header.Set("Proxy-Authorization", "NTLM "+base64.StdEncoding.EncodeToString(negotiate))
 	resp, err := rt.RoundTrip(req)
 	if err != nil {
-		log.Printf("Error sending NTLM Type 1 (Negotiate) request: %v", err)
+		slog.ErrorContext(ctx, "Error sending NTLM Type 1 (Negotiate) request", "error", err)
 		return nil, err
 	} else if resp.StatusCode != http.StatusProxyAuthRequired {
-		log.Printf("Expected response with status 407, got %s", resp.Status)
+		slog.WarnContext(ctx, "Expected response with status 407", "status", resp.StatusCode)
 		return resp, nil
 	}
 	_ = resp.Body.Close()
 	encoded := findNTLMChallenge(resp.Header)
 	if encoded == "" {
-		log.Printf("NTLM Type 2 (Challenge) message not found in Proxy-Authenticate")
+		slog.ErrorContext(ctx, "NTLM Type 2 (Challenge) message not found in Proxy-Authenticate")
 		return nil, fmt.Errorf("missing NTLM challenge in proxy response")
 	}
 	challenge, err := base64.StdEncoding.DecodeString(encoded)
 	if err != nil {
-		log.Printf("Error decoding NTLM Type 2 (Challenge) message: %v", err)
+		slog.ErrorContext(ctx, "Error decoding NTLM Type 2 (Challenge) message", "error", err)
 		return nil, err
 	}
-	authenticate, err := ntlmssp.ProcessChallengeWithHash(
-		challenge, a.domain, a.username, a.hash)
+	// resp.TLS is set if we're talking to an HTTPS proxy, in which case
+	// the Type 3 message must be bound to this TLS connection.
+	bound, mic := challenge, false
+	if cb := tlsServerEndPoint(resp.TLS); cb != nil {
+		bound, mic, err = addNTLMChannelBindings(challenge, channelBindingsHash(cb))
+		if err != nil {
+			slog.ErrorContext(ctx, "Error adding channel bindings to NTLM Type 2 "+
+				"(Challenge) message", "error", err)
+			return nil, err
+		}
+	}
+	authenticate, err := ntlmssp.ProcessChallengeWithHash(bound, a.domain, a.username, a.hash)
 	if err != nil {
-		log.Printf("Error processing NTLM Type 2 (Challenge) message: %v", err)
+		slog.ErrorContext(ctx, "Error processing NTLM Type 2 (Challenge) message", "error", err)
 		return nil, err
 	}
+	if mic {
+		authenticate, err = addNTLMMIC(authenticate, a.responseKey(), negotiate, challenge)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error adding MIC to NTLM Type 3 (Authenticate) message",
+				"error", err)
+			return nil, err
+		}
+	}
 	req.Header.Set("Proxy-Authorization",
 		"NTLM "+base64.StdEncoding.EncodeToString(authenticate))
 	return rt.RoundTrip(req)
 }
 
+// AvIds of the AV pairs in an NTLM TargetInfo (see MS-NLMP section 2.2.2.1).
+const (
+	ntlmAvFlags           = 0x0006
+	ntlmAvTimestamp       = 0x0007
+	ntlmAvChannelBindings = 0x000a
+)
+
+// ntlmAvFlagMIC is the bit in MsvAvFlags that says the Type 3 message has a
+// MIC.
+const ntlmAvFlagMIC = 0x00000002
+
+// addNTLMChannelBindings returns a copy of an NTLM Type 2 (Challenge) message
+// with an MsvAvChannelBindings pair added to its TargetInfo. go-ntlmssp
+// copies the TargetInfo verbatim into the NTLMv2 response that it puts in
+// the Type 3 message, which is where the client's channel bindings belong
+// (MS-NLMP section 3.1.5.1.2).
+//
+// If the challenge has an MsvAvTimestamp, which is what servers that enforce
+// EPA send, the server expects a MIC as well. In that case, the MIC bit is
+// set in MsvAvFlags, and mic is true: the caller must then add the MIC to the
+// Type 3 message with addNTLMMIC.
+func addNTLMChannelBindings(challenge, cbHash []byte) (msg []byte, mic bool, err error) {
+	// TargetInfoFields is a (Len, MaxLen, BufferOffset) triple at offset 40.
+	if len(challenge) < 48 {
+		return nil, false, errors.New("NTLM challenge message too short")
+	}
+	length := int(binary.LittleEndian.Uint16(challenge[40:]))
+	offset := int(binary.LittleEndian.Uint32(challenge[44:]))
+	if offset+length > len(challenge) {
+		return nil, false, errors.New("NTLM challenge TargetInfo out of bounds")
+	}
+	var pairs []byte
+	var flags uint32
+	for info := challenge[offset : offset+length]; len(info) >= 4; {
+		id := binary.LittleEndian.Uint16(info)
+		n := 4 + int(binary.LittleEndian.Uint16(info[2:]))
+		if n > len(info) {
+			return nil, false, errors.New("NTLM challenge TargetInfo truncated")
+		} else if id == 0 { // MsvAvEOL
+			break
+		} else if id == ntlmAvFlags && n == 8 {
+			flags = binary.LittleEndian.Uint32(info[4:])
+		} else if id != ntlmAvChannelBindings {
+			mic = mic || id == ntlmAvTimestamp
+			pairs = append(pairs, info[:n]...)
+		}
+		info = info[n:]
+	}
+	if mic {
+		flags |= ntlmAvFlagMIC
+	}
+	if flags != 0 {
+		pairs = binary.LittleEndian.AppendUint16(pairs, ntlmAvFlags)
+		pairs = binary.LittleEndian.AppendUint16(pairs, 4)
+		pairs = binary.LittleEndian.AppendUint32(pairs, flags)
+	}
+	pairs = binary.LittleEndian.AppendUint16(pairs, ntlmAvChannelBindings)
+	pairs = binary.LittleEndian.AppendUint16(pairs, uint16(len(cbHash)))
+	pairs = append(pairs, cbHash...)
+	pairs = append(pairs, 0, 0, 0, 0) // MsvAvEOL
+	// Put the new TargetInfo at the end of the message, and point the
+	// TargetInfoFields at it.
+	msg = append(slices.Clip(challenge), pairs...)
+	binary.LittleEndian.PutUint16(msg[40:], uint16(len(pairs)))
+	binary.LittleEndian.PutUint16(msg[42:], uint16(len(pairs)))
+	binary.LittleEndian.PutUint32(msg[44:], uint32(len(challenge)))
+	return msg, mic, nil
+}
+
+// responseKey returns the NTLMv2 ResponseKeyNT for a's credentials (see
+// NTOWFv2 in MS-NLMP section 3.3.2), as go-ntlmssp computes it.
+func (a authenticator) responseKey() []byte {
+	var user []byte
+	for _, c := range utf16.Encode([]rune(strings.ToUpper(a.username) + a.domain)) {
+		user = binary.LittleEndian.AppendUint16(user, c)
+	}
+	return hmacMD5(a.hash, user)
+}
+
+func hmacMD5(key, data []byte) []byte {
+	mac := hmac.New(md5.New, key)
+	_, _ = mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// addNTLMMIC returns a copy of an NTLM Type 3 (Authenticate) message from
+// go-ntlmssp, with a MIC added (see MS-NLMP section 3.1.5.1.2). go-ntlmssp
+// leaves out the optional Version field, and the MIC that follows it, so they
+// are inserted after the fixed-length fields, and the payload offsets are
+// moved along to match. The MIC is an HMAC-MD5 of the negotiate, challenge
+// and authenticate messages, keyed with the session key. go-ntlmssp never
+// does key exchange, so that's the NTLMv2 SessionBaseKey.
+func addNTLMMIC(authenticate, responseKey, negotiate, challenge []byte) ([]byte, error) {
+	const (
+		fieldsLength = 64 // up to and including NegotiateFlags
+		micOffset    = 72 // after the 8-byte Version
+		micLength    = 16
+	)
+	if len(authenticate) < fieldsLength {
+		return nil, errors.New("NTLM authenticate message too short")
+	}
+	inserted := micOffset + micLength - fieldsLength
+	msg := slices.Concat(authenticate[:fieldsLength], make([]byte, inserted),
+		authenticate[fieldsLength:])
+	// The (Len, MaxLen, BufferOffset) fields for LmChallengeResponse,
+	// NtChallengeResponse, DomainName, UserName, Workstation and
+	// EncryptedRandomSessionKey.
+	for field := 12; field < 60; field += 8 {
+		if offset := binary.LittleEndian.Uint32(msg[field+4:]); offset >= fieldsLength {
+			binary.LittleEndian.PutUint32(msg[field+4:], offset+uint32(inserted))
+		}
+	}
+	length := int(binary.LittleEndian.Uint16(msg[20:]))
+	offset := int(binary.LittleEndian.Uint32(msg[24:]))
+	if length < 16 || offset+length > len(msg) {
+		return nil, errors.New("NTLM authenticate message has no NTLMv2 response")
+	}
+	// The NTLMv2 response starts with the NTProofStr.
+	sessionKey := hmacMD5(responseKey, msg[offset:offset+16])
+	copy(msg[micOffset:], hmacMD5(sessionKey, slices.Concat(negotiate, challenge, msg)))
+	return msg, nil
+}
+
 // findNTLMChallenge scans every Proxy-Authenticate header value for an
 // NTLM challenge and returns the base64-encoded Type 2 message.
 //
@@ -16,13 +16,17 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"slices"
 	"strings"
 	"testing"
 
@@ -33,6 +37,10 @@ import (
 
 type ntlmServer struct {
 	t *testing.T
+	// negotiate and authenticate, if not nil, are called with each Type 1
+	// and Type 3 message.
+	negotiate    func(msg []byte)
+	authenticate func(msg []byte)
 }
 
 func (s ntlmServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -47,8 +55,14 @@ func (s ntlmServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	msgType := binary.LittleEndian.Uint32(msg[8:12])
 	switch msgType {
 	case 1:
+		if s.negotiate != nil {
+			s.negotiate(msg)
+		}
 		sendChallengeResponse(w)
 	case 3:
+		if s.authenticate != nil {
+			s.authenticate(msg)
+		}
 		req.Header.Del("Proxy-Authenticate")
 		_, err := w.Write([]byte("Access granted"))
 		require.NoError(s.t, err)
@@ -64,13 +78,17 @@ func sendProxyAuthRequired(w http.ResponseWriter) {
 	_, _ = fmt.Fprintf(w, "<html><body>oh noes!</body></html>")
 }
 
+// testChallenge is the Type 2 message that ntlmServer sends. Its TargetInfo
+// has an MsvAvTimestamp.
+const testChallenge = "TlRMTVNTUAACAAAADAAMADgAAAAFgomi+Rp9UDbAycMAAAAAAAAAAKIAogBEAAAABgEAAAAAAA9HAEwATwBCAEEATAACAAwARwBMAE8AQgBBAEwAAQAeAFAAWABZAEEAVQAwADAAMgBNAEUATAAwADEAMAAzAAQAHABnAGwAbwBiAGEAbAAuAGEAbgB6AC4AYwBvAG0AAwA8AHAAeAB5AGEAdQAwADAAMgBtAGUAbAAwADEAMAAzAC4AZwBsAG8AYgBhAGwALgBhAG4AegAuAGMAbwBtAAcACABQ7ZOkOQbVAQAAAAA="
+
 func sendChallengeResponse(w http.ResponseWriter) {
-	w.Header().Set("Proxy-Authenticate", "NTLM TlRMTVNTUAACAAAADAAMADgAAAAFgomi+Rp9UDbAycMAAAAAAAAAAKIAogBEAAAABgEAAAAAAA9HAEwATwBCAEEATAACAAwARwBMAE8AQgBBAEwAAQAeAFAAWABZAEEAVQAwADAAMgBNAEUATAAwADEAMAAzAAQAHABnAGwAbwBiAGEAbAAuAGEAbgB6AC4AYwBvAG0AAwA8AHAAeAB5AGEAdQAwADAAMgBtAGUAbAAwADEAMAAzAC4AZwBsAG8AYgBhAGwALgBhAG4AegAuAGMAbwBtAAcACABQ7ZOkOQbVAQAAAAA=")
+	w.Header().Set("Proxy-Authenticate", "NTLM "+testChallenge)
 	w.WriteHeader(http.StatusProxyAuthRequired)
 }
 
 func TestNtlmAuth(t *testing.T) {
-	server := httptest.NewServer(ntlmServer{t})
+	server := httptest.NewServer(ntlmServer{t: t})
 	defer server.Close()
 	serverAddr := server.Listener.Addr().String()
 	tr := &http.Transport{Proxy: http.ProxyURL(&url.URL{Host: serverAddr})}
@@ -90,6 +108,204 @@ func TestNtlmAuth(t *testing.T) {
 	assert.Equal(t, "Access granted", string(body))
 }
 
+// ntlmAvPair returns the value of the AV pair with the given ID in the
+// NTLMv2 response of a Type 3 message, or nil if there isn't one.
+func ntlmAvPair(t *testing.T, msg []byte, id uint16) []byte {
+	// NtChallengeResponseFields is at offset 20. The AV pairs start after
+	// the 16-byte NTProofStr and the 28-byte header of the NTLMv2 blob.
+	length := binary.LittleEndian.Uint16(msg[20:])
+	offset := binary.LittleEndian.Uint32(msg[24:])
+	require.LessOrEqual(t, int(offset)+int(length), len(msg))
+	pairs := msg[offset+44 : offset+uint32(length)]
+	for len(pairs) >= 4 {
+		n := 4 + int(binary.LittleEndian.Uint16(pairs[2:]))
+		if binary.LittleEndian.Uint16(pairs) == id {
+			return pairs[4:n]
+		}
+		pairs = pairs[n:]
+	}
+	return nil
+}
+
+// ntlmField returns the payload of the (Len, MaxLen, BufferOffset) field at
+// the given offset in an NTLM message.
+func ntlmField(t *testing.T, msg []byte, field int) []byte {
+	length := binary.LittleEndian.Uint16(msg[field:])
+	offset := binary.LittleEndian.Uint32(msg[field+4:])
+	require.LessOrEqual(t, int(offset)+int(length), len(msg))
+	return msg[offset : offset+uint32(length)]
+}
+
+func TestNtlmAuthChannelBindings(t *testing.T) {
+	var negotiate, authenticate []byte
+	handler := ntlmServer{
+		t:            t,
+		negotiate:    func(msg []byte) { negotiate = msg },
+		authenticate: func(msg []byte) { authenticate = msg },
+	}
+	t.Run("HTTP", func(t *testing.T) {
+		server := httptest.NewServer(handler)
+		defer server.Close()
+		proxyURL, err := url.Parse(server.URL)
+		require.NoError(t, err)
+		tr := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+		defer tr.CloseIdleConnections()
+		req, err := http.NewRequest(http.MethodGet, "http://www.example.com", nil)
+		require.NoError(t, err)
+		auth := &authenticator{"isis", "malory", ntlmssp.GetNtlmHash("guest")}
+		resp, err := auth.do(req, tr)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Nil(t, ntlmAvPair(t, authenticate, ntlmAvChannelBindings))
+		assert.Nil(t, ntlmAvPair(t, authenticate, ntlmAvFlags))
+	})
+	t.Run("HTTPS", func(t *testing.T) {
+		server := httptest.NewTLSServer(handler)
+		defer server.Close()
+		proxyURL, err := url.Parse(server.URL)
+		require.NoError(t, err)
+		tr := server.Client().Transport.(*http.Transport).Clone()
+		tr.Proxy = http.ProxyURL(proxyURL)
+		defer tr.CloseIdleConnections()
+		req, err := http.NewRequest(http.MethodGet, "http://www.example.com", nil)
+		require.NoError(t, err)
+		auth := &authenticator{"isis", "malory", ntlmssp.GetNtlmHash("guest")}
+		resp, err := auth.do(req, tr)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		cb := tlsServerEndPoint(&tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{server.Certificate()},
+		})
+		assert.Equal(t, channelBindingsHash(cb),
+			ntlmAvPair(t, authenticate, ntlmAvChannelBindings))
+		// The pairs that the proxy sent (e.g. MsvAvTimestamp) must
+		// still be there.
+		assert.NotNil(t, ntlmAvPair(t, authenticate, ntlmAvTimestamp))
+
+		// Since there's a timestamp, the message has a MIC, which the
+		// server checks like this (MS-NLMP section 3.2.5.1.2).
+		assert.Equal(t, []byte{2, 0, 0, 0}, ntlmAvPair(t, authenticate, ntlmAvFlags))
+		challenge, err := base64.StdEncoding.DecodeString(testChallenge)
+		require.NoError(t, err)
+		mic := slices.Clone(authenticate[72:88])
+		zeroed := slices.Clone(authenticate)
+		clear(zeroed[72:88])
+		sessionKey := hmacMD5(auth.responseKey(), ntlmField(t, authenticate, 20)[:16])
+		assert.Equal(t, hmacMD5(sessionKey, slices.Concat(negotiate, challenge, zeroed)), mic)
+		// The other fields were moved along to make room for it.
+		assert.Equal(t, []byte("m\x00a\x00l\x00o\x00r\x00y\x00"),
+			ntlmField(t, authenticate, 36))
+		assert.Equal(t, []byte("i\x00s\x00i\x00s\x00"), ntlmField(t, authenticate, 28))
+	})
+}
+
+func TestNTLMResponseKey(t *testing.T) {
+	// The NTLMv2 example in MS-NLMP section 4.2.4.
+	auth := authenticator{"Domain", "User", ntlmssp.GetNtlmHash("Password")}
+	responseKey, err := hex.DecodeString("0c868a403bfd7a93a3001ef22ef02e3f")
+	require.NoError(t, err)
+	assert.Equal(t, responseKey, auth.responseKey())
+	ntProofStr, err := hex.DecodeString("68cd0ab851e51c96aabc927bebef6a1c")
+	require.NoError(t, err)
+	sessionKey, err := hex.DecodeString("8de40ccadbc14a82f15cb0ad0de95ca3")
+	require.NoError(t, err)
+	assert.Equal(t, sessionKey, hmacMD5(auth.responseKey(), ntProofStr))
+}
+
+func TestAddNTLMMIC(t *testing.T) {
+	t.Run("TooShort", func(t *testing.T) {
+		_, err := addNTLMMIC([]byte("NTLMSSP\x00"), nil, nil, nil)
+		assert.Error(t, err)
+	})
+	t.Run("NoNTLMv2Response", func(t *testing.T) {
+		msg := make([]byte, 64)
+		copy(msg, "NTLMSSP\x00\x03")
+		_, err := addNTLMMIC(msg, nil, nil, nil)
+		assert.Error(t, err)
+	})
+}
+
+func TestAddNTLMChannelBindings(t *testing.T) {
+	// A Type 2 message header, with TargetInfoFields pointing at the
+	// given pairs.
+	challenge := func(pairs ...byte) []byte {
+		msg := make([]byte, 48, 48+len(pairs))
+		copy(msg, "NTLMSSP\x00\x02")
+		binary.LittleEndian.PutUint16(msg[40:], uint16(len(pairs)))
+		binary.LittleEndian.PutUint16(msg[42:], uint16(len(pairs)))
+		binary.LittleEndian.PutUint32(msg[44:], 48)
+		return append(msg, pairs...)
+	}
+	hash := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	cbPair := append([]byte{10, 0, 16, 0}, hash...)
+	eol := []byte{0, 0, 0, 0}
+	micFlags := []byte{6, 0, 4, 0, 2, 0, 0, 0}
+	tests := []struct {
+		name  string
+		input []byte
+		want  []byte // the new TargetInfo
+		mic   bool
+	}{
+		{
+			name:  "NoTargetInfo",
+			input: challenge(),
+			want:  slices.Concat(cbPair, eol),
+		},
+		{
+			name:  "KeepsOtherPairs",
+			input: challenge(2, 0, 2, 0, 'A', 0, 3, 0, 1, 0, 9, 0, 0, 0),
+			want:  slices.Concat([]byte{2, 0, 2, 0, 'A', 0, 3, 0, 1, 0, 9}, cbPair, eol),
+		},
+		{
+			name:  "ReplacesChannelBindings",
+			input: challenge(10, 0, 2, 0, 0xff, 0xff, 0, 0, 0, 0),
+			want:  slices.Concat(cbPair, eol),
+		},
+		{
+			name:  "TimestampNeedsMIC",
+			input: challenge(7, 0, 1, 0, 9, 0, 0, 0, 0),
+			want:  slices.Concat([]byte{7, 0, 1, 0, 9}, micFlags, cbPair, eol),
+			mic:   true,
+		},
+		{
+			name:  "KeepsFlags",
+			input: challenge(6, 0, 4, 0, 1, 0, 0, 0, 7, 0, 1, 0, 9, 0, 0, 0, 0),
+			want: slices.Concat([]byte{7, 0, 1, 0, 9}, []byte{6, 0, 4, 0, 3, 0, 0, 0},
+				cbPair, eol),
+			mic: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := slices.Clone(test.input)
+			msg, mic, err := addNTLMChannelBindings(test.input, hash)
+			require.NoError(t, err)
+			assert.Equal(t, test.mic, mic)
+			assert.Equal(t, input, test.input, "input was modified")
+			assert.Equal(t, input[:40], msg[:40])
+			length := binary.LittleEndian.Uint16(msg[40:])
+			offset := binary.LittleEndian.Uint32(msg[44:])
+			assert.Equal(t, test.want, msg[offset:offset+uint32(length)])
+		})
+	}
+	t.Run("TooShort", func(t *testing.T) {
+		_, _, err := addNTLMChannelBindings([]byte("NTLMSSP\x00"), hash)
+		assert.Error(t, err)
+	})
+	t.Run("OutOfBounds", func(t *testing.T) {
+		msg := challenge(2, 0, 2, 0, 'A', 0, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint16(msg[40:], 100)
+		_, _, err := addNTLMChannelBindings(msg, hash)
+		assert.Error(t, err)
+	})
+	t.Run("Truncated", func(t *testing.T) {
+		_, _, err := addNTLMChannelBindings(challenge(2, 0, 9, 0, 'A', 0), hash)
+		assert.Error(t, err)
+	})
+}
+
 func TestFindNTLMChallenge(t *testing.T) {
 	tests := []struct {
 		name    string
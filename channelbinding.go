@@ -0,0 +1,91 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"hash"
+)
+
+// Proxies that enforce Extended Protection for Authentication (EPA) require
+// NTLM and Kerberos tokens to be bound to the TLS connection that carries
+// them, so that a token captured by a man-in-the-middle can't be replayed
+// on a different connection. Alpaca only uses TLS to talk to "HTTPS"
+// proxies, so that's the only time these bindings are sent.
+
+// contextKeyChannelBinding holds the tls-server-end-point channel binding
+// for the connection to the upstream proxy, for authenticators (notably
+// Negotiate) that need it before they send their first request.
+const contextKeyChannelBinding = contextKey("channel-binding")
+
+// tlsServerEndPoint returns the tls-server-end-point channel binding (RFC
+// 5929, section 4) for a TLS connection, or nil if there isn't one.
+func tlsServerEndPoint(state *tls.ConnectionState) []byte {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := state.PeerCertificates[0]
+	// Use the certificate's signature hash, except that MD5 and SHA-1
+	// are upgraded to SHA-256. SHA-256 is also used for algorithms that
+	// RFC 5929 doesn't cover, such as Ed25519.
+	var h hash.Hash
+	switch cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.SHA384WithRSAPSS, x509.ECDSAWithSHA384:
+		h = sha512.New384()
+	case x509.SHA512WithRSA, x509.SHA512WithRSAPSS, x509.ECDSAWithSHA512:
+		h = sha512.New()
+	default:
+		h = sha256.New()
+	}
+	h.Write(cert.Raw)
+	return h.Sum([]byte("tls-server-end-point:"))
+}
+
+// withChannelBinding returns a copy of ctx that holds the channel binding
+// for a TLS connection. If state is nil (i.e. the proxy doesn't use TLS),
+// ctx is returned unchanged.
+func withChannelBinding(ctx context.Context, state *tls.ConnectionState) context.Context {
+	if cb := tlsServerEndPoint(state); cb != nil {
+		return context.WithValue(ctx, contextKeyChannelBinding, cb)
+	}
+	return ctx
+}
+
+// channelBindingFromContext returns the channel binding set by
+// withChannelBinding, or nil.
+func channelBindingFromContext(ctx context.Context) []byte {
+	cb, _ := ctx.Value(contextKeyChannelBinding).([]byte)
+	return cb
+}
+
+// channelBindingsHash returns the MD5 hash of a gss_channel_bindings_struct
+// that contains only the given application data (no initiator or acceptor
+// addresses), as used by NTLM's MsvAvChannelBindings and the Kerberos
+// authenticator checksum (RFC 4121, section 4.1.1.2).
+func channelBindingsHash(appData []byte) []byte {
+	// initiator_addrtype, initiator_address.length, acceptor_addrtype,
+	// acceptor_address.length and application_data.length, all as
+	// little-endian 32-bit integers.
+	b := make([]byte, 20, 20+len(appData))
+	binary.LittleEndian.PutUint32(b[16:], uint32(len(appData)))
+	sum := md5.Sum(append(b, appData...))
+	return sum[:]
+}
@@ -0,0 +1,211 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSServerEndPoint(t *testing.T) {
+	raw := []byte("not really a certificate")
+	sha256sum := sha256.Sum256(raw)
+	sha384sum := sha512.Sum384(raw)
+	sha512sum := sha512.Sum512(raw)
+	tests := []struct {
+		alg  x509.SignatureAlgorithm
+		hash []byte
+	}{
+		{x509.MD5WithRSA, sha256sum[:]},
+		{x509.SHA1WithRSA, sha256sum[:]},
+		{x509.ECDSAWithSHA1, sha256sum[:]},
+		{x509.SHA256WithRSA, sha256sum[:]},
+		{x509.ECDSAWithSHA256, sha256sum[:]},
+		{x509.SHA384WithRSA, sha384sum[:]},
+		{x509.ECDSAWithSHA384, sha384sum[:]},
+		{x509.SHA512WithRSAPSS, sha512sum[:]},
+		{x509.ECDSAWithSHA512, sha512sum[:]},
+		{x509.PureEd25519, sha256sum[:]},
+	}
+	for _, test := range tests {
+		t.Run(test.alg.String(), func(t *testing.T) {
+			state := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+				{Raw: raw, SignatureAlgorithm: test.alg},
+			}}
+			want := append([]byte("tls-server-end-point:"), test.hash...)
+			assert.Equal(t, want, tlsServerEndPoint(state))
+		})
+	}
+}
+
+func TestTLSServerEndPointWithoutTLS(t *testing.T) {
+	assert.Nil(t, tlsServerEndPoint(nil))
+	assert.Nil(t, tlsServerEndPoint(&tls.ConnectionState{}))
+	ctx := withChannelBinding(context.Background(), nil)
+	assert.Nil(t, channelBindingFromContext(ctx))
+}
+
+func TestChannelBindingsHash(t *testing.T) {
+	// Four zero fields for the (empty) addresses, then the length of the
+	// application data and the data itself.
+	b := []byte{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		3, 0, 0, 0, 'a', 'b', 'c',
+	}
+	want := md5.Sum(b)
+	assert.Equal(t, want[:], channelBindingsHash([]byte("abc")))
+}
+
+// bindingAuth is an authenticator that records the channel binding that it
+// sees in each request's context.
+type bindingAuth struct {
+	seen [][]byte
+}
+
+func (a *bindingAuth) scheme() string { return "Test" }
+
+func (a *bindingAuth) applicableTo(string) bool { return true }
+
+func (a *bindingAuth) do(req *http.Request, rt http.RoundTripper) (*http.Response, error) {
+	a.seen = append(a.seen, channelBindingFromContext(req.Context()))
+	req.Header.Set("Proxy-Authorization", "Test ok")
+	return rt.RoundTrip(req)
+}
+
+func TestChannelBindingForHTTPSProxy(t *testing.T) {
+	proxy := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("Proxy-Authorization") != "Test ok" {
+				w.Header().Set("Proxy-Authenticate", "Test")
+				w.WriteHeader(http.StatusProxyAuthRequired)
+			}
+		}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+	oldConfig := tlsClientConfig
+	tlsClientConfig = &tls.Config{RootCAs: x509.NewCertPool()}
+	tlsClientConfig.RootCAs.AddCert(proxy.Certificate())
+	defer func() { tlsClientConfig = oldConfig }()
+	want := tlsServerEndPoint(&tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{proxy.Certificate()},
+	})
+
+	t.Run("CONNECT", func(t *testing.T) {
+		auth := &bindingAuth{}
+		req, err := http.NewRequest(http.MethodConnect, "https://example.com:443", nil)
+		require.NoError(t, err)
+		conn, err := connectViaProxy(req, proxyURL, newAuthChain(auth))
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+		assert.Equal(t, [][]byte{want}, auth.seen)
+	})
+
+	t.Run("GET", func(t *testing.T) {
+		auth := &bindingAuth{}
+		ph := NewProxyHandler(newAuthChain(auth), http.ProxyURL(proxyURL), func(*url.URL) {})
+		defer ph.transport.CloseIdleConnections()
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), contextKeyProxy, proxyURL))
+		w := httptest.NewRecorder()
+		ph.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, [][]byte{want}, auth.seen)
+	})
+}
+
+// boundAuth is a Negotiate-like authenticator whose token is the channel
+// binding that it sees in the request's context (or "unbound").
+type boundAuth struct{}
+
+func (boundAuth) scheme() string { return "Negotiate" }
+
+func (boundAuth) applicableTo(string) bool { return true }
+
+func (boundAuth) do(req *http.Request, rt http.RoundTripper) (*http.Response, error) {
+	token := "unbound"
+	if cb := channelBindingFromContext(req.Context()); cb != nil {
+		token = base64.StdEncoding.EncodeToString(cb)
+	}
+	req.Header.Set("Proxy-Authorization", "Negotiate "+token)
+	return rt.RoundTrip(req)
+}
+
+func TestProactiveAuthWithEPA(t *testing.T) {
+	// The proxy enforces channel binding (Extended Protection for
+	// Authentication), so it only accepts a token that's bound to its
+	// certificate.
+	var mu sync.Mutex
+	var seen []string
+	var want string
+	proxy := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			seen = append(seen, req.Header.Get("Proxy-Authorization"))
+			if req.Header.Get("Proxy-Authorization") != want {
+				w.Header().Set("Proxy-Authenticate", "Negotiate")
+				w.WriteHeader(http.StatusProxyAuthRequired)
+			}
+		}))
+	defer proxy.Close()
+	want = "Negotiate " + base64.StdEncoding.EncodeToString(tlsServerEndPoint(
+		&tls.ConnectionState{PeerCertificates: []*x509.Certificate{proxy.Certificate()}}))
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+	oldConfig := tlsClientConfig
+	tlsClientConfig = &tls.Config{RootCAs: x509.NewCertPool()}
+	tlsClientConfig.RootCAs.AddCert(proxy.Certificate())
+	defer func() { tlsClientConfig = oldConfig }()
+
+	chain := newAuthChain(boundAuth{})
+	chain.known = newSchemeCache(time.Minute)
+	ph := NewProxyHandler(chain, http.ProxyURL(proxyURL), func(*url.URL) {})
+	defer ph.transport.CloseIdleConnections()
+	send := func() []string {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), contextKeyProxy, proxyURL))
+		w := httptest.NewRecorder()
+		ph.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		mu.Lock()
+		defer mu.Unlock()
+		requests := seen
+		seen = nil
+		return requests
+	}
+
+	assert.Equal(t, []string{"", want}, send())
+	// The proactive token can't be bound, so the proxy rejects it...
+	assert.Equal(t, []string{"Negotiate unbound", want}, send())
+	// ...and it isn't sent proactively again.
+	assert.Nil(t, chain.remembered(proxyURL))
+	assert.Equal(t, []string{"", want}, send())
+	assert.Equal(t, []string{"", want}, send())
+}
@@ -0,0 +1,377 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config holds every setting that can come from the config file, the
+// environment, or the command line. Sources are layered in that order,
+// so a flag overrides an environment variable, which overrides the file:
+//
+//  1. defaultConfig()
+//  2. the YAML config file (loadConfigFile)
+//  3. environment variables (applyEnv)
+//  4. command-line flags that were explicitly set (see main)
+//
+// Fields that are absent from a layer leave the previous layer's value
+// untouched.
+type config struct {
+	Listen          []string      `yaml:"listen"`
+	Port            int           `yaml:"port"`
+	SocksPort       int           `yaml:"socks_port"`
+	TransparentPort int           `yaml:"transparent_port"`
+	UnixSocket      string        `yaml:"unix_socket"`
+	UnixSocketMode  string        `yaml:"unix_socket_mode"`
+	UnixSocketOwner string        `yaml:"unix_socket_owner"`
+	PACURL          string        `yaml:"pac_url"`
+	WPAD            bool          `yaml:"wpad"`
+	EnableSocks     bool          `yaml:"enable_socks"`
+	HTTP2           bool          `yaml:"http2"`
+	HealthCheckHost string        `yaml:"health_check_host"`
+	ShutdownTimeout string        `yaml:"shutdown_timeout"`
+	Quiet           bool          `yaml:"quiet"`
+	LogLevel        string        `yaml:"log_level"`
+	LogFormat       string        `yaml:"log_format"`
+	Auth            authConfig    `yaml:"auth"`
+	Clients         clientsConfig `yaml:"clients"`
+	Limits          limitsConfig  `yaml:"limits"`
+}
+
+// authConfig is the `auth:` section of the config file. Methods lists the
+// authentication schemes to enable, most-preferred first; a scheme that is
+// left out is never attempted, even if credentials for it are available.
+type authConfig struct {
+	Methods          []string `yaml:"methods"`
+	Allowlist        []string `yaml:"allowlist"`
+	BasicCredentials string   `yaml:"basic_credentials"`
+	NTLMCredentials  string   `yaml:"ntlm_credentials"`
+	NTLMUsername     string   `yaml:"ntlm_username"`
+	NTLMDomain       string   `yaml:"ntlm_domain"`
+	// NTLMPrompt asks for the password for NTLMDomain\NTLMUsername on the
+	// terminal at startup, as -d does. The username defaults to the
+	// current user.
+	NTLMPrompt bool `yaml:"ntlm_prompt"`
+	// SchemeTTL is how long to remember the scheme that a proxy accepted,
+	// and use it without waiting for a 407 (e.g. "10m"; "0" disables).
+	SchemeTTL string `yaml:"scheme_ttl"`
+}
+
+// clientsConfig is the `clients:` section of the config file, which controls
+// who may use alpaca (see clientAccess). Allow and Deny are lists of CIDR
+// prefixes; Credentials are "user:password" pairs that clients must send in
+// a Proxy-Authorization header.
+type clientsConfig struct {
+	Allow       []string `yaml:"allow"`
+	Deny        []string `yaml:"deny"`
+	Credentials []string `yaml:"credentials"`
+}
+
+// limitsConfig is the `limits:` section of the config file (see limits).
+// Durations and counts of 0 mean no limit, except that a MaxHeaderBytes of 0
+// uses the Go default of 1 MB.
+type limitsConfig struct {
+	// DialTimeout is how long to wait to connect to a proxy or server,
+	// including a proxy's response to CONNECT.
+	DialTimeout string `yaml:"dial_timeout"`
+	// HeaderTimeout is how long a client has to send a request's headers.
+	HeaderTimeout string `yaml:"header_timeout"`
+	// IdleTimeout is how long to keep an idle client connection open,
+	// waiting for its next request.
+	IdleTimeout string `yaml:"idle_timeout"`
+	// TunnelIdleTimeout is how long a tunnel can go without any data
+	// passing through it before it's closed.
+	TunnelIdleTimeout   string `yaml:"tunnel_idle_timeout"`
+	MaxHeaderBytes      int    `yaml:"max_header_bytes"`
+	MaxTunnelsPerClient int    `yaml:"max_tunnels_per_client"`
+}
+
+// defaultConfig returns the settings alpaca uses when nothing has been
+// configured. The method order matches Chrome's hierarchy (see
+// newAuthChain).
+func defaultConfig() *config {
+	return &config{
+		Port:            3128,
+		UnixSocketMode:  "0600",
+		ShutdownTimeout: "30s",
+		LogLevel:        "info",
+		LogFormat:       "text",
+		Auth: authConfig{
+			Methods:   []string{schemeNegotiate, schemeNTLM, schemeBasic},
+			SchemeTTL: "10m",
+		},
+		Limits: limitsConfig{
+			DialTimeout:       "30s",
+			HeaderTimeout:     "30s",
+			IdleTimeout:       "0",
+			TunnelIdleTimeout: "0",
+			MaxHeaderBytes:    1 << 20,
+		},
+	}
+}
+
+// defaultConfigPath returns the path that is checked for a config file when
+// the -config flag isn't given, e.g. ~/.config/alpaca/config.yaml on Linux.
+// It returns "" if the user's config directory can't be determined.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "alpaca", "config.yaml")
+}
+
+// loadConfigFile reads the YAML file at path and layers it on top of cfg.
+// If required is false, a missing file is not an error; this is used for
+// the default path, which most users won't have created.
+func loadConfigFile(cfg *config, path string, required bool) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) && !required {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error opening config file: %w", err)
+	}
+	defer f.Close() //nolint:errcheck
+	dec := yaml.NewDecoder(f)
+	// Reject unknown keys so that a typo (e.g. "pacurl" instead of
+	// "pac_url") is reported rather than silently ignored.
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+	if cfg.Auth.BasicCredentials != "" || cfg.Auth.NTLMCredentials != "" ||
+		len(cfg.Clients.Credentials) > 0 {
+		if info, err := f.Stat(); err == nil && info.Mode().Perm()&0o077 != 0 {
+			slog.Warn("Config file contains credentials but is readable by "+
+				"other users; consider running `chmod 600` on it", "path", path)
+		}
+	}
+	slog.Info("Loaded config", "path", path)
+	return nil
+}
+
+// applyEnv layers the environment variables that alpaca understands on top
+// of cfg. Empty variables are treated as unset.
+func (cfg *config) applyEnv(getenv func(string) string) {
+	if value := getenv("BASIC_CREDENTIALS"); value != "" {
+		cfg.Auth.BasicCredentials = value
+	}
+	if value := getenv("NTLM_CREDENTIALS"); value != "" {
+		cfg.Auth.NTLMCredentials = value
+	}
+	if value := getenv("NTLM_USERNAME"); value != "" {
+		cfg.Auth.NTLMUsername = value
+	}
+	if value := getenv("NTLM_DOMAIN"); value != "" {
+		cfg.Auth.NTLMDomain = value
+	}
+	if value := getenv("ALPACA_PROXY_AUTH_ALLOWLIST"); value != "" {
+		cfg.Auth.Allowlist = strings.Split(value, ",")
+	}
+	if value := getenv("ALPACA_AUTH_SCHEME_TTL"); value != "" {
+		cfg.Auth.SchemeTTL = value
+	}
+	if value := getenv("ALPACA_CLIENT_ALLOW"); value != "" {
+		cfg.Clients.Allow = strings.Split(value, ",")
+	}
+	if value := getenv("ALPACA_CLIENT_DENY"); value != "" {
+		cfg.Clients.Deny = strings.Split(value, ",")
+	}
+	if value := getenv("ALPACA_CLIENT_CREDENTIALS"); value != "" {
+		cfg.Clients.Credentials = []string{value}
+	}
+	if value := getenv("ALPACA_LOG_LEVEL"); value != "" {
+		cfg.LogLevel = value
+	}
+	if value := getenv("ALPACA_LOG_FORMAT"); value != "" {
+		cfg.LogFormat = value
+	}
+}
+
+// validate checks for settings that can't be caught by the YAML decoder.
+// Method names are normalised to lower case as a side effect.
+func (cfg *config) validate() error {
+	if cfg.Port < 0 || cfg.Port > 65535 {
+		return fmt.Errorf("invalid port number: %d", cfg.Port)
+	}
+	if cfg.SocksPort < 0 || cfg.SocksPort > 65535 {
+		return fmt.Errorf("invalid SOCKS5 port number: %d", cfg.SocksPort)
+	}
+	if cfg.TransparentPort < 0 || cfg.TransparentPort > 65535 {
+		return fmt.Errorf("invalid transparent port number: %d", cfg.TransparentPort)
+	}
+	if cfg.TransparentPort != 0 && !transparentSupported {
+		return errTransparentUnsupported
+	}
+	if cfg.TransparentPort != 0 && len(cfg.Clients.Credentials) > 0 {
+		// Redirected connections (and TLS ones in particular) can't
+		// carry Proxy-Authorization.
+		return errors.New("transparent port can't be used with client credentials " +
+			"(restrict transparent clients by address instead)")
+	}
+	if cfg.Auth.NTLMPrompt && cfg.Auth.NTLMDomain == "" {
+		return errors.New("ntlm_prompt needs a domain (set ntlm_domain, NTLM_DOMAIN or -d)")
+	}
+	if mode, err := strconv.ParseUint(cfg.UnixSocketMode, 8, 32); err != nil || mode > 0o777 {
+		return fmt.Errorf("invalid unix socket mode %q (expected an octal mode like 0600)",
+			cfg.UnixSocketMode)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return fmt.Errorf("invalid log level %q (expected debug, info, warn or error)",
+			cfg.LogLevel)
+	}
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		return fmt.Errorf("invalid log format %q (expected text or json)", cfg.LogFormat)
+	}
+	if ttl, err := time.ParseDuration(cfg.Auth.SchemeTTL); err != nil || ttl < 0 {
+		return fmt.Errorf("invalid auth scheme TTL %q (expected a duration like 10m, "+
+			"or 0 to disable)", cfg.Auth.SchemeTTL)
+	}
+	if timeout, err := time.ParseDuration(cfg.ShutdownTimeout); err != nil || timeout < 0 {
+		return fmt.Errorf("invalid shutdown timeout %q (expected a duration like 30s)",
+			cfg.ShutdownTimeout)
+	}
+	if cfg.HealthCheckHost != "" {
+		if _, _, err := net.SplitHostPort(cfg.HealthCheckHost); err != nil {
+			return fmt.Errorf("invalid health check host %q (expected host:port)",
+				cfg.HealthCheckHost)
+		}
+	}
+	if _, err := newClientAccess(cfg.Clients); err != nil {
+		return err
+	}
+	for _, setting := range []struct{ name, value string }{
+		{"dial timeout", cfg.Limits.DialTimeout},
+		{"header timeout", cfg.Limits.HeaderTimeout},
+		{"idle timeout", cfg.Limits.IdleTimeout},
+		{"tunnel idle timeout", cfg.Limits.TunnelIdleTimeout},
+	} {
+		if timeout, err := time.ParseDuration(setting.value); err != nil || timeout < 0 {
+			return fmt.Errorf("invalid %s %q (expected a duration like 30s, or 0 for "+
+				"no limit)", setting.name, setting.value)
+		}
+	}
+	if cfg.Limits.MaxHeaderBytes < 0 {
+		return fmt.Errorf("invalid maximum header size: %d", cfg.Limits.MaxHeaderBytes)
+	}
+	if cfg.Limits.MaxTunnelsPerClient < 0 {
+		return fmt.Errorf("invalid maximum tunnels per client: %d",
+			cfg.Limits.MaxTunnelsPerClient)
+	}
+	for i, method := range cfg.Auth.Methods {
+		method = strings.ToLower(strings.TrimSpace(method))
+		switch method {
+		case schemeNegotiate, schemeNTLM, schemeBasic:
+		default:
+			return fmt.Errorf("unknown auth method %q (expected %s, %s or %s)",
+				method, schemeNegotiate, schemeNTLM, schemeBasic)
+		}
+		if slices.Contains(cfg.Auth.Methods[:i], method) {
+			return fmt.Errorf("auth method %q listed more than once", method)
+		}
+		cfg.Auth.Methods[i] = method
+	}
+	return nil
+}
+
+// allowlist returns the proxy-auth allowlist in the comma-separated form
+// accepted by parseAuthAllowlist.
+func (cfg *config) allowlist() string {
+	return strings.Join(cfg.Auth.Allowlist, ",")
+}
+
+// schemeTTL returns how long to remember the scheme that a proxy accepted.
+func (cfg *config) schemeTTL() time.Duration {
+	ttl, err := time.ParseDuration(cfg.Auth.SchemeTTL)
+	if err != nil {
+		return 0 // unreachable once validate() has succeeded
+	}
+	return ttl
+}
+
+// shutdownTimeout returns how long to wait for requests and tunnels to
+// finish when shutting down.
+func (cfg *config) shutdownTimeout() time.Duration {
+	timeout, err := time.ParseDuration(cfg.ShutdownTimeout)
+	if err != nil {
+		return 0 // unreachable once validate() has succeeded
+	}
+	return timeout
+}
+
+// limits returns the configured timeouts and limits.
+func (cfg *config) limits() limits {
+	duration := func(value string) time.Duration {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return 0 // unreachable once validate() has succeeded
+		}
+		return d
+	}
+	return limits{
+		dialTimeout:         duration(cfg.Limits.DialTimeout),
+		headerTimeout:       duration(cfg.Limits.HeaderTimeout),
+		idleTimeout:         duration(cfg.Limits.IdleTimeout),
+		tunnelIdleTimeout:   duration(cfg.Limits.TunnelIdleTimeout),
+		maxHeaderBytes:      cfg.Limits.MaxHeaderBytes,
+		maxTunnelsPerClient: cfg.Limits.MaxTunnelsPerClient,
+	}
+}
+
+// clientAccess returns the rules for which clients may use alpaca.
+func (cfg *config) clientAccess() *clientAccess {
+	ca, err := newClientAccess(cfg.Clients)
+	if err != nil {
+		return nil // unreachable once validate() has succeeded
+	}
+	return ca
+}
+
+// unixSocketMode returns the permissions to give the unix socket.
+func (cfg *config) unixSocketMode() fs.FileMode {
+	mode, err := strconv.ParseUint(cfg.UnixSocketMode, 8, 32)
+	if err != nil {
+		return 0o600 // unreachable once validate() has succeeded
+	}
+	return fs.FileMode(mode)
+}
+
+// logLevel returns the minimum level of messages to log. Quiet mode only
+// lets errors through, whatever the configured level.
+func (cfg *config) logLevel() slog.Level {
+	if cfg.Quiet {
+		return slog.LevelError
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return slog.LevelInfo // unreachable once validate() has succeeded
+	}
+	return level
+}
@@ -0,0 +1,259 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0600))
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfigFile(t, `
+listen: [localhost, 192.0.2.1]
+port: 8080
+socks_port: 1080
+pac_url: http://pac.test/proxy.pac
+enable_socks: true
+http2: true
+wpad: true
+auth:
+  methods: [NTLM, basic]
+  allowlist: [.corp.test]
+  basic_credentials: malory:guest
+clients:
+  allow: [192.0.2.0/24]
+  deny: [192.0.2.7]
+  credentials: [alice:secret]
+`)
+	cfg := defaultConfig()
+	require.NoError(t, loadConfigFile(cfg, path, true))
+	require.NoError(t, cfg.validate())
+	assert.Equal(t, []string{"localhost", "192.0.2.1"}, cfg.Listen)
+	assert.Equal(t, 8080, cfg.Port)
+	assert.Equal(t, 1080, cfg.SocksPort)
+	assert.Equal(t, "http://pac.test/proxy.pac", cfg.PACURL)
+	assert.True(t, cfg.EnableSocks)
+	assert.True(t, cfg.HTTP2)
+	assert.True(t, cfg.WPAD)
+	assert.Equal(t, []string{"ntlm", "basic"}, cfg.Auth.Methods)
+	assert.Equal(t, ".corp.test", cfg.allowlist())
+	assert.Equal(t, "malory:guest", cfg.Auth.BasicCredentials)
+	assert.Equal(t, clientsConfig{
+		Allow:       []string{"192.0.2.0/24"},
+		Deny:        []string{"192.0.2.7"},
+		Credentials: []string{"alice:secret"},
+	}, cfg.Clients)
+}
+
+func TestLoadConfigFileKeepsDefaults(t *testing.T) {
+	path := writeConfigFile(t, "pac_url: http://pac.test/proxy.pac\n")
+	cfg := defaultConfig()
+	require.NoError(t, loadConfigFile(cfg, path, true))
+	assert.Equal(t, 3128, cfg.Port)
+	assert.Equal(t, defaultConfig().Auth.Methods, cfg.Auth.Methods)
+}
+
+func TestLoadConfigFileEmpty(t *testing.T) {
+	path := writeConfigFile(t, "")
+	cfg := defaultConfig()
+	require.NoError(t, loadConfigFile(cfg, path, true))
+	assert.Equal(t, defaultConfig(), cfg)
+}
+
+func TestLoadConfigFileMissing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nonexistent.yaml")
+	assert.NoError(t, loadConfigFile(defaultConfig(), path, false))
+	assert.Error(t, loadConfigFile(defaultConfig(), path, true))
+}
+
+func TestLoadConfigFileUnknownField(t *testing.T) {
+	path := writeConfigFile(t, "pacurl: http://pac.test/proxy.pac\n")
+	assert.Error(t, loadConfigFile(defaultConfig(), path, true))
+}
+
+func TestConfigEnvOverridesFile(t *testing.T) {
+	path := writeConfigFile(t, `
+auth:
+  allowlist: [.file.test]
+  basic_credentials: file:secret
+  ntlm_username: fileuser
+  ntlm_domain: FILEDOMAIN
+`)
+	cfg := defaultConfig()
+	require.NoError(t, loadConfigFile(cfg, path, true))
+	env := map[string]string{
+		"BASIC_CREDENTIALS":           "env:secret",
+		"NTLM_USERNAME":               "envuser",
+		"ALPACA_PROXY_AUTH_ALLOWLIST": ".env1.test,.env2.test",
+		"ALPACA_CLIENT_ALLOW":         "192.0.2.0/24,198.51.100.0/24",
+	}
+	cfg.applyEnv(func(key string) string { return env[key] })
+	assert.Equal(t, "env:secret", cfg.Auth.BasicCredentials)
+	assert.Equal(t, "envuser", cfg.Auth.NTLMUsername)
+	assert.Equal(t, "FILEDOMAIN", cfg.Auth.NTLMDomain)
+	assert.Equal(t, ".env1.test,.env2.test", cfg.allowlist())
+	assert.Equal(t, []string{"192.0.2.0/24", "198.51.100.0/24"}, cfg.Clients.Allow)
+}
+
+func TestConfigNTLMPrompt(t *testing.T) {
+	path := writeConfigFile(t, `
+auth:
+  ntlm_prompt: true
+`)
+	cfg := defaultConfig()
+	require.NoError(t, loadConfigFile(cfg, path, true))
+	assert.True(t, cfg.Auth.NTLMPrompt)
+	assert.Error(t, cfg.validate(), "the prompt needs a domain")
+	cfg.applyEnv(func(key string) string {
+		return map[string]string{"NTLM_DOMAIN": "ENVDOMAIN"}[key]
+	})
+	assert.NoError(t, cfg.validate())
+	assert.Equal(t, "ENVDOMAIN", cfg.Auth.NTLMDomain)
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		methods []string
+		port    int
+		valid   bool
+	}{
+		{"Default", []string{"negotiate", "ntlm", "basic"}, 3128, true},
+		{"MixedCase", []string{"Negotiate", "BASIC"}, 3128, true},
+		{"Empty", []string{}, 3128, true},
+		{"UnknownMethod", []string{"digest"}, 3128, false},
+		{"DuplicateMethod", []string{"ntlm", "NTLM"}, 3128, false},
+		{"InvalidPort", []string{"ntlm"}, 65536, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.Port = test.port
+			cfg.Auth.Methods = test.methods
+			if test.valid {
+				assert.NoError(t, cfg.validate())
+			} else {
+				assert.Error(t, cfg.validate())
+			}
+		})
+	}
+}
+
+func TestConfigTransparentPort(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.TransparentPort = 3129
+	if transparentSupported {
+		assert.NoError(t, cfg.validate())
+	} else {
+		assert.ErrorIs(t, cfg.validate(), errTransparentUnsupported)
+	}
+	cfg.TransparentPort = 65536
+	assert.Error(t, cfg.validate())
+	cfg.TransparentPort = 3129
+	cfg.Clients.Credentials = []string{"builder:s3cret"}
+	assert.Error(t, cfg.validate(), "transparent clients can't send credentials")
+}
+
+func TestConfigShutdownTimeout(t *testing.T) {
+	cfg := defaultConfig()
+	require.NoError(t, cfg.validate())
+	assert.Equal(t, 30*time.Second, cfg.shutdownTimeout())
+	cfg.ShutdownTimeout = "0"
+	require.NoError(t, cfg.validate())
+	assert.Equal(t, time.Duration(0), cfg.shutdownTimeout())
+	for _, value := range []string{"soon", "-1s"} {
+		cfg.ShutdownTimeout = value
+		assert.Error(t, cfg.validate(), value)
+	}
+}
+
+func TestConfigSchemeTTL(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		ttl   time.Duration
+		valid bool
+	}{
+		{"10m", 10 * time.Minute, true},
+		{"1h30m", 90 * time.Minute, true},
+		{"0", 0, true},
+		{"-1m", 0, false},
+		{"ten minutes", 0, false},
+		{"", 0, false},
+	} {
+		t.Run(test.value, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.applyEnv(func(key string) string {
+				if key == "ALPACA_AUTH_SCHEME_TTL" {
+					return test.value
+				}
+				return ""
+			})
+			if test.value == "" {
+				// An empty variable is ignored, so try the file.
+				cfg.Auth.SchemeTTL = test.value
+			}
+			if !test.valid {
+				assert.Error(t, cfg.validate())
+				return
+			}
+			require.NoError(t, cfg.validate())
+			assert.Equal(t, test.ttl, cfg.schemeTTL())
+		})
+	}
+}
+
+func TestConfigLimits(t *testing.T) {
+	cfg := defaultConfig()
+	require.NoError(t, cfg.validate())
+	assert.Equal(t, limits{
+		dialTimeout:    30 * time.Second,
+		headerTimeout:  30 * time.Second,
+		maxHeaderBytes: 1 << 20,
+	}, cfg.limits(), "connections that are open (but idle) aren't closed by default")
+	cfg.Limits.TunnelIdleTimeout = "1h"
+	cfg.Limits.MaxTunnelsPerClient = 8
+	require.NoError(t, cfg.validate())
+	assert.Equal(t, time.Hour, cfg.limits().tunnelIdleTimeout)
+	assert.Equal(t, 8, cfg.limits().maxTunnelsPerClient)
+	for _, mutate := range []func(*limitsConfig){
+		func(l *limitsConfig) { l.DialTimeout = "soon" },
+		func(l *limitsConfig) { l.HeaderTimeout = "-1s" },
+		func(l *limitsConfig) { l.IdleTimeout = "" },
+		func(l *limitsConfig) { l.MaxHeaderBytes = -1 },
+		func(l *limitsConfig) { l.MaxTunnelsPerClient = -1 },
+	} {
+		cfg := defaultConfig()
+		mutate(&cfg.Limits)
+		assert.Error(t, cfg.validate(), "%+v", cfg.Limits)
+	}
+}
+
+func TestConfigHealthCheckHost(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.HealthCheckHost = "www.example.com:443"
+	assert.NoError(t, cfg.validate())
+	cfg.HealthCheckHost = "www.example.com"
+	assert.Error(t, cfg.validate())
+}
@@ -0,0 +1,75 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// tunnelDialer opens tunnels for clients of the SOCKS5 and transparent
+// listeners. Each target is routed in the same way as an HTTP CONNECT
+// request to it would be: the PAC file picks a proxy (or DIRECT), and the
+// tunnel is opened through that proxy with the auth chain.
+type tunnelDialer struct {
+	finder *ProxyFinder
+	proxy  ProxyHandler
+}
+
+func (d *tunnelDialer) dial(ctx context.Context, _, addr string) (net.Conn, error) {
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodConnect, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL = &url.URL{Host: addr}
+	req.Host = addr
+	d.finder.checkForUpdates()
+	proxies, err := d.finder.findProxiesForRequest(req)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error finding proxy for tunnel",
+			"host", addr, "error", err)
+		return nil, err
+	}
+	req = req.WithContext(withProxies(ctx, proxies))
+	conn, proxyURL, err := d.proxy.connect(req)
+	if err != nil {
+		observeRequest(req, proxyURL, http.StatusBadGateway, start)
+		return nil, err
+	}
+	observeRequest(req, proxyURL, http.StatusOK, start)
+	slog.InfoContext(ctx, "Opened tunnel", "host", addr, "proxy", proxyLabel(proxyURL))
+	return conn, nil
+}
+
+// reloadableDialer is the tunnelDialer counterpart of reloadableHandler: it
+// delegates to a tunnelDialer which is replaced whenever the config is
+// reloaded.
+type reloadableDialer struct {
+	current atomic.Pointer[tunnelDialer]
+}
+
+func (rd *reloadableDialer) swap(dialer *tunnelDialer) {
+	rd.current.Store(dialer)
+}
+
+func (rd *reloadableDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return rd.current.Load().dial(ctx, network, addr)
+}
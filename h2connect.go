@@ -0,0 +1,409 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	// h2ReadIdleTimeout is how long an HTTP/2 connection to a proxy can be
+	// silent before we ping it, so that a dead connection is noticed
+	// before a new tunnel is opened on it.
+	h2ReadIdleTimeout = 30 * time.Second
+	// h2PingTimeout is how long to wait for a reply to that ping.
+	h2PingTimeout = 15 * time.Second
+	// h2IdleConnTimeout is how long an HTTP/2 connection to a proxy can
+	// go without any tunnels before it's closed, like
+	// http.DefaultTransport's IdleConnTimeout.
+	h2IdleConnTimeout = 90 * time.Second
+)
+
+// errHTTP11Required is returned by (*h2Pool).connect when a CONNECT can't be
+// sent over HTTP/2, and should be sent over HTTP/1.1 instead.
+var errHTTP11Required = errors.New("proxy requires HTTP/1.1")
+
+// h2Pool holds one HTTP/2 connection to each HTTPS proxy that supports it,
+// and opens CONNECT tunnels as streams on that connection (RFC 9113 §8.5),
+// so that many tunnels share a single TCP and TLS handshake.
+//
+// Only schemes that authenticate each request on its own (Basic, and
+// Negotiate with Kerberos) can be used over HTTP/2. NTLM authenticates the
+// connection rather than the request, which HTTP/2 doesn't allow, so a
+// proxy that asks for NTLM (or that doesn't offer HTTP/2 in its TLS
+// handshake) is sent CONNECTs over HTTP/1.1 instead, for as long as this
+// pool lives. A new pool is created whenever the config is reloaded, along
+// with the ProxyHandler that it belongs to.
+type h2Pool struct {
+	t *http2.Transport
+
+	mu       sync.Mutex
+	sessions map[string]*h2Session // keyed by scheme://host:port
+	dialing  map[string]*h2Dial    // connections that are being dialled
+	http11   map[string]bool       // proxies to use HTTP/1.1 with
+}
+
+// h2Dial is a connection to a proxy that's being dialled. Once done is
+// closed, s and err hold the result.
+type h2Dial struct {
+	done chan struct{}
+	s    *h2Session
+	err  error
+}
+
+// h2Session is an HTTP/2 connection to a proxy. Its RoundTrip method sends
+// a CONNECT as a new stream, and the body of the response that it returns
+// is an *h2Tunnel.
+type h2Session struct {
+	cc    *http2.ClientConn
+	conn  *tls.Conn
+	state *tls.ConnectionState
+}
+
+func newH2Pool() *h2Pool {
+	return &h2Pool{
+		t: &http2.Transport{
+			ReadIdleTimeout: h2ReadIdleTimeout,
+			PingTimeout:     h2PingTimeout,
+			IdleConnTimeout: h2IdleConnTimeout,
+		},
+		sessions: make(map[string]*h2Session),
+		dialing:  make(map[string]*h2Dial),
+		http11:   make(map[string]bool),
+	}
+}
+
+// useHTTP11 records that CONNECTs to the given proxy should be sent over
+// HTTP/1.1.
+func (p *h2Pool) useHTTP11(proxy *url.URL) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.http11[proxy.String()] = true
+	if s, ok := p.sessions[proxy.String()]; ok {
+		delete(p.sessions, proxy.String())
+		// Tunnels that are already open on the connection keep running,
+		// and Shutdown waits for them to finish.
+		go s.cc.Shutdown(context.Background()) //nolint:errcheck
+	}
+}
+
+// session returns an HTTP/2 connection to the given proxy, dialling one if
+// there isn't a usable one already. It returns errHTTP11Required if the
+// proxy doesn't support HTTP/2.
+func (p *h2Pool) session(proxy *url.URL) (*h2Session, error) {
+	key := proxy.String()
+	p.mu.Lock()
+	if p.http11[key] {
+		p.mu.Unlock()
+		return nil, errHTTP11Required
+	}
+	if s, ok := p.sessions[key]; ok && s.cc.CanTakeNewRequest() {
+		p.mu.Unlock()
+		return s, nil
+	}
+	// Concurrent tunnels to the same proxy share one new connection
+	// rather than each dialling their own. The dial happens without the
+	// lock, so that a slow proxy doesn't hold up tunnels to other ones.
+	if d, ok := p.dialing[key]; ok {
+		p.mu.Unlock()
+		<-d.done
+		return d.s, d.err
+	}
+	delete(p.sessions, key)
+	d := &h2Dial{done: make(chan struct{})}
+	p.dialing[key] = d
+	p.mu.Unlock()
+
+	d.s, d.err = p.dial(proxy)
+	p.mu.Lock()
+	delete(p.dialing, key)
+	switch {
+	case d.err == nil && p.http11[key]:
+		// useHTTP11 was called while we were dialling.
+		go d.s.cc.Shutdown(context.Background()) //nolint:errcheck
+		d.s, d.err = nil, errHTTP11Required
+	case d.err == nil:
+		p.sessions[key] = d.s
+	case errors.Is(d.err, errHTTP11Required):
+		p.http11[key] = true
+	}
+	p.mu.Unlock()
+	close(d.done)
+	return d.s, d.err
+}
+
+// evict removes s from the pool, if it's still there, so that the next tunnel
+// to the proxy dials a new connection. Tunnels that are already open on s
+// keep running.
+func (p *h2Pool) evict(proxy *url.URL, s *h2Session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sessions[proxy.String()] == s {
+		delete(p.sessions, proxy.String())
+		go s.cc.Shutdown(context.Background()) //nolint:errcheck
+	}
+}
+
+// dial opens a new HTTP/2 connection to the given proxy. It returns
+// errHTTP11Required if the proxy doesn't support HTTP/2.
+func (p *h2Pool) dial(proxy *url.URL) (*h2Session, error) {
+	config := tlsClientConfig.Clone()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	conn, err := tls.DialWithDialer(netDialer, "tcp", proxy.Host, config)
+	if err != nil {
+		return nil, &net.OpError{Op: "proxyconnect", Net: "tcp", Err: err}
+	}
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != http2.NextProtoTLS {
+		_ = conn.Close()
+		slog.Info("Proxy doesn't support HTTP/2; using HTTP/1.1", "proxy", proxy.Host)
+		return nil, errHTTP11Required
+	}
+	cc, err := p.t.NewClientConn(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, &net.OpError{Op: "proxyconnect", Net: "tcp", Err: err}
+	}
+	return &h2Session{cc: cc, conn: conn, state: &state}, nil
+}
+
+// connect opens a tunnel to req.Host through the given proxy, as a stream on
+// the proxy's HTTP/2 connection. It returns errHTTP11Required if the proxy
+// is to be reached over HTTP/1.1 (or isn't an HTTPS proxy at all), in which
+// case the caller should use connectViaProxy. A nil pool always returns
+// errHTTP11Required.
+func (p *h2Pool) connect(req *http.Request, proxyURL *url.URL, auth *authChain) (net.Conn, error) {
+	if p == nil || proxyURL.Scheme != "https" {
+		return nil, errHTTP11Required
+	}
+	s, err := p.session(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	// The stream has to outlive the client's request, which is cancelled
+	// as soon as handleConnect returns (after the connection has been
+	// hijacked).
+	ctx := context.WithoutCancel(req.Context())
+	ctx = context.WithValue(ctx, contextKeyProxy, proxyURL)
+	ctx = withChannelBinding(ctx, s.state)
+	req = req.WithContext(ctx)
+
+	var method proxyAuthenticator
+	if m := auth.remembered(proxyURL); m != nil && !connectionBound(m) {
+		method = m
+	}
+	var resp *http.Response
+	if method == nil {
+		resp, err = s.RoundTrip(req)
+	} else {
+		slog.DebugContext(ctx, "Authenticating proactively", "scheme", method.scheme())
+		req.Header.Del("Proxy-Authorization")
+		resp, err = method.do(req, s)
+		observeAuthAttempt(proxyLabel(proxyURL), method.scheme(), resp, err)
+	}
+	if err != nil {
+		return nil, p.roundTripError(ctx, proxyURL, s, err)
+	}
+	if method != nil && resp.StatusCode == http.StatusProxyAuthRequired {
+		auth.forget(proxyURL, method.scheme())
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired && auth != nil {
+		_ = resp.Body.Close()
+		slog.InfoContext(ctx, "Retrying with auth", "status", resp.StatusCode)
+		schemes := parseProxyAuthenticateSchemes(resp.Header)
+		var scheme string
+		resp, scheme, err = p.retryWithAuth(req, proxyURL, auth, schemes, s)
+		if err != nil {
+			return nil, err
+		}
+		slog.InfoContext(ctx, "Got response to authenticated request",
+			"status", resp.StatusCode)
+		auth.remember(proxyURL, scheme, schemes)
+	}
+	if tunnel, ok := resp.Body.(*h2Tunnel); ok && resp.StatusCode == http.StatusOK {
+		return tunnel, nil
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		err := errors.New("all configured authentication methods rejected by proxy")
+		slog.WarnContext(ctx, "Error connecting via proxy", "error", err)
+		return nil, err
+	}
+	err = fmt.Errorf("unexpected response status: %s", resp.Status)
+	slog.WarnContext(ctx, "Error connecting via proxy", "error", err)
+	return nil, err
+}
+
+// retryWithAuth is like retryConnectWithAuth, but each method sends its
+// CONNECT as a new stream on the same connection. If the only methods that
+// could answer the 407 are connection-bound, it returns errHTTP11Required.
+func (p *h2Pool) retryWithAuth(req *http.Request, proxyURL *url.URL, auth *authChain,
+	schemes []string, s *h2Session) (*http.Response, string, error) {
+	ctx := req.Context()
+	var candidates []proxyAuthenticator
+	bound := false
+	for _, method := range auth.pick(schemes, proxyURL.Hostname()) {
+		if connectionBound(method) {
+			bound = true
+			continue
+		}
+		candidates = append(candidates, method)
+	}
+	if len(candidates) == 0 && bound {
+		slog.InfoContext(ctx, "Proxy wants connection-bound auth, which HTTP/2 "+
+			"doesn't support; using HTTP/1.1", "proxy", proxyURL.Host)
+		p.useHTTP11(proxyURL)
+		return nil, "", errHTTP11Required
+	} else if len(candidates) == 0 {
+		return nil, "", errNoMatchingAuthMethod
+	}
+	var lastResp *http.Response
+	for i, method := range candidates {
+		req.Header.Del("Proxy-Authorization")
+		slog.InfoContext(ctx, "Attempting authentication", "scheme", method.scheme())
+		resp, err := method.do(req, s)
+		observeAuthAttempt(proxyLabel(proxyURL), method.scheme(), resp, err)
+		if err != nil {
+			return nil, "", p.roundTripError(ctx, proxyURL, s, err)
+		}
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			return resp, method.scheme(), nil
+		}
+		if i < len(candidates)-1 {
+			_ = resp.Body.Close()
+			continue
+		}
+		lastResp = resp
+	}
+	return lastResp, "", nil
+}
+
+// roundTripError logs an error from sending a CONNECT over HTTP/2 on s, and
+// returns the error to give the caller. A proxy that resets the stream with
+// HTTP_1_1_REQUIRED is sent future CONNECTs over HTTP/1.1. Otherwise, if the
+// connection itself failed (it was lost, the proxy sent GOAWAY, or it didn't
+// answer in time), s is evicted from the pool. Errors from the proxy are
+// "proxyconnect" errors (see h2Session.RoundTrip), so the proxy is failed
+// over like one that can't be reached over HTTP/1.1.
+func (p *h2Pool) roundTripError(ctx context.Context, proxyURL *url.URL, s *h2Session,
+	err error) error {
+
+	var se http2.StreamError
+	var ge http2.GoAwayError
+	if (errors.As(err, &se) && se.Code == http2.ErrCodeHTTP11Required) ||
+		(errors.As(err, &ge) && ge.ErrCode == http2.ErrCodeHTTP11Required) {
+		slog.InfoContext(ctx, "Proxy asked for HTTP/1.1", "proxy", proxyURL.Host)
+		p.useHTTP11(proxyURL)
+		return errHTTP11Required
+	}
+	slog.ErrorContext(ctx, "Error reading CONNECT response", "error", err)
+	var oe *net.OpError
+	if errors.As(err, &oe) && oe.Op == "proxyconnect" && !errors.As(err, &se) {
+		p.evict(proxyURL, s)
+	}
+	return err
+}
+
+// connectionBound reports whether an authenticator authenticates the
+// connection rather than the request. Such a method takes more than one
+// round trip, and can't be used over HTTP/2.
+func connectionBound(m proxyAuthenticator) bool {
+	return strings.EqualFold(m.scheme(), schemeNTLM)
+}
+
+// errH2ConnectTimeout is returned when a proxy doesn't answer a CONNECT
+// stream within the dial timeout.
+var errH2ConnectTimeout = fmt.Errorf("timed out waiting for CONNECT response: %w",
+	os.ErrDeadlineExceeded)
+
+// RoundTrip sends a CONNECT request as a new stream. The request body is
+// replaced with a pipe that the returned tunnel writes to. If the stream
+// can't be opened, or isn't answered within the dial timeout, the error is
+// a "proxyconnect" *net.OpError, like one from dialling the proxy.
+func (s *h2Session) RoundTrip(req *http.Request) (*http.Response, error) {
+	pr, pw := io.Pipe()
+	// The stream lives for as long as the request's context, so the wait
+	// for the response is bounded with a timer that cancels it, rather
+	// than with a deadline.
+	ctx, cancel := context.WithCancel(req.Context())
+	req = req.Clone(ctx)
+	req.Body = pr
+	req.ContentLength = -1
+	var timer *time.Timer
+	if timeout := netDialer.Timeout; timeout > 0 {
+		timer = time.AfterFunc(timeout, cancel)
+	}
+	resp, err := s.cc.RoundTrip(req)
+	if timer != nil && !timer.Stop() {
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		err = errH2ConnectTimeout
+	}
+	if err != nil {
+		_ = pw.Close()
+		cancel()
+		return nil, &net.OpError{Op: "proxyconnect", Net: "tcp", Err: err}
+	}
+	resp.TLS = s.state
+	resp.Body = &h2Tunnel{body: resp.Body, w: pw, conn: s.conn, cancel: cancel}
+	return resp, nil
+}
+
+// h2Tunnel is a tunnel over an HTTP/2 stream: reads come from the response
+// body, and writes go to the request body.
+type h2Tunnel struct {
+	body   io.ReadCloser
+	w      *io.PipeWriter
+	conn   net.Conn // the connection to the proxy
+	cancel context.CancelFunc
+}
+
+var errH2TunnelDeadline = errors.New("deadlines aren't supported on HTTP/2 tunnels")
+
+func (t *h2Tunnel) Read(b []byte) (int, error)  { return t.body.Read(b) }
+func (t *h2Tunnel) Write(b []byte) (int, error) { return t.w.Write(b) }
+
+// Close closes both directions of the stream, leaving the connection (and
+// any other tunnels on it) open.
+func (t *h2Tunnel) Close() error {
+	_ = t.w.Close()
+	err := t.body.Close()
+	t.cancel()
+	return err
+}
+
+func (t *h2Tunnel) LocalAddr() net.Addr              { return t.conn.LocalAddr() }
+func (t *h2Tunnel) RemoteAddr() net.Addr             { return t.conn.RemoteAddr() }
+func (t *h2Tunnel) SetDeadline(time.Time) error      { return errH2TunnelDeadline }
+func (t *h2Tunnel) SetReadDeadline(time.Time) error  { return errH2TunnelDeadline }
+func (t *h2Tunnel) SetWriteDeadline(time.Time) error { return errH2TunnelDeadline }
@@ -0,0 +1,275 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+// h2Proxy is an HTTPS proxy that supports HTTP/2 (if enabled), asks for the
+// given scheme, and echoes everything sent through its tunnels.
+type h2Proxy struct {
+	*httptest.Server
+	conns atomic.Int32 // number of connections accepted
+}
+
+func newH2Proxy(t *testing.T, scheme string, enableHTTP2 bool) *h2Proxy {
+	p := &h2Proxy{}
+	p.Server = httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if req.Method != http.MethodConnect {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			if req.Header.Get("Proxy-Authorization") != scheme+" ok" {
+				w.Header().Set("Proxy-Authenticate", scheme)
+				w.WriteHeader(http.StatusProxyAuthRequired)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			rc := http.NewResponseController(w)
+			_ = rc.Flush()
+			buf := make([]byte, 1024)
+			for {
+				n, err := req.Body.Read(buf)
+				if n > 0 {
+					_, _ = w.Write(buf[:n])
+					_ = rc.Flush()
+				}
+				if err != nil {
+					return
+				}
+			}
+		}))
+	p.EnableHTTP2 = enableHTTP2
+	p.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			p.conns.Add(1)
+		}
+	}
+	p.StartTLS()
+	t.Cleanup(p.Close)
+	oldConfig := tlsClientConfig
+	tlsClientConfig = &tls.Config{RootCAs: x509.NewCertPool()}
+	tlsClientConfig.RootCAs.AddCert(p.Certificate())
+	t.Cleanup(func() { tlsClientConfig = oldConfig })
+	return p
+}
+
+func (p *h2Proxy) proxyURL(t *testing.T) *url.URL {
+	u, err := url.Parse(p.URL)
+	require.NoError(t, err)
+	return u
+}
+
+func h2ConnectRequest(t *testing.T) *http.Request {
+	req, err := http.NewRequest(http.MethodConnect, "https://example.com:443", nil)
+	require.NoError(t, err)
+	req.Host = "example.com:443"
+	return req
+}
+
+// echo writes msg to conn and checks that it comes back.
+func echo(t *testing.T, conn net.Conn, msg string) {
+	_, err := conn.Write([]byte(msg))
+	require.NoError(t, err)
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, msg, string(buf))
+}
+
+func TestH2ConnectMultiplexesTunnels(t *testing.T) {
+	proxy := newH2Proxy(t, "Basic", true)
+	proxyURL := proxy.proxyURL(t)
+	basic := realisticFake("Basic", "Basic ok")
+	chain := newAuthChain(basic)
+	chain.known = newSchemeCache(time.Minute)
+	pool := newH2Pool()
+
+	first, err := pool.connect(h2ConnectRequest(t), proxyURL, chain)
+	require.NoError(t, err)
+	defer first.Close() //nolint:errcheck
+	second, err := pool.connect(h2ConnectRequest(t), proxyURL, chain)
+	require.NoError(t, err)
+	defer second.Close() //nolint:errcheck
+	echo(t, first, "hello")
+	echo(t, second, "world")
+	echo(t, first, "again")
+
+	assert.Equal(t, int32(1), proxy.conns.Load(), "tunnels should share a connection")
+	// The first tunnel learned that the proxy wants Basic, so the second
+	// sent it straight away.
+	assert.Equal(t, int32(2), basic.calls.Load())
+}
+
+func TestH2ConnectFallsBackToHTTP11(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		scheme      string
+		enableHTTP2 bool
+	}{
+		{"NoHTTP2", "Basic", false},
+		{"ConnectionBoundAuth", "NTLM", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := newH2Proxy(t, test.scheme, test.enableHTTP2)
+			proxyURL := proxy.proxyURL(t)
+			chain := newAuthChain(realisticFake(test.scheme, test.scheme+" ok"))
+			pool := newH2Pool()
+			_, err := pool.connect(h2ConnectRequest(t), proxyURL, chain)
+			assert.ErrorIs(t, err, errHTTP11Required)
+			// The pool remembers, and doesn't try HTTP/2 again.
+			_, err = pool.connect(h2ConnectRequest(t), proxyURL, chain)
+			assert.ErrorIs(t, err, errHTTP11Required)
+			assert.Equal(t, int32(1), proxy.conns.Load())
+			// Over HTTP/1.1, the tunnel works.
+			conn, err := connectViaProxy(h2ConnectRequest(t), proxyURL, chain)
+			require.NoError(t, err)
+			_ = conn.Close()
+		})
+	}
+}
+
+func TestH2ConnectOnlyForHTTPSProxies(t *testing.T) {
+	proxyURL := &url.URL{Scheme: "http", Host: "proxy.test:3128"}
+	_, err := newH2Pool().connect(h2ConnectRequest(t), proxyURL, nil)
+	assert.ErrorIs(t, err, errHTTP11Required)
+	var pool *h2Pool
+	proxyURL.Scheme = "https"
+	_, err = pool.connect(h2ConnectRequest(t), proxyURL, nil)
+	assert.ErrorIs(t, err, errHTTP11Required, "HTTP/2 is disabled")
+}
+
+func TestH2ConnectDoesntWaitForOtherProxies(t *testing.T) {
+	// A proxy that accepts connections but never finishes the TLS
+	// handshake.
+	hung, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer hung.Close() //nolint:errcheck
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := hung.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	proxy := newH2Proxy(t, "Basic", true)
+	chain := newAuthChain(realisticFake("Basic", "Basic ok"))
+	pool := newH2Pool()
+
+	hungURL := &url.URL{Scheme: "https", Host: hung.Addr().String()}
+	hungErr := make(chan error, 1)
+	go func() {
+		_, err := pool.session(hungURL)
+		hungErr <- err
+	}()
+	conn := <-accepted
+
+	// Tunnels through the other proxy, including concurrent ones (which
+	// share a connection), don't wait for the hung dial.
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Go(func() {
+			tunnel, err := pool.connect(h2ConnectRequest(t), proxy.proxyURL(t), chain)
+			if assert.NoError(t, err) {
+				_ = tunnel.Close()
+			}
+		})
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), proxy.conns.Load())
+
+	_ = conn.Close()
+	assert.Error(t, <-hungErr)
+}
+
+func TestH2ConnectEvictsFailedSession(t *testing.T) {
+	proxy := newH2Proxy(t, "Basic", true)
+	proxyURL := proxy.proxyURL(t)
+	pool := newH2Pool()
+	s, err := pool.session(proxyURL)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// A reset stream only fails that one tunnel.
+	streamErr := &net.OpError{Op: "proxyconnect", Net: "tcp",
+		Err: http2.StreamError{Code: http2.ErrCodeRefusedStream}}
+	err = pool.roundTripError(ctx, proxyURL, s, streamErr)
+	assert.Equal(t, streamErr, err)
+	same, err := pool.session(proxyURL)
+	require.NoError(t, err)
+	assert.Same(t, s, same)
+
+	// A connection that's going away is evicted, and the error is one that
+	// fails over to the next proxy.
+	goAway := &net.OpError{Op: "proxyconnect", Net: "tcp",
+		Err: http2.GoAwayError{ErrCode: http2.ErrCodeNo}}
+	err = pool.roundTripError(ctx, proxyURL, s, goAway)
+	var oe *net.OpError
+	require.ErrorAs(t, err, &oe)
+	assert.Equal(t, "proxyconnect", oe.Op)
+	next, err := pool.session(proxyURL)
+	require.NoError(t, err)
+	assert.NotSame(t, s, next)
+	assert.Equal(t, int32(2), proxy.conns.Load())
+}
+
+func TestH2ConnectTimesOut(t *testing.T) {
+	// An HTTP/2 proxy that never answers CONNECT.
+	release := make(chan struct{})
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(http.ResponseWriter, *http.Request) { <-release }))
+	proxy.EnableHTTP2 = true
+	proxy.StartTLS()
+	defer proxy.Close()
+	defer close(release)
+	oldConfig := tlsClientConfig
+	tlsClientConfig = &tls.Config{RootCAs: x509.NewCertPool()}
+	tlsClientConfig.RootCAs.AddCert(proxy.Certificate())
+	defer func() { tlsClientConfig = oldConfig }()
+	oldTimeout := netDialer.Timeout
+	netDialer.Timeout = 50 * time.Millisecond
+	defer func() { netDialer.Timeout = oldTimeout }()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+	pool := newH2Pool()
+	s, err := pool.session(proxyURL)
+	require.NoError(t, err)
+	_, err = pool.connect(h2ConnectRequest(t), proxyURL, nil)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	var oe *net.OpError
+	require.ErrorAs(t, err, &oe)
+	assert.Equal(t, "proxyconnect", oe.Op)
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	assert.NotSame(t, s, pool.sessions[proxyURL.String()], "the session should be evicted")
+}
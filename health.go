@@ -0,0 +1,201 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// minProbeInterval is how long after a proxy fails that it's first
+	// probed. The interval doubles after every failed probe, up to
+	// maxProbeInterval (which matches the time that Chrome skips a bad
+	// proxy for; see "Evaluating proxy lists" in
+	// https://crsrc.org/net/docs/proxy.md).
+	minProbeInterval = 5 * time.Second
+	maxProbeInterval = 5 * time.Minute
+	// probeTimeout is how long a probe has to connect to the proxy (and
+	// get a response to its CONNECT request, if there is one).
+	probeTimeout = 10 * time.Second
+)
+
+// proxyHealth keeps track of proxies that have failed, so that requests can
+// skip them. Rather than blocking a proxy for a fixed time, it probes each
+// one in the background, and unblocks it as soon as a probe succeeds. A proxy
+// that keeps failing is probed less and less often.
+type proxyHealth struct {
+	mu          sync.Mutex
+	probe       func(*url.URL) error
+	down        map[string]*downProxy // keyed by host:port
+	closed      bool
+	minInterval time.Duration
+	maxInterval time.Duration
+}
+
+type downProxy struct {
+	proxy    *url.URL
+	failures int       // failed probes since the proxy went down
+	next     time.Time // when the proxy will next be probed
+	timer    *time.Timer
+}
+
+func newProxyHealth(probe func(*url.URL) error) *proxyHealth {
+	return &proxyHealth{
+		probe:       probe,
+		down:        make(map[string]*downProxy),
+		minInterval: minProbeInterval,
+		maxInterval: maxProbeInterval,
+	}
+}
+
+// fail records that proxy couldn't be reached. If it isn't already down, it's
+// blocked until a probe finds that it's back up.
+func (h *proxyHealth) fail(proxy *url.URL) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed || h.down[proxy.Host] != nil {
+		return
+	}
+	dp := &downProxy{proxy: proxy}
+	h.down[proxy.Host] = dp
+	h.schedule(dp)
+}
+
+// schedule starts the timer for the next probe of dp. The caller must hold
+// h.mu.
+func (h *proxyHealth) schedule(dp *downProxy) {
+	delay := h.interval(dp.failures)
+	dp.next = time.Now().Add(delay)
+	dp.timer = time.AfterFunc(delay, func() { h.check(dp) })
+}
+
+// interval returns how long to wait before probing a proxy that has failed
+// the given number of probes.
+func (h *proxyHealth) interval(failures int) time.Duration {
+	if failures >= 16 {
+		// Don't let the shift overflow.
+		return h.maxInterval
+	}
+	return min(h.minInterval<<failures, h.maxInterval)
+}
+
+// check probes dp, and either unblocks it or schedules another probe.
+func (h *proxyHealth) check(dp *downProxy) {
+	err := h.probe(dp.proxy)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.down[dp.proxy.Host] != dp {
+		// It stopped being tracked while it was being probed.
+		return
+	}
+	if err == nil {
+		slog.Info("Proxy is back up", "proxy", dp.proxy.Host)
+		delete(h.down, dp.proxy.Host)
+		return
+	}
+	dp.failures++
+	h.schedule(dp)
+	slog.Debug("Proxy is still down", "proxy", dp.proxy.Host, "error", err,
+		"next_probe", dp.next)
+}
+
+// isDown reports whether the proxy at host (in host:port form) is blocked.
+func (h *proxyHealth) isDown(host string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.down[host] != nil
+}
+
+// snapshot returns the proxies that are down, and when each will next be
+// probed.
+func (h *proxyHealth) snapshot() map[string]time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entries := make(map[string]time.Time, len(h.down))
+	for host, dp := range h.down {
+		entries[host] = dp.next
+	}
+	return entries
+}
+
+// retain stops tracking (and unblocks) the proxies for which keep returns
+// false.
+func (h *proxyHealth) retain(keep func(host string) bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for host, dp := range h.down {
+		if !keep(host) {
+			dp.timer.Stop()
+			delete(h.down, host)
+		}
+	}
+}
+
+// reset unblocks every proxy.
+func (h *proxyHealth) reset() {
+	h.retain(func(string) bool { return false })
+}
+
+// close stops all probes, for good.
+func (h *proxyHealth) close() {
+	h.reset()
+	h.mu.Lock()
+	h.closed = true
+	h.mu.Unlock()
+}
+
+// pacMentions reports whether the proxy at host (in host:port form) is
+// named anywhere in a PAC file. The PAC file is code, so the only way to find
+// out what it might return is to look for the name.
+func pacMentions(pacjs []byte, host string) bool {
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+	}
+	return bytes.Contains(pacjs, []byte(hostname))
+}
+
+// probeProxy checks whether proxy is up by connecting to it (with TLS, for an
+// HTTPS proxy). If canary isn't empty, it also sends a CONNECT request for
+// canary, without any credentials: any response at all, even a 407, shows
+// that the proxy is answering requests.
+func probeProxy(proxy *url.URL, canary string) error {
+	var tr transport
+	tr.setDeadline(time.Now().Add(probeTimeout))
+	if err := tr.dial(proxy); err != nil {
+		return err
+	}
+	defer tr.Close() //nolint:errcheck
+	if canary == "" || proxy.Scheme == "socks5" {
+		return nil
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: canary},
+		Host:   canary,
+		Header: make(http.Header),
+	}
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
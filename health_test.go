@@ -0,0 +1,142 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyHealthRecovery(t *testing.T) {
+	var up atomic.Bool
+	var probes atomic.Int32
+	h := newProxyHealth(func(proxy *url.URL) error {
+		assert.Equal(t, "proxy.test:3128", proxy.Host)
+		probes.Add(1)
+		if up.Load() {
+			return nil
+		}
+		return errors.New("connection refused")
+	})
+	defer h.close()
+	h.minInterval, h.maxInterval = 10*time.Millisecond, 20*time.Millisecond
+	h.fail(&url.URL{Host: "proxy.test:3128"})
+	assert.True(t, h.isDown("proxy.test:3128"))
+	assert.False(t, h.isDown("other.test:3128"))
+	assert.Contains(t, h.snapshot(), "proxy.test:3128")
+	require.Eventually(t, func() bool { return probes.Load() >= 3 },
+		time.Second, 5*time.Millisecond)
+	assert.True(t, h.isDown("proxy.test:3128"))
+	up.Store(true)
+	require.Eventually(t, func() bool { return !h.isDown("proxy.test:3128") },
+		time.Second, 5*time.Millisecond)
+	assert.Empty(t, h.snapshot())
+}
+
+func TestProxyHealthInterval(t *testing.T) {
+	h := newProxyHealth(nil)
+	for failures, expected := range []time.Duration{
+		5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second,
+		80 * time.Second, 160 * time.Second, 5 * time.Minute, 5 * time.Minute,
+	} {
+		assert.Equal(t, expected, h.interval(failures), "after %d failures", failures)
+	}
+	assert.Equal(t, 5*time.Minute, h.interval(100))
+}
+
+func TestProxyHealthRetain(t *testing.T) {
+	h := newProxyHealth(func(*url.URL) error { return errors.New("still down") })
+	defer h.close()
+	h.fail(&url.URL{Host: "a.test:80"})
+	h.fail(&url.URL{Host: "b.test:80"})
+	h.retain(func(host string) bool { return host == "a.test:80" })
+	assert.True(t, h.isDown("a.test:80"))
+	assert.False(t, h.isDown("b.test:80"))
+	h.reset()
+	assert.False(t, h.isDown("a.test:80"))
+}
+
+func TestProxyHealthClose(t *testing.T) {
+	h := newProxyHealth(func(*url.URL) error { return errors.New("still down") })
+	h.fail(&url.URL{Host: "a.test:80"})
+	h.close()
+	assert.False(t, h.isDown("a.test:80"))
+	h.fail(&url.URL{Host: "a.test:80"})
+	assert.False(t, h.isDown("a.test:80"))
+}
+
+func TestPACMentions(t *testing.T) {
+	pacjs := []byte(`function FindProxyForURL(url, host) {
+		return "PROXY proxy.corp.test; PROXY backup.corp.test:8080";
+	}`)
+	assert.True(t, pacMentions(pacjs, "proxy.corp.test:80"))
+	assert.True(t, pacMentions(pacjs, "backup.corp.test:8080"))
+	assert.False(t, pacMentions(pacjs, "old.corp.test:8080"))
+}
+
+func TestProbeProxy(t *testing.T) {
+	// A listener that closes connections as soon as they're accepted.
+	closing, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer closing.Close() //nolint:errcheck
+	go func() {
+		for {
+			conn, err := closing.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	// A proxy that wants credentials.
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer proxy.Close()
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, dead.Close())
+
+	for _, test := range []struct {
+		name   string
+		proxy  string
+		canary string
+		up     bool
+	}{
+		{"Connect", proxy.Listener.Addr().String(), "", true},
+		{"Canary", proxy.Listener.Addr().String(), "canary.test:443", true},
+		{"ConnectOnly", closing.Addr().String(), "", true},
+		{"NoAnswer", closing.Addr().String(), "canary.test:443", false},
+		{"Refused", dead.Addr().String(), "", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := probeProxy(&url.URL{Scheme: "http", Host: test.proxy}, test.canary)
+			if test.up {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
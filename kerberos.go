@@ -12,12 +12,13 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-//go:build !darwin
+//go:build !darwin && !linux
 
 package main
 
-// newNegotiateAuthenticator is a stub for non-macOS platforms. Kerberos
-// authentication via GSS.framework is only available on macOS.
+// newNegotiateAuthenticator is a stub for platforms other than macOS and Linux.
+// Kerberos authentication is only available on macOS (via GSS.framework) and
+// Linux (see kerberos_linux.go).
 func newNegotiateAuthenticator() proxyAuthenticator {
 	return nil
 }
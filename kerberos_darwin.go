@@ -48,14 +48,18 @@ static int hasCredential() {
 }
 
 // generateToken generates a SPNEGO token for the given service principal name.
+// If cbLen is non-zero, cbData is the application data for the channel bindings.
 // The caller must free the returned token with free().
 // Returns 0 on success, non-zero GSS major status on failure.
-static OM_uint32 generateToken(const char *spn, void **tokenData, size_t *tokenLen, OM_uint32 *minorStatus) {
+static OM_uint32 generateToken(const char *spn, void *cbData, size_t cbLen,
+                               void **tokenData, size_t *tokenLen, OM_uint32 *minorStatus) {
     OM_uint32 major, minor;
     gss_buffer_desc nameBuffer;
     gss_name_t targetName = GSS_C_NO_NAME;
     gss_ctx_id_t ctx = GSS_C_NO_CONTEXT;
     gss_buffer_desc outputToken = GSS_C_EMPTY_BUFFER;
+    struct gss_channel_bindings_struct bindings;
+    gss_channel_bindings_t channelBindings = GSS_C_NO_CHANNEL_BINDINGS;
 
     *tokenData = NULL;
     *tokenLen = 0;
@@ -70,6 +74,15 @@ static OM_uint32 generateToken(const char *spn, void **tokenData, size_t *tokenL
         return major;
     }
 
+    // Bind the token to the TLS connection, if there is one. The
+    // addresses are left empty, as they are for all TLS channel bindings.
+    if (cbLen > 0) {
+        memset(&bindings, 0, sizeof(bindings));
+        bindings.application_data.value = cbData;
+        bindings.application_data.length = cbLen;
+        channelBindings = &bindings;
+    }
+
     // Initialize security context to get the SPNEGO token
     major = gss_init_sec_context(
         &minor,
@@ -79,7 +92,7 @@ static OM_uint32 generateToken(const char *spn, void **tokenData, size_t *tokenL
         GSS_SPNEGO_MECHANISM,  // SPNEGO mechanism
         0,                     // no special flags
         0,                     // default lifetime
-        GSS_C_NO_CHANNEL_BINDINGS,
+        channelBindings,
         GSS_C_NO_BUFFER,       // no input token (first call)
         NULL,                  // actual mechanism (not needed)
         &outputToken,
@@ -117,48 +130,10 @@ static OM_uint32 generateToken(const char *spn, void **tokenData, size_t *tokenL
 import "C"
 
 import (
-	"encoding/base64"
 	"fmt"
-	"log"
-	"net/http"
-	"net/url"
 	"unsafe"
 )
 
-// negotiateAuthenticator implements proxyAuthenticator using SPNEGO
-// over GSS.framework on macOS. It does NOT enforce a host allowlist
-// itself — that's the picker's job (see *authChain.allowedHost), which
-// applies uniformly to Basic, NTLM, and Negotiate. The only per-method
-// applicability check Negotiate enforces is "do we currently have a
-// Kerberos ticket?" — re-checked on every 407 so a ticket that
-// arrives mid-session (Apple SSO completing, kinit, etc.) is honoured
-// automatically without an alpaca restart.
-type negotiateAuthenticator struct {
-	// hasTicket is the ticket-availability check used by applicableTo
-	// at picker time. Defaults to checkKerberosTicket; tests inject
-	// their own to avoid depending on the developer's real Kerberos
-	// state.
-	hasTicket func() bool
-}
-
-// newNegotiateAuthenticator returns a negotiateAuthenticator that will
-// be consulted on every 407 response. It does NOT require a Kerberos
-// ticket to exist at the moment alpaca starts: applicableTo() re-checks
-// ticket availability per-request, so a ticket that arrives later (e.g.
-// because Apple SSO finishes after alpaca, or the user runs kinit
-// mid-session) starts being honoured at the next 407 without a
-// restart.
-func newNegotiateAuthenticator() proxyAuthenticator {
-	if checkKerberosTicket() {
-		log.Println("Kerberos ticket found")
-	} else {
-		log.Println("No Kerberos ticket at startup; will check again " +
-			"on each 407 response so a ticket that arrives later " +
-			"(e.g. via kinit or Apple SSO) is honoured automatically")
-	}
-	return &negotiateAuthenticator{hasTicket: checkKerberosTicket}
-}
-
 // checkKerberosTicket returns true if valid Kerberos credentials exist.
 // Uses GSS.framework to check the system credential store, which includes
 // tickets managed by Apple SSO and the Ticket Viewer app.
@@ -167,17 +142,24 @@ func checkKerberosTicket() bool {
 }
 
 // generateSPNEGOToken creates a SPNEGO token for the given proxy host using
-// the macOS GSS.framework and the current user's Kerberos TGT.
-func generateSPNEGOToken(proxyHost string) ([]byte, error) {
+// the macOS GSS.framework and the current user's Kerberos TGT. If cb isn't
+// nil, the token is bound to it (see channelbinding.go).
+func generateSPNEGOToken(proxyHost string, cb []byte) ([]byte, error) {
 	spn := "HTTP@" + proxyHost
 	cSPN := C.CString(spn)
 	defer C.free(unsafe.Pointer(cSPN))
+	var cbData unsafe.Pointer
+	if len(cb) > 0 {
+		cbData = C.CBytes(cb)
+		defer C.free(cbData)
+	}
 
 	var tokenData unsafe.Pointer
 	var tokenLen C.size_t
 	var minorStatus C.OM_uint32
 
-	major := C.generateToken(cSPN, &tokenData, &tokenLen, &minorStatus)
+	major := C.generateToken(cSPN, cbData, C.size_t(len(cb)), &tokenData, &tokenLen,
+		&minorStatus)
 	if tokenData != nil {
 		defer C.free(tokenData)
 	}
@@ -191,61 +173,3 @@ func generateSPNEGOToken(proxyHost string) ([]byte, error) {
 
 	return C.GoBytes(tokenData, C.int(tokenLen)), nil
 }
-
-func (n *negotiateAuthenticator) scheme() string { return "Negotiate" }
-
-// applicableTo enforces two policies at picker time:
-//
-//  1. The proxy host must be non-empty (we cannot generate an SPN
-//     without it).
-//  2. A valid Kerberos ticket must currently be available. We re-check
-//     on every 407 because the user's ticket may have expired or been
-//     revoked since alpaca started; if it has, returning false here
-//     causes the picker to omit Negotiate and fall through to NTLM /
-//     Basic instead of failing the chain on a stale-ticket error.
-//
-// Host policy (the ALPACA_PROXY_AUTH_ALLOWLIST gate) is enforced at the
-// picker level in *authChain.pick, uniformly across Basic, NTLM, and
-// Negotiate, so this method intentionally doesn't repeat that check.
-//
-// Returning false is silent fall-through; the chain proceeds to the
-// next configured authenticator.
-func (n *negotiateAuthenticator) applicableTo(proxyHost string) bool {
-	if proxyHost == "" {
-		return false
-	}
-	check := n.hasTicket
-	if check == nil {
-		check = checkKerberosTicket
-	}
-	if !check() {
-		log.Printf("Kerberos ticket no longer valid; skipping Negotiate for %s",
-			proxyHost)
-		return false
-	}
-	return true
-}
-
-// do performs Negotiate/SPNEGO proxy authentication. It generates a SPNEGO
-// token for the upstream proxy and sends the request with a
-// Proxy-Authorization: Negotiate header.
-func (n *negotiateAuthenticator) do(req *http.Request, rt http.RoundTripper) (*http.Response, error) {
-	// Get the proxy host from the request context.
-	proxyHost := ""
-	if value := req.Context().Value(contextKeyProxy); value != nil {
-		proxy := value.(*url.URL)
-		proxyHost = proxy.Hostname()
-	}
-	if proxyHost == "" {
-		return nil, fmt.Errorf("cannot determine proxy host for Negotiate auth")
-	}
-
-	token, err := generateSPNEGOToken(proxyHost)
-	if err != nil {
-		log.Printf("Error generating SPNEGO token for %s: %v", proxyHost, err)
-		return nil, err
-	}
-
-	req.Header.Set("Proxy-Authorization", "Negotiate "+base64.StdEncoding.EncodeToString(token))
-	return rt.RoundTrip(req)
-}
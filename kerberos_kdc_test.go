@@ -0,0 +1,253 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build e2e && linux
+
+// End-to-end test for the Linux (gokrb5) Negotiate backend against a real
+// MIT KDC, which the test creates in a temporary directory and runs on a
+// free port on localhost. Unlike kerberos_integration_test.go, it doesn't
+// need docker or root, just the MIT server and client tools:
+//
+//   apt install krb5-kdc krb5-admin-server krb5-user   # Debian, Ubuntu
+//   dnf install krb5-server krb5-workstation           # Fedora
+//
+// Run with:
+//
+//   go test -tags=e2e -run TestKerberosMITKDC -v .
+//
+// The test calls t.Skip() when the tools are missing.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// kdcFixture is a running MIT KDC for testRealm, with a user principal
+// (alice) and a service principal for testProxyHost.
+type kdcFixture struct {
+	dir  string
+	env  []string
+	bins map[string]string
+	// service is the keytab for HTTP/proxy.example.test, which the fake
+	// proxy uses to verify the tokens that alpaca sends.
+	service *keytab.Keytab
+}
+
+// findKrb5Binary looks for one of the MIT tools, which are often installed
+// in an sbin directory that isn't on a regular user's PATH.
+func findKrb5Binary(name string) string {
+	if path, err := exec.LookPath(name); err == nil {
+		return path
+	}
+	for _, dir := range []string{"/usr/sbin", "/usr/local/sbin", "/sbin"} {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+func newKDCFixture(t *testing.T) *kdcFixture {
+	kf := &kdcFixture{dir: t.TempDir(), bins: make(map[string]string)}
+	for _, name := range []string{"krb5kdc", "kdb5_util", "kadmin.local", "kinit"} {
+		if kf.bins[name] = findKrb5Binary(name); kf.bins[name] == "" {
+			t.Skipf("e2e: %s not found (install the MIT krb5 server and client tools)", name)
+		}
+	}
+
+	// Reserve a port for the KDC. There's a small window in which
+	// another process could take it, but that's fine for a test.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	_, port, _ := net.SplitHostPort(addr)
+	require.NoError(t, l.Close())
+
+	kdcConf := filepath.Join(kf.dir, "kdc.conf")
+	require.NoError(t, os.WriteFile(kdcConf, []byte(fmt.Sprintf(`
+[kdcdefaults]
+    kdc_listen = 127.0.0.1:%[2]s
+    kdc_tcp_listen = 127.0.0.1:%[2]s
+
+[realms]
+    %[3]s = {
+        database_name = %[1]s/principal
+        key_stash_file = %[1]s/stash
+        acl_file = %[1]s/kadm5.acl
+        supported_enctypes = aes256-cts-hmac-sha1-96:normal
+        max_life = 1h
+    }
+
+[logging]
+    kdc = FILE:%[1]s/kdc.log
+`, kf.dir, port, testRealm)), 0o600))
+	krb5Conf := filepath.Join(kf.dir, "krb5.conf")
+	require.NoError(t, os.WriteFile(krb5Conf, []byte(fmt.Sprintf(`
+[libdefaults]
+    default_realm = %[2]s
+    dns_lookup_kdc = false
+    dns_lookup_realm = false
+    rdns = false
+    udp_preference_limit = 1
+    default_tkt_enctypes = aes256-cts-hmac-sha1-96
+    default_tgs_enctypes = aes256-cts-hmac-sha1-96
+    permitted_enctypes = aes256-cts-hmac-sha1-96
+
+[realms]
+    %[2]s = {
+        kdc = %[1]s
+    }
+
+[domain_realm]
+    .example.test = %[2]s
+`, addr, testRealm)), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(kf.dir, "kadm5.acl"), nil, 0o600))
+	kf.env = append(os.Environ(), "KRB5_CONFIG="+krb5Conf, "KRB5_KDC_PROFILE="+kdcConf)
+
+	kf.run(t, "", "kdb5_util", "-r", testRealm, "create", "-s", "-P", "masterpw")
+	kf.kadmin(t, "addprinc -pw alicepw alice")
+	kf.kadmin(t, "addprinc -randkey HTTP/"+testProxyHost)
+	serviceKeytab := filepath.Join(kf.dir, "http.keytab")
+	kf.kadmin(t, "ktadd -k "+serviceKeytab+" HTTP/"+testProxyHost)
+	kf.service, err = keytab.Load(serviceKeytab)
+	require.NoError(t, err)
+
+	kdc := exec.Command(kf.bins["krb5kdc"], "-n", "-r", testRealm)
+	kdc.Env = kf.env
+	require.NoError(t, kdc.Start())
+	t.Cleanup(func() {
+		_ = kdc.Process.Kill()
+		_ = kdc.Wait()
+		if t.Failed() {
+			log, _ := os.ReadFile(filepath.Join(kf.dir, "kdc.log"))
+			t.Logf("e2e: kdc.log:\n%s", log)
+		}
+	})
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err == nil
+	}, 10*time.Second, 50*time.Millisecond, "KDC didn't start listening on %s", addr)
+
+	// Point alpaca at the test realm, and make sure that it can't pick
+	// up the developer's own credentials.
+	t.Setenv("KRB5_CONFIG", krb5Conf)
+	t.Setenv("KRB5CCNAME", "FILE:"+filepath.Join(kf.dir, "krb5cc"))
+	t.Setenv("KRB5_CLIENT_KTNAME", filepath.Join(kf.dir, "nonexistent.keytab"))
+	return kf
+}
+
+func (kf *kdcFixture) run(t *testing.T, stdin string, name string, args ...string) {
+	cmd := exec.Command(kf.bins[name], args...)
+	cmd.Env = kf.env
+	cmd.Stdin = strings.NewReader(stdin)
+	output, err := cmd.CombinedOutput()
+	require.NoErrorf(t, err, "%s %v failed:\n%s", name, args, output)
+}
+
+func (kf *kdcFixture) kadmin(t *testing.T, query string) {
+	kf.run(t, "", "kadmin.local", "-r", testRealm, "-q", query)
+}
+
+func (kf *kdcFixture) kinit(t *testing.T) {
+	kf.run(t, "alicepw\n", "kinit", "-c", "FILE:"+filepath.Join(kf.dir, "krb5cc"), "alice")
+}
+
+// authenticate sends a request through a fake proxy that requires
+// Negotiate, and returns the name of the user that the proxy saw.
+func (kf *kdcFixture) authenticate(t *testing.T, n *negotiateAuthenticator) string {
+	var user string
+	verifier := &kerberosFixture{keytab: kf.service}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token, ok := strings.CutPrefix(req.Header.Get("Proxy-Authorization"), "Negotiate ")
+		if !ok {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		b, err := base64.StdEncoding.DecodeString(token)
+		require.NoError(t, err)
+		user = verifier.verify(t, b)
+	}))
+	defer proxy.Close()
+	// Use the proxy's SPN-bearing name, but connect to the test server.
+	_, port, _ := net.SplitHostPort(proxy.Listener.Addr().String())
+	proxyURL := &url.URL{Scheme: "http", Host: net.JoinHostPort(testProxyHost, port)}
+	tr := &http.Transport{
+		Proxy: http.ProxyURL(proxyURL),
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, proxy.Listener.Addr().String())
+		},
+	}
+	defer tr.CloseIdleConnections()
+	req, err := http.NewRequest(http.MethodGet, "http://www.example.test/", nil)
+	require.NoError(t, err)
+	req = req.WithContext(context.WithValue(req.Context(), contextKeyProxy, proxyURL))
+	resp, err := n.do(req, tr)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	return user
+}
+
+func TestKerberosMITKDC(t *testing.T) {
+	kf := newKDCFixture(t)
+	neg, ok := newNegotiateAuthenticator().(*negotiateAuthenticator)
+	require.True(t, ok)
+
+	t.Run("No ticket before kinit", func(t *testing.T) {
+		assert.False(t, neg.applicableTo(testProxyHost))
+	})
+
+	t.Run("Service ticket from KDC after kinit", func(t *testing.T) {
+		// The cache only holds a TGT, so this needs a TGS exchange
+		// with the KDC.
+		kf.kinit(t)
+		require.True(t, neg.applicableTo(testProxyHost))
+		assert.Equal(t, "alice", kf.authenticate(t, neg))
+	})
+
+	t.Run("No ticket after kdestroy", func(t *testing.T) {
+		require.NoError(t, os.Remove(filepath.Join(kf.dir, "krb5cc")))
+		assert.False(t, neg.applicableTo(testProxyHost))
+	})
+
+	t.Run("Client keytab", func(t *testing.T) {
+		path := filepath.Join(kf.dir, "alice.keytab")
+		kf.kadmin(t, "ktadd -norandkey -k "+path+" alice")
+		t.Setenv("KRB5_CLIENT_KTNAME", "FILE:"+path)
+		require.True(t, neg.applicableTo(testProxyHost))
+		assert.Equal(t, "alice", kf.authenticate(t, neg))
+	})
+}
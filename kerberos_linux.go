@@ -0,0 +1,241 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/client"
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// Linux has no system-wide Kerberos API, so we use the pure-Go gokrb5
+// library and find the user's credentials the same way that MIT krb5 does:
+//
+//  1. the credentials cache named by KRB5CCNAME, or by default_ccache_name
+//     in krb5.conf, or FILE:/tmp/krb5cc_<uid> (populated by kinit or SSSD);
+//  2. failing that, the client keytab named by KRB5_CLIENT_KTNAME, or
+//     /var/kerberos/krb5/user/<uid>/client.keytab.
+//
+// Both are read afresh on every 407, so running kinit while alpaca is
+// running takes effect straight away.
+
+// checkKerberosTicket returns true if valid Kerberos credentials exist.
+func checkKerberosTicket() bool {
+	_, err := newKerberosClient()
+	if err != nil {
+		slog.Debug("No usable Kerberos credentials", "error", err)
+	}
+	return err == nil
+}
+
+// generateSPNEGOToken creates a SPNEGO token for the given proxy host, using
+// a service ticket for HTTP/proxyHost. If cb isn't nil, the token is bound
+// to it (see channelbinding.go).
+func generateSPNEGOToken(proxyHost string, cb []byte) ([]byte, error) {
+	cl, err := newKerberosClient()
+	if err != nil {
+		return nil, err
+	}
+	defer cl.Destroy()
+	if err := cl.AffirmLogin(); err != nil {
+		return nil, fmt.Errorf("couldn't acquire Kerberos credentials: %w", err)
+	}
+	tkt, key, err := cl.GetServiceTicket("HTTP/" + proxyHost)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get service ticket for HTTP/%s: %w", proxyHost, err)
+	}
+	// This is what spnego.SPNEGOClient does, except that gokrb5 always
+	// sends empty channel bindings, so we replace its authenticator with
+	// one that has ours.
+	flags := []int{gssapi.ContextFlagInteg, gssapi.ContextFlagConf}
+	mt, err := spnego.NewKRB5TokenAPREQ(cl, tkt, key, flags, nil)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := types.NewAuthenticator(cl.Credentials.Domain(), cl.Credentials.CName())
+	if err != nil {
+		return nil, err
+	}
+	auth.Cksum = types.Checksum{
+		CksumType: chksumtype.GSSAPI,
+		Checksum:  kerberosAuthenticatorChecksum(cb, flags),
+	}
+	if mt.APReq, err = messages.NewAPReq(tkt, key, auth); err != nil {
+		return nil, err
+	}
+	mtb, err := mt.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	token := spnego.SPNEGOToken{
+		Init: true,
+		NegTokenInit: spnego.NegTokenInit{
+			MechTypes:      []asn1.ObjectIdentifier{gssapi.OIDKRB5.OID()},
+			MechTokenBytes: mtb,
+		},
+	}
+	return token.Marshal()
+}
+
+// kerberosAuthenticatorChecksum returns the checksum for the authenticator in
+// a GSS-API Kerberos token (RFC 4121, section 4.1.1), which holds the channel
+// bindings hash and the context flags.
+func kerberosAuthenticatorChecksum(cb []byte, flags []int) []byte {
+	b := make([]byte, 24)
+	binary.LittleEndian.PutUint32(b, 16) // Lgth, the size of Bnd
+	if cb != nil {
+		copy(b[4:20], channelBindingsHash(cb))
+	}
+	var f uint32
+	for _, flag := range flags {
+		f |= uint32(flag)
+	}
+	binary.LittleEndian.PutUint32(b[20:], f)
+	return b
+}
+
+// newKerberosClient returns a client that uses the user's ticket cache or,
+// if there isn't a valid ticket, their client keytab.
+func newKerberosClient() (*client.Client, error) {
+	paths := os.Getenv("KRB5_CONFIG")
+	if paths == "" {
+		paths = "/etc/krb5.conf"
+	}
+	// KRB5_CONFIG can be a colon-separated list of files; use the first
+	// one that exists.
+	var cfg *krb5config.Config
+	var ccname string
+	var err error
+	for _, path := range strings.Split(paths, ":") {
+		if cfg, ccname, err = loadKrb5Config(path); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if name := os.Getenv("KRB5CCNAME"); name != "" {
+		ccname = name
+	} else if ccname == "" {
+		ccname = "FILE:/tmp/krb5cc_%{uid}"
+	}
+	cl, ccErr := clientFromCCache(expandKrb5Path(ccname), cfg)
+	if ccErr == nil {
+		return cl, nil
+	}
+	ktname := os.Getenv("KRB5_CLIENT_KTNAME")
+	if ktname == "" {
+		ktname = "FILE:/var/kerberos/krb5/user/%{euid}/client.keytab"
+	}
+	cl, ktErr := clientFromKeytab(expandKrb5Path(ktname), cfg)
+	if ktErr == nil {
+		return cl, nil
+	}
+	return nil, fmt.Errorf("%w; %w", ccErr, ktErr)
+}
+
+// loadKrb5Config loads a krb5.conf file. gokrb5 doesn't parse the
+// default_ccache_name setting, so it is returned separately.
+func loadKrb5Config(path string) (*krb5config.Config, string, error) {
+	cfg, err := krb5config.Load(path)
+	var unsupported krb5config.UnsupportedDirective
+	if errors.As(err, &unsupported) {
+		// The rest of the file was parsed, and is good enough for us.
+		err = nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close() //nolint:errcheck
+	var ccname string
+	scanner := bufio.NewScanner(f)
+	section := ""
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			section = line
+		} else if key, value, ok := strings.Cut(line, "="); ok &&
+			section == "[libdefaults]" &&
+			strings.TrimSpace(key) == "default_ccache_name" {
+			ccname = strings.TrimSpace(value)
+		}
+	}
+	return cfg, ccname, scanner.Err()
+}
+
+// expandKrb5Path expands the parameters that are commonly used in
+// default_ccache_name and friends.
+func expandKrb5Path(path string) string {
+	path = strings.TrimPrefix(path, "FILE:")
+	return strings.NewReplacer(
+		"%{uid}", strconv.Itoa(os.Getuid()),
+		"%{euid}", strconv.Itoa(os.Geteuid()),
+		"%{USERID}", strconv.Itoa(os.Getuid()),
+		"%{TEMP}", os.TempDir(),
+	).Replace(path)
+}
+
+func clientFromCCache(name string, cfg *krb5config.Config) (*client.Client, error) {
+	cc, err := loadCCache(name)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read credentials cache %s: %w", name, err)
+	}
+	// gokrb5 can't renew tickets that came from a cache, so check that
+	// the TGT hasn't expired rather than failing later on.
+	tgt, ok := cc.GetEntry(types.PrincipalName{
+		NameType:   nametype.KRB_NT_SRV_INST,
+		NameString: []string{"krbtgt", cc.DefaultPrincipal.Realm},
+	})
+	if !ok {
+		return nil, fmt.Errorf("no ticket-granting ticket in credentials cache %s", name)
+	} else if !time.Now().Before(tgt.EndTime) {
+		return nil, fmt.Errorf("ticket-granting ticket in %s expired at %v",
+			name, tgt.EndTime)
+	}
+	return client.NewFromCCache(cc, cfg, client.DisablePAFXFAST(true))
+}
+
+func clientFromKeytab(path string, cfg *krb5config.Config) (*client.Client, error) {
+	kt, err := keytab.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read client keytab %s: %w", path, err)
+	} else if len(kt.Entries) == 0 {
+		return nil, fmt.Errorf("client keytab %s is empty", path)
+	}
+	principal := kt.Entries[0].Principal
+	return client.NewWithKeytab(strings.Join(principal.Components, "/"), principal.Realm,
+		kt, cfg, client.DisablePAFXFAST(true)), nil
+}
@@ -0,0 +1,374 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// The realm and principals are fictitious; EXAMPLE.TEST is reserved for
+// testing by RFC 6761.
+const (
+	testRealm     = "EXAMPLE.TEST"
+	testProxyHost = "proxy.example.test"
+)
+
+// writeCCacheData appends a length-prefixed string, as used in the FILE
+// credentials cache format.
+func writeCCacheData(b *bytes.Buffer, data []byte) {
+	_ = binary.Write(b, binary.BigEndian, uint32(len(data)))
+	b.Write(data)
+}
+
+func marshalCCachePrincipal(b *bytes.Buffer, pn types.PrincipalName, realm string) {
+	_ = binary.Write(b, binary.BigEndian, uint32(pn.NameType))
+	_ = binary.Write(b, binary.BigEndian, uint32(len(pn.NameString)))
+	writeCCacheData(b, []byte(realm))
+	for _, s := range pn.NameString {
+		writeCCacheData(b, []byte(s))
+	}
+}
+
+// kerberosFixture holds a service keytab, and tickets for a user that were
+// issued (offline) using keys from that keytab, so that the SPNEGO tokens
+// that alpaca generates can be verified without a KDC.
+type kerberosFixture struct {
+	keytab *keytab.Keytab
+	user   types.PrincipalName
+}
+
+func newKerberosFixture(t *testing.T) *kerberosFixture {
+	kt := keytab.New()
+	now := time.Now()
+	for _, princ := range []string{"krbtgt/" + testRealm, "HTTP/" + testProxyHost} {
+		require.NoError(t, kt.AddEntry(princ, testRealm, "secret-"+princ, now, 1,
+			etypeID.AES256_CTS_HMAC_SHA1_96))
+	}
+	return &kerberosFixture{
+		keytab: kt,
+		user:   types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, "alice"),
+	}
+}
+
+// credential returns a serialised ccache entry for a ticket to the given
+// service, which expires at endTime.
+func (kf *kerberosFixture) credential(t *testing.T, spn string, endTime time.Time) []byte {
+	sname := types.NewPrincipalName(nametype.KRB_NT_SRV_INST, spn)
+	now := time.Now()
+	tkt, key, err := messages.NewTicket(kf.user, testRealm, sname, testRealm,
+		types.NewKrbFlags(), kf.keytab, etypeID.AES256_CTS_HMAC_SHA1_96, 1,
+		now, now, endTime, endTime)
+	require.NoError(t, err)
+	tktBytes, err := tkt.Marshal()
+	require.NoError(t, err)
+	var b bytes.Buffer
+	marshalCCachePrincipal(&b, kf.user, testRealm)
+	marshalCCachePrincipal(&b, sname, testRealm)
+	_ = binary.Write(&b, binary.BigEndian, uint16(key.KeyType))
+	writeCCacheData(&b, key.KeyValue)
+	for _, ts := range []time.Time{now, now, endTime, endTime} {
+		_ = binary.Write(&b, binary.BigEndian, uint32(ts.Unix()))
+	}
+	b.WriteByte(0)                                    // is_skey
+	_ = binary.Write(&b, binary.BigEndian, uint32(0)) // ticket flags
+	_ = binary.Write(&b, binary.BigEndian, uint32(0)) // addresses
+	_ = binary.Write(&b, binary.BigEndian, uint32(0)) // authdata
+	writeCCacheData(&b, tktBytes)
+	writeCCacheData(&b, nil) // second ticket
+	return b.Bytes()
+}
+
+func (kf *kerberosFixture) principal() []byte {
+	var b bytes.Buffer
+	marshalCCachePrincipal(&b, kf.user, testRealm)
+	return b.Bytes()
+}
+
+// setup writes a krb5.conf and a credentials cache containing a TGT that
+// expires at tgtEndTime and a service ticket for the proxy, and points the
+// Kerberos environment variables at them.
+func (kf *kerberosFixture) setup(t *testing.T, tgtEndTime time.Time) string {
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "krb5.conf")
+	require.NoError(t, os.WriteFile(conf, []byte(`
+includedir /etc/krb5.conf.d/
+
+[libdefaults]
+    default_realm = EXAMPLE.TEST
+    dns_lookup_kdc = false
+
+[realms]
+    EXAMPLE.TEST = {
+        kdc = 127.0.0.1:1
+    }
+`), 0o600))
+	ccache := filepath.Join(dir, "krb5cc")
+	data := assembleCCache(kf.principal(), [][]byte{
+		kf.credential(t, "krbtgt/"+testRealm, tgtEndTime),
+		kf.credential(t, "HTTP/"+testProxyHost, time.Now().Add(time.Hour)),
+	})
+	require.NoError(t, os.WriteFile(ccache, data, 0o600))
+	t.Setenv("KRB5_CONFIG", conf)
+	t.Setenv("KRB5CCNAME", "FILE:"+ccache)
+	t.Setenv("KRB5_CLIENT_KTNAME", filepath.Join(dir, "nonexistent.keytab"))
+	return ccache
+}
+
+// verify checks a SPNEGO token in the way that a proxy would.
+func (kf *kerberosFixture) verify(t *testing.T, token []byte) string {
+	var st spnego.SPNEGOToken
+	require.NoError(t, st.Unmarshal(token))
+	s := spnego.SPNEGOService(kf.keytab, service.DecodePAC(false))
+	ok, ctx, status := s.AcceptSecContext(&st)
+	require.True(t, ok, status.Error())
+	// gokrb5 doesn't export the key that it stores the identity under.
+	key := "github.com/jcmturner/gokrb5/v8/ctxCredentials"
+	id, ok := ctx.Value(key).(*credentials.Credentials)
+	require.True(t, ok)
+	return id.UserName()
+}
+
+func TestGenerateSPNEGOToken(t *testing.T) {
+	kf := newKerberosFixture(t)
+	kf.setup(t, time.Now().Add(time.Hour))
+	assert.True(t, checkKerberosTicket())
+	token, err := generateSPNEGOToken(testProxyHost, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", kf.verify(t, token))
+}
+
+func TestGenerateSPNEGOTokenChannelBindings(t *testing.T) {
+	kf := newKerberosFixture(t)
+	kf.setup(t, time.Now().Add(time.Hour))
+	for _, test := range []struct {
+		name string
+		cb   []byte
+		bnd  []byte
+	}{
+		{"None", nil, make([]byte, 16)},
+		{"TLS", []byte("tls-server-end-point:abc"),
+			channelBindingsHash([]byte("tls-server-end-point:abc"))},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			token, err := generateSPNEGOToken(testProxyHost, test.cb)
+			require.NoError(t, err)
+			assert.Equal(t, "alice", kf.verify(t, token))
+			// Decrypt the authenticator, and check its checksum.
+			var st spnego.SPNEGOToken
+			require.NoError(t, st.Unmarshal(token))
+			var mt spnego.KRB5Token
+			require.NoError(t, mt.Unmarshal(st.NegTokenInit.MechTokenBytes))
+			require.NoError(t, mt.APReq.Ticket.DecryptEncPart(kf.keytab, nil))
+			require.NoError(t, mt.APReq.DecryptAuthenticator(mt.APReq.Ticket.DecryptedEncPart.Key))
+			cksum := mt.APReq.Authenticator.Cksum.Checksum
+			require.Len(t, cksum, 24)
+			assert.Equal(t, uint32(16), binary.LittleEndian.Uint32(cksum))
+			assert.Equal(t, test.bnd, cksum[4:20])
+			assert.Equal(t, uint32(gssapi.ContextFlagInteg|gssapi.ContextFlagConf),
+				binary.LittleEndian.Uint32(cksum[20:]))
+		})
+	}
+}
+
+func TestCheckKerberosTicket(t *testing.T) {
+	kf := newKerberosFixture(t)
+	t.Run("Expired", func(t *testing.T) {
+		kf.setup(t, time.Now().Add(-time.Minute))
+		assert.False(t, checkKerberosTicket())
+	})
+	t.Run("Missing", func(t *testing.T) {
+		ccache := kf.setup(t, time.Now().Add(time.Hour))
+		require.NoError(t, os.Remove(ccache))
+		assert.False(t, checkKerberosTicket())
+	})
+	t.Run("Keytab", func(t *testing.T) {
+		ccache := kf.setup(t, time.Now().Add(time.Hour))
+		require.NoError(t, os.Remove(ccache))
+		path := filepath.Join(t.TempDir(), "client.keytab")
+		kt := keytab.New()
+		require.NoError(t, kt.AddEntry("alice", testRealm, "alicepw", time.Now(), 1,
+			etypeID.AES256_CTS_HMAC_SHA1_96))
+		b, err := kt.Marshal()
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, b, 0o600))
+		t.Setenv("KRB5_CLIENT_KTNAME", "FILE:"+path)
+		assert.True(t, checkKerberosTicket())
+	})
+	t.Run("UnsupportedType", func(t *testing.T) {
+		kf.setup(t, time.Now().Add(time.Hour))
+		t.Setenv("KRB5CCNAME", "KCM:")
+		assert.False(t, checkKerberosTicket())
+	})
+}
+
+func TestNegotiateAuthenticatorDo(t *testing.T) {
+	kf := newKerberosFixture(t)
+	kf.setup(t, time.Now().Add(time.Hour))
+	var user string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		header := req.Header.Get("Proxy-Authorization")
+		token, ok := strings.CutPrefix(header, "Negotiate ")
+		if !ok {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		b, err := base64.StdEncoding.DecodeString(token)
+		require.NoError(t, err)
+		user = kf.verify(t, b)
+	}))
+	defer server.Close()
+	proxyURL := &url.URL{Scheme: "http", Host: testProxyHost + ":3128"}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	req = req.WithContext(context.WithValue(req.Context(), contextKeyProxy, proxyURL))
+	n := &negotiateAuthenticator{}
+	require.True(t, n.applicableTo(testProxyHost))
+	resp, err := n.do(req, http.DefaultTransport)
+	require.NoError(t, err)
+	defer resp.Body.Close() //nolint:errcheck
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "alice", user)
+}
+
+func TestLoadCCache(t *testing.T) {
+	kf := newKerberosFixture(t)
+	dir := t.TempDir()
+	data := assembleCCache(kf.principal(), nil)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tkt"), data, 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tktother"), data, 0o600))
+	for _, name := range []string{
+		filepath.Join(dir, "tkt"),
+		"FILE:" + filepath.Join(dir, "tkt"),
+		"DIR:" + dir,
+		"DIR::" + filepath.Join(dir, "tktother"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			cc, err := loadCCache(name)
+			require.NoError(t, err)
+			assert.Equal(t, testRealm, cc.DefaultPrincipal.Realm)
+			assert.Equal(t, []string{"alice"}, cc.DefaultPrincipal.PrincipalName.NameString)
+		})
+	}
+	_, err := loadCCache("KCM:1000")
+	assert.Error(t, err)
+}
+
+func TestDirCCachePrimary(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "primary"), []byte("tktABC\n"), 0o600))
+	path, err := dirCCachePath(dir)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "tktABC"), path)
+}
+
+func TestParseKeyringResidual(t *testing.T) {
+	for _, test := range []struct {
+		residual string
+		expected keyringResidual
+	}{
+		{"persistent:1000", keyringResidual{"persistent", "1000", ""}},
+		{"persistent:1000:krb_ccache_x", keyringResidual{"persistent", "1000", "krb_ccache_x"}},
+		{"session:foo", keyringResidual{"session", "foo", ""}},
+		{"user:foo:bar", keyringResidual{"user", "foo", "bar"}},
+		{"legacy_name", keyringResidual{"legacy", "legacy_name", ""}},
+	} {
+		t.Run(test.residual, func(t *testing.T) {
+			assert.Equal(t, test.expected, parseKeyringResidual(test.residual))
+		})
+	}
+}
+
+func TestLoadKrb5ConfigDefaultCCacheName(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "krb5.conf")
+	require.NoError(t, os.WriteFile(path, []byte(`
+[libdefaults]
+    default_realm = EXAMPLE.TEST
+    default_ccache_name = KEYRING:persistent:%{uid}
+`), 0o600))
+	cfg, ccname, err := loadKrb5Config(path)
+	require.NoError(t, err)
+	assert.Equal(t, testRealm, cfg.LibDefaults.DefaultRealm)
+	assert.Equal(t, "KEYRING:persistent:%{uid}", ccname)
+}
+
+// addKeyringCCache creates a KEYRING cache in the process keyring, laid out
+// in the same way as MIT krb5 does, and returns its name.
+func addKeyringCCache(t *testing.T, principal []byte, creds ...[]byte) string {
+	collection, err := unix.AddKey("keyring", keyringCollection+"alpacatest", nil,
+		unix.KEY_SPEC_PROCESS_KEYRING)
+	if err != nil {
+		t.Skipf("kernel keyring unavailable: %v", err)
+	}
+	t.Cleanup(func() { _, _ = unix.KeyctlInt(unix.KEYCTL_INVALIDATE, collection, 0, 0, 0) })
+	name := "krb_ccache_test"
+	primary := binary.BigEndian.AppendUint32(nil, 1)
+	primary = binary.BigEndian.AppendUint32(primary, uint32(len(name)))
+	primary = append(primary, name...)
+	_, err = unix.AddKey("user", keyringPrimaryKey, primary, collection)
+	require.NoError(t, err)
+	cache, err := unix.AddKey("keyring", name, nil, collection)
+	require.NoError(t, err)
+	_, err = unix.AddKey("user", keyringPrincipalKey, principal, cache)
+	require.NoError(t, err)
+	_, err = unix.AddKey("user", keyringTimeOffsetKey, make([]byte, 8), cache)
+	require.NoError(t, err)
+	for i, cred := range creds {
+		_, err = unix.AddKey("user", fmt.Sprintf("cred%d", i), cred, cache)
+		require.NoError(t, err)
+	}
+	return "KEYRING:process:alpacatest"
+}
+
+func TestKeyringCCache(t *testing.T) {
+	kf := newKerberosFixture(t)
+	kf.setup(t, time.Now().Add(time.Hour))
+	name := addKeyringCCache(t, kf.principal(),
+		kf.credential(t, "krbtgt/"+testRealm, time.Now().Add(time.Hour)),
+		kf.credential(t, "HTTP/"+testProxyHost, time.Now().Add(time.Hour)))
+	cc, err := loadCCache(name)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alice"}, cc.DefaultPrincipal.PrincipalName.NameString)
+	assert.Len(t, cc.GetEntries(), 2)
+
+	t.Setenv("KRB5CCNAME", name)
+	token, err := generateSPNEGOToken(testProxyHost, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", kf.verify(t, token))
+}
@@ -18,29 +18,33 @@ package main
 
 import (
 	"fmt"
-	"os"
 
 	"github.com/samuong/go-ntlmssp"
 	ring "github.com/zalando/go-keyring"
 )
 
-type keyring struct{}
+type keyring struct {
+	domain, username string
+}
 
 func fromKeyring() *keyring {
 	return &keyring{}
 }
 
-func (k *keyring) getCredentials() (*authenticator, error) {
-
-	var (
-		username = os.Getenv("NTLM_USERNAME")
-		domain   = os.Getenv("NTLM_DOMAIN")
-	)
+// forUser sets the account to look up in the keyring. These come from the
+// NTLM_USERNAME and NTLM_DOMAIN environment variables (or the equivalent
+// config file settings).
+func (k *keyring) forUser(domain, username string) *keyring {
+	k.domain = domain
+	k.username = username
+	return k
+}
 
-	pwd, err := ring.Get("alpaca", username)
+func (k *keyring) getCredentials() (*authenticator, error) {
+	pwd, err := ring.Get("alpaca", k.username)
 	if err != nil {
 		return nil, fmt.Errorf("cannot get user secret from keyring: %w", err)
 	}
 	hash := ntlmssp.GetNtlmHash(pwd)
-	return &authenticator{domain, username, hash}, nil
+	return &authenticator{k.domain, k.username, hash}, nil
 }
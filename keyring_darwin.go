@@ -17,7 +17,7 @@ package main
 import (
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os/exec"
 	"strings"
 
@@ -33,6 +33,12 @@ func fromKeyring() *keyring {
 	return &keyring{execCommand: exec.Command}
 }
 
+// forUser is a no-op on macOS: the account is taken from NoMAD's
+// UserPrincipal setting rather than from NTLM_USERNAME and NTLM_DOMAIN.
+func (k *keyring) forUser(domain, username string) *keyring {
+	return k
+}
+
 func (k *keyring) readDefaultForNoMAD(key string) (string, error) {
 	userDomain := "com.trusourcelabs.NoMAD"
 	mpDomain := fmt.Sprintf("/Library/Managed Preferences/%s.plist", userDomain)
@@ -80,6 +86,6 @@ func (k *keyring) getCredentials() (*authenticator, error) {
 	}
 	user, domain := substrs[0], substrs[1]
 	hash := ntlmssp.GetNtlmHash(k.readPasswordFromKeychain(userPrincipal))
-	log.Printf("Found NoMAD credentials for %s\\%s in system keychain", domain, user)
+	slog.Info("Found NoMAD credentials in system keychain", "domain", domain, "username", user)
 	return &authenticator{domain, user, hash}, nil
 }
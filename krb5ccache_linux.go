@@ -0,0 +1,259 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"golang.org/x/sys/unix"
+)
+
+// loadCCache loads the credentials cache with the given name, which uses the
+// same TYPE:residual syntax as KRB5CCNAME. FILE, DIR and KEYRING caches are
+// supported; KCM (used by SSSD) isn't, since it needs a daemon to talk to.
+func loadCCache(name string) (*credentials.CCache, error) {
+	typ, residual, ok := strings.Cut(name, ":")
+	if !ok || strings.Contains(typ, "/") {
+		// A name without a type prefix is the path to a file.
+		typ, residual = "FILE", name
+	}
+	switch typ {
+	case "FILE":
+		return credentials.LoadCCache(residual)
+	case "DIR":
+		path, err := dirCCachePath(residual)
+		if err != nil {
+			return nil, err
+		}
+		return credentials.LoadCCache(path)
+	case "KEYRING":
+		b, err := readKeyringCCache(residual)
+		if err != nil {
+			return nil, err
+		}
+		cc := new(credentials.CCache)
+		return cc, cc.Unmarshal(b)
+	default:
+		return nil, fmt.Errorf("unsupported credentials cache type %q "+
+			"(set KRB5CCNAME to a FILE:, DIR: or KEYRING: cache)", typ)
+	}
+}
+
+// dirCCachePath returns the file that holds the credentials for a DIR cache.
+// The residual is either a directory, whose primary cache is named in the
+// "primary" file (defaulting to "tkt"), or ":" followed by the path of a
+// specific cache file in the directory.
+func dirCCachePath(residual string) (string, error) {
+	if path, ok := strings.CutPrefix(residual, ":"); ok {
+		return path, nil
+	}
+	name := "tkt"
+	b, err := os.ReadFile(filepath.Join(residual, "primary"))
+	if err == nil {
+		name = strings.TrimSpace(string(b))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	return filepath.Join(residual, name), nil
+}
+
+// keyringResidual is a parsed KEYRING cache name, which takes one of these
+// forms (see "ccache types" in the MIT krb5 documentation):
+//
+//	KEYRING:persistent:uid[:subsidiary]
+//	KEYRING:{user,session,process}:collection[:subsidiary]
+//	KEYRING:name (the "legacy" form, stored in the session keyring)
+type keyringResidual struct {
+	anchor     string
+	collection string
+	subsidiary string
+}
+
+func parseKeyringResidual(residual string) keyringResidual {
+	var kr keyringResidual
+	anchor, rest, ok := strings.Cut(residual, ":")
+	if !ok {
+		anchor, rest = "legacy", residual
+	}
+	kr.anchor = anchor
+	kr.collection, kr.subsidiary, _ = strings.Cut(rest, ":")
+	return kr
+}
+
+// These names match those used by MIT krb5's cc_keyring.c.
+const (
+	keyringPrincipalKey  = "__krb5_princ__"
+	keyringTimeOffsetKey = "__krb5_time_offsets__"
+	keyringPrimaryKey    = "krb_ccache:primary"
+	keyringCollection    = "_krb_"
+	keyringPersistent    = "_krb"
+)
+
+// readKeyringCCache reads a KEYRING cache from the kernel keyring and
+// returns it in the FILE cache format, so that it can be parsed by gokrb5.
+// MIT krb5 stores the default principal and each credential as separate
+// "user" keys in a per-cache keyring, serialised in the same way as a
+// version 4 FILE cache.
+func readKeyringCCache(residual string) ([]byte, error) {
+	kr := parseKeyringResidual(residual)
+	collection, err := keyringCollectionID(kr)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't find keyring for KEYRING:%s: %w", residual, err)
+	}
+	if kr.subsidiary == "" {
+		kr.subsidiary = keyringPrimaryName(collection, kr)
+	}
+	cache, err := unix.KeyctlSearch(collection, "keyring", kr.subsidiary, 0)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't find credentials cache KEYRING:%s: %w", residual, err)
+	}
+	var principal []byte
+	var creds [][]byte
+	ids, err := keyctlRead(cache)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i+4 <= len(ids); i += 4 {
+		id := int(int32(binary.NativeEndian.Uint32(ids[i:])))
+		typ, desc, err := keyctlDescribe(id)
+		if err != nil || typ != "user" || desc == keyringTimeOffsetKey {
+			continue
+		}
+		payload, err := keyctlRead(id)
+		if err != nil {
+			return nil, err
+		}
+		if desc == keyringPrincipalKey {
+			principal = payload
+		} else {
+			creds = append(creds, payload)
+		}
+	}
+	if principal == nil {
+		return nil, fmt.Errorf("credentials cache KEYRING:%s is empty", residual)
+	}
+	return assembleCCache(principal, creds), nil
+}
+
+// keyringCollectionID returns the ID of the keyring that holds the caches in
+// a collection.
+func keyringCollectionID(kr keyringResidual) (int, error) {
+	var anchor int
+	switch kr.anchor {
+	case "persistent":
+		uid := os.Geteuid()
+		if kr.collection != "" {
+			var err error
+			if uid, err = strconv.Atoi(kr.collection); err != nil {
+				return 0, fmt.Errorf("invalid uid %q", kr.collection)
+			}
+		}
+		persistent, err := unix.KeyctlInt(unix.KEYCTL_GET_PERSISTENT, uid,
+			unix.KEY_SPEC_PROCESS_KEYRING, 0, 0)
+		if err != nil {
+			return 0, err
+		}
+		return unix.KeyctlSearch(persistent, "keyring", keyringPersistent, 0)
+	case "user":
+		anchor = unix.KEY_SPEC_USER_KEYRING
+	case "session":
+		anchor = unix.KEY_SPEC_SESSION_KEYRING
+	case "process":
+		anchor = unix.KEY_SPEC_PROCESS_KEYRING
+	case "legacy":
+		// Legacy caches are linked directly into the session keyring.
+		return unix.KEY_SPEC_SESSION_KEYRING, nil
+	default:
+		return 0, fmt.Errorf("unsupported keyring type %q", kr.anchor)
+	}
+	return unix.KeyctlSearch(anchor, "keyring", keyringCollection+kr.collection, 0)
+}
+
+// keyringPrimaryName returns the name of the primary cache in a collection,
+// as recorded by kinit or kswitch.
+func keyringPrimaryName(collection int, kr keyringResidual) string {
+	if kr.anchor == "legacy" {
+		return kr.collection
+	}
+	id, err := unix.KeyctlSearch(collection, "user", keyringPrimaryKey, 0)
+	if err != nil {
+		return "tkt"
+	}
+	payload, err := keyctlRead(id)
+	if err != nil {
+		return "tkt"
+	}
+	// The payload is a version number (1) and the length of the name,
+	// both as big-endian 32-bit integers, followed by the name.
+	if len(payload) < 8 || binary.BigEndian.Uint32(payload) != 1 {
+		return "tkt"
+	}
+	n := binary.BigEndian.Uint32(payload[4:])
+	if uint32(len(payload)-8) < n {
+		return "tkt"
+	}
+	return string(payload[8 : 8+n])
+}
+
+// assembleCCache joins a serialised default principal and credentials into
+// a version 4 FILE cache, with an empty header.
+func assembleCCache(principal []byte, creds [][]byte) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{5, 4, 0, 0})
+	b.Write(principal)
+	for _, cred := range creds {
+		b.Write(cred)
+	}
+	return b.Bytes()
+}
+
+func keyctlRead(id int) ([]byte, error) {
+	for {
+		size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, buf, 0)
+		if err != nil {
+			return nil, err
+		} else if n <= size {
+			return buf[:n], nil
+		}
+		// The key grew between the two calls; try again.
+	}
+}
+
+// keyctlDescribe returns the type and description of a key.
+func keyctlDescribe(id int) (string, string, error) {
+	desc, err := unix.KeyctlString(unix.KEYCTL_DESCRIBE, id)
+	if err != nil {
+		return "", "", err
+	}
+	// The description is formatted as "type;uid;gid;perm;description".
+	fields := strings.SplitN(desc, ";", 5)
+	if len(fields) != 5 {
+		return "", "", fmt.Errorf("unexpected key description %q", desc)
+	}
+	return fields[0], fields[4], nil
+}
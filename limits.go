@@ -0,0 +1,200 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// limits bounds how long alpaca waits on clients, proxies and servers, and
+// how many tunnels each client can have open. A zero duration or count means
+// no limit.
+type limits struct {
+	dialTimeout         time.Duration
+	headerTimeout       time.Duration
+	idleTimeout         time.Duration
+	tunnelIdleTimeout   time.Duration
+	maxHeaderBytes      int
+	maxTunnelsPerClient int
+}
+
+// netDialer makes every outgoing connection, to proxies and to servers, so
+// that one that doesn't answer can't hold up a request forever.
+var netDialer = &net.Dialer{}
+
+// tunnelIdleTimeout is how long a tunnel can go without any data passing
+// through it (in either direction) before it's closed.
+var tunnelIdleTimeout time.Duration
+
+// tunnelLimits counts the tunnels that each client has open. Like
+// activeTunnels, it's package-level, since tunnels outlive the handlers that
+// opened them.
+var tunnelLimits = newTunnelLimiter()
+
+// applyLimits sets the limits for outgoing connections and tunnels. It's
+// called once at startup, before anything is dialled; the HTTP server's own
+// limits are set by createServer.
+func applyLimits(l limits) {
+	netDialer.Timeout = l.dialTimeout
+	tunnelIdleTimeout = l.tunnelIdleTimeout
+	tunnelLimits.mu.Lock()
+	tunnelLimits.max = l.maxTunnelsPerClient
+	tunnelLimits.mu.Unlock()
+}
+
+// connectDeadline returns the time by which a tunnel that's started now has
+// to be open, or the zero time if there's no limit. It covers the proxy's
+// response to CONNECT as well as the dial, since a proxy that accepts
+// connections but never answers is just as stuck as one that can't be
+// reached.
+func connectDeadline() time.Time {
+	if netDialer.Timeout == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(netDialer.Timeout)
+}
+
+// tunnelLimiter caps the number of tunnels that each client can have open at
+// once, so that one misbehaving client can't use up every socket.
+type tunnelLimiter struct {
+	mu   sync.Mutex
+	max  int
+	open map[netip.Addr]int
+}
+
+func newTunnelLimiter() *tunnelLimiter {
+	return &tunnelLimiter{open: make(map[netip.Addr]int)}
+}
+
+// acquire claims a tunnel for the client at remoteAddr, and returns a func to
+// call once the tunnel has closed. It returns false if the client already has
+// as many tunnels open as it's allowed. Clients without an IP address (i.e.
+// on a unix socket) aren't limited.
+func (tl *tunnelLimiter) acquire(remoteAddr string) (release func(), ok bool) {
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return func() {}, true
+	}
+	addr := addrPort.Addr().Unmap()
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if tl.max == 0 {
+		return func() {}, true
+	}
+	if tl.open[addr] >= tl.max {
+		return nil, false
+	}
+	tl.open[addr]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			tl.mu.Lock()
+			defer tl.mu.Unlock()
+			if tl.open[addr]--; tl.open[addr] == 0 {
+				delete(tl.open, addr)
+			}
+		})
+	}, true
+}
+
+// idleTimer closes a tunnel once no data has passed through it for a while.
+// A nil idleTimer never fires.
+type idleTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+// newIdleTimer returns an idleTimer that closes each of closers once timeout
+// has passed without a call to touch. It returns nil if timeout is zero.
+func newIdleTimer(timeout time.Duration, closers ...io.Closer) *idleTimer {
+	if timeout == 0 {
+		return nil
+	}
+	return &idleTimer{timeout, time.AfterFunc(timeout, func() {
+		for _, c := range closers {
+			_ = c.Close()
+		}
+	})}
+}
+
+// touch records activity on the tunnel, which restarts the timer.
+func (t *idleTimer) touch() {
+	if t != nil {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+func (t *idleTimer) stop() {
+	if t != nil {
+		t.timer.Stop()
+	}
+}
+
+// idleReader touches its idleTimer whenever data is read.
+type idleReader struct {
+	io.Reader
+	idle *idleTimer
+}
+
+func (r idleReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		r.idle.touch()
+	}
+	return n, err
+}
+
+// watchedConn is a connection that's closed once nothing has been read from or
+// written to it for a while. It's used for the SOCKS5 server, which does its
+// own copying.
+type watchedConn struct {
+	net.Conn
+	idle *idleTimer
+}
+
+// watchIdle returns conn wrapped in a watchedConn, or conn itself if timeout is
+// zero.
+func watchIdle(conn net.Conn, timeout time.Duration) net.Conn {
+	idle := newIdleTimer(timeout, conn)
+	if idle == nil {
+		return conn
+	}
+	return &watchedConn{conn, idle}
+}
+
+func (c *watchedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.idle.touch()
+	}
+	return n, err
+}
+
+func (c *watchedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.idle.touch()
+	}
+	return n, err
+}
+
+func (c *watchedConn) Close() error {
+	c.idle.stop()
+	return c.Conn.Close()
+}
@@ -0,0 +1,90 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelLimiter(t *testing.T) {
+	tl := newTunnelLimiter()
+	tl.max = 2
+	release1, ok := tl.acquire("192.0.2.1:1000")
+	require.True(t, ok)
+	release2, ok := tl.acquire("[::ffff:192.0.2.1]:1001")
+	require.True(t, ok)
+	_, ok = tl.acquire("192.0.2.1:1002")
+	assert.False(t, ok, "third tunnel from the same client")
+	_, ok = tl.acquire("192.0.2.2:1000")
+	assert.True(t, ok, "tunnel from another client")
+	_, ok = tl.acquire("@")
+	assert.True(t, ok, "unix socket clients aren't limited")
+
+	// Releasing twice only frees one tunnel.
+	release1()
+	release1()
+	_, ok = tl.acquire("192.0.2.1:1003")
+	assert.True(t, ok)
+	_, ok = tl.acquire("192.0.2.1:1004")
+	assert.False(t, ok)
+	release2()
+	_, ok = tl.acquire("192.0.2.1:1005")
+	assert.True(t, ok)
+}
+
+func TestTunnelLimiterUnlimited(t *testing.T) {
+	tl := newTunnelLimiter()
+	for range 100 {
+		_, ok := tl.acquire("192.0.2.1:1000")
+		require.True(t, ok)
+	}
+}
+
+func TestWatchIdle(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close() //nolint:errcheck
+	conn := watchIdle(server, 200*time.Millisecond)
+	defer conn.Close() //nolint:errcheck
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	// Keep the connection busy for longer than the timeout.
+	for range 5 {
+		time.Sleep(100 * time.Millisecond)
+		_, err := client.Write([]byte("x"))
+		require.NoError(t, err)
+	}
+	// Then leave it idle, until it's closed.
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err := client.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestWatchIdleDisabled(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close() //nolint:errcheck
+	assert.Equal(t, server, watchIdle(server, 0))
+}
@@ -14,11 +14,8 @@
 
 package main
 
-import (
-	"io"
-	"log"
-)
+import "log/slog"
 
 func init() {
-	log.SetOutput(io.Discard)
+	slog.SetDefault(slog.New(slog.DiscardHandler))
 }
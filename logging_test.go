@@ -0,0 +1,78 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoggerAddsContextFields(t *testing.T) {
+	var b bytes.Buffer
+	logger := newLogger(&b, slog.LevelInfo, "json")
+	ctx := context.WithValue(context.Background(), contextKeyID, uint64(42))
+	ctx = context.WithValue(ctx, contextKeyProxy, &url.URL{Host: "proxy.test:3128"})
+	logger.With("scheme", "NTLM").InfoContext(ctx, "Attempting authentication")
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(b.Bytes(), &record))
+	assert.Equal(t, "Attempting authentication", record["msg"])
+	assert.Equal(t, 42.0, record["id"])
+	assert.Equal(t, "proxy.test:3128", record["proxy"])
+	assert.Equal(t, "NTLM", record["scheme"])
+	assert.Regexp(t, `^logging_test\.go:\d+$`, record["source"])
+}
+
+func TestLoggerWithoutContext(t *testing.T) {
+	var b bytes.Buffer
+	newLogger(&b, slog.LevelInfo, "json").Info("Config reloaded")
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(b.Bytes(), &record))
+	assert.NotContains(t, record, "id")
+	assert.NotContains(t, record, "proxy")
+}
+
+func TestLoggerLevel(t *testing.T) {
+	var b bytes.Buffer
+	logger := newLogger(&b, slog.LevelWarn, "text")
+	logger.Info("not logged")
+	logger.Warn("logged", "error", "boom")
+	out := b.String()
+	assert.Equal(t, 1, strings.Count(out, "\n"))
+	assert.Contains(t, out, "level=WARN")
+	assert.Contains(t, out, "msg=logged error=boom")
+}
+
+func TestConfigLogLevel(t *testing.T) {
+	cfg := defaultConfig()
+	require.NoError(t, cfg.validate())
+	assert.Equal(t, slog.LevelInfo, cfg.logLevel())
+	cfg.LogLevel = "DEBUG"
+	require.NoError(t, cfg.validate())
+	assert.Equal(t, slog.LevelDebug, cfg.logLevel())
+	cfg.Quiet = true
+	assert.Equal(t, slog.LevelError, cfg.logLevel())
+	cfg.LogLevel = "verbose"
+	assert.Error(t, cfg.validate())
+	cfg.LogLevel, cfg.LogFormat = "info", "xml"
+	assert.Error(t, cfg.validate())
+}
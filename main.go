@@ -15,16 +15,23 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"flag"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"os/user"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/things-go/go-socks5"
 )
 
 var BuildVersion string
@@ -52,72 +59,194 @@ func (s *stringArrayFlag) Set(value string) error {
 }
 
 func main() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile | log.Lmicroseconds)
-
-	var hosts stringArrayFlag
+	var hosts, allowClients, denyClients stringArrayFlag
 	flag.Var(&hosts, "l", "address to listen on")
-	port := flag.Int("p", 3128, "port number to listen on")
+	flag.Var(&allowClients, "allow-client",
+		"address range (CIDR) of clients that may use the proxy (can be repeated)")
+	flag.Var(&denyClients, "deny-client",
+		"address range (CIDR) of clients that may not use the proxy (can be repeated)")
+	port := flag.Int("p", 3128, "port number to listen on (0 to disable)")
+	socksPort := flag.Int("socks-port", 0,
+		"port number to listen on for SOCKS5 clients (0 to disable)")
+	transparentPort := flag.Int("transparent-port", 0,
+		"port number to listen on for redirected connections (Linux only, 0 to disable)")
+	unixSocket := flag.String("unix-socket", "", "path of a unix socket to listen on")
+	unixSocketMode := flag.String("unix-socket-mode", "0600", "permissions for the unix socket")
+	unixSocketOwner := flag.String("unix-socket-owner", "",
+		"owner for the unix socket, as user[:group]")
 	pacurl := flag.String("C", "", "url of proxy auto-config (pac) file")
+	wpad := flag.Bool("wpad", false,
+		"discover the pac url with WPAD if it isn't in the system settings (Linux and BSD only)")
 	domain := flag.String("d", "", "domain of the proxy account (for NTLM auth)")
 	username := flag.String("u", whoAmI(), "username for proxy auth (NTLM)")
 	printHash := flag.Bool("H", false, "print hashed NTLM credentials for non-interactive use")
 	noKerberos := flag.Bool("no-kerberos", false,
-		"disable Kerberos/Negotiate auto-detection (macOS only)")
-	quiet := flag.Bool("q", false, "quiet mode, suppress all log output")
+		"disable Kerberos/Negotiate auto-detection (macOS and Linux only)")
+	quiet := flag.Bool("q", false, "quiet mode, only log errors")
+	logLevel := flag.String("log-level", "info", "minimum level to log (debug, info, warn, error)")
+	logFormat := flag.String("log-format", "text", "log output format (text or json)")
 	version := flag.Bool("version", false, "print version number")
 	enableSocks := flag.Bool("enable-socks", false, "allow SOCKS5 proxies from PAC files")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second,
+		"how long to wait for requests and tunnels to finish when shutting down")
+	dialTimeout := flag.Duration("dial-timeout", 30*time.Second,
+		"how long to wait to connect to a proxy or server (0 for no limit)")
+	tunnelIdleTimeout := flag.Duration("tunnel-idle-timeout", 0,
+		"how long to keep a tunnel open with no data passing through it (0 for no limit)")
+	maxTunnels := flag.Int("max-tunnels-per-client", 0,
+		"maximum number of tunnels each client can have open at once (0 for no limit)")
+	healthCheckHost := flag.String("health-check-host", "",
+		"host:port to CONNECT to when checking whether a failed proxy is back up")
+	http2 := flag.Bool("http2", false,
+		"tunnel CONNECT requests over HTTP/2 to HTTPS proxies that support it, "+
+			"and accept them from clients over HTTP/2")
+	configPath := flag.String("config", "",
+		"path to config file (default "+defaultConfigPath()+")")
 	flag.Parse()
 
-	if *quiet {
-		log.SetOutput(io.Discard)
-	}
-
-	// default to localhost if no hosts are specified
-	if len(hosts) == 0 {
-		hosts = append(hosts, "localhost")
-	}
-
 	if *version {
 		fmt.Println("Alpaca", BuildVersion)
 		os.Exit(0)
 	}
 
-	var basicAuth *basicAuthenticator
-	var a *authenticator
+	// Flags that weren't given on the command line must not clobber
+	// values from the config file or environment, so only explicitly
+	// set flags are layered on top.
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
 
-	// Basic credentials come from BASIC_CREDENTIALS to avoid leaking the
-	// password into shell history (mirrors how NTLM_CREDENTIALS works).
-	if value := os.Getenv("BASIC_CREDENTIALS"); value != "" {
-		basicAuth = newBasicAuthenticator(value)
-		log.Println("Basic proxy authentication configured from BASIC_CREDENTIALS")
+	applyFlags := func(cfg *config) {
+		if set["l"] {
+			cfg.Listen = hosts
+		}
+		if set["p"] {
+			cfg.Port = *port
+		}
+		if set["socks-port"] {
+			cfg.SocksPort = *socksPort
+		}
+		if set["transparent-port"] {
+			cfg.TransparentPort = *transparentPort
+		}
+		if set["unix-socket"] {
+			cfg.UnixSocket = *unixSocket
+		}
+		if set["unix-socket-mode"] {
+			cfg.UnixSocketMode = *unixSocketMode
+		}
+		if set["unix-socket-owner"] {
+			cfg.UnixSocketOwner = *unixSocketOwner
+		}
+		if set["allow-client"] {
+			cfg.Clients.Allow = allowClients
+		}
+		if set["deny-client"] {
+			cfg.Clients.Deny = denyClients
+		}
+		if set["C"] {
+			cfg.PACURL = *pacurl
+		}
+		if set["d"] && *domain != "" {
+			cfg.Auth.NTLMDomain = *domain
+			cfg.Auth.NTLMPrompt = true
+		}
+		if set["u"] {
+			cfg.Auth.NTLMUsername = *username
+		}
+		if set["wpad"] {
+			cfg.WPAD = *wpad
+		}
+		if set["q"] {
+			cfg.Quiet = *quiet
+		}
+		if set["log-level"] {
+			cfg.LogLevel = *logLevel
+		}
+		if set["log-format"] {
+			cfg.LogFormat = *logFormat
+		}
+		if set["enable-socks"] {
+			cfg.EnableSocks = *enableSocks
+		}
+		if set["http2"] {
+			cfg.HTTP2 = *http2
+		}
+		if set["health-check-host"] {
+			cfg.HealthCheckHost = *healthCheckHost
+		}
+		if set["shutdown-timeout"] {
+			cfg.ShutdownTimeout = shutdownTimeout.String()
+		}
+		if set["dial-timeout"] {
+			cfg.Limits.DialTimeout = dialTimeout.String()
+		}
+		if set["tunnel-idle-timeout"] {
+			cfg.Limits.TunnelIdleTimeout = tunnelIdleTimeout.String()
+		}
+		if set["max-tunnels-per-client"] {
+			cfg.Limits.MaxTunnelsPerClient = *maxTunnels
+		}
+		if *noKerberos {
+			cfg.Auth.Methods = slices.DeleteFunc(cfg.Auth.Methods,
+				func(m string) bool { return strings.EqualFold(m, schemeNegotiate) })
+		}
+	}
+	setLogger := func(cfg *config) {
+		slog.SetDefault(newLogger(os.Stderr, cfg.logLevel(), cfg.LogFormat))
 	}
 
-	// NTLM credential sources
-	var src credentialSource
-	if *domain != "" {
-		src = fromTerminal().forUser(*domain, *username)
-	} else if value := os.Getenv("NTLM_CREDENTIALS"); value != "" {
-		src = fromEnvVar(value)
-	} else {
-		src = fromKeyring()
+	// Until the config file has been read, log according to the flags and
+	// environment alone, so that -q and -log-format also apply to messages
+	// about loading the config file.
+	early := defaultConfig()
+	early.applyEnv(os.Getenv)
+	applyFlags(early)
+	if early.validate() == nil {
+		setLogger(early)
 	}
-	if src != nil {
+
+	// loadConfig is called at startup and again on every reload (SIGHUP),
+	// so that edits to the config file take effect without a restart.
+	loadConfig := func() (*config, error) {
+		cfg := defaultConfig()
 		var err error
-		a, err = src.getCredentials()
+		if *configPath != "" {
+			err = loadConfigFile(cfg, *configPath, true)
+		} else if path := defaultConfigPath(); path != "" {
+			err = loadConfigFile(cfg, path, false)
+		}
 		if err != nil {
-			// The keyring source returns an error whenever NoMAD
-			// isn't installed and configured — the dominant case
-			// for any developer Mac without the specific NoMAD
-			// plist. The terminal and env-var sources return an
-			// error when the user supplied creds but they're
-			// malformed; today both cases land on this branch
-			// indistinguishably. Log a calm one-liner so a user
-			// without NoMAD doesn't see what looks like an error.
-			log.Println("NTLM credentials not available from the " +
-				"configured source")
+			return nil, err
+		}
+		cfg.applyEnv(os.Getenv)
+		applyFlags(cfg)
+		// default to localhost if no hosts are specified
+		if len(cfg.Listen) == 0 {
+			cfg.Listen = append(cfg.Listen, "localhost")
 		}
+		return cfg, cfg.validate()
 	}
 
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Error("Error loading config", "error", err)
+		os.Exit(1)
+	}
+	setLogger(cfg)
+
+	// The terminal prompt (-d or ntlm_prompt) is interactive, so its
+	// credentials are collected once and reused across reloads. The other
+	// sources are re-read on every reload.
+	var src credentialSource
+	if cfg.Auth.NTLMPrompt {
+		username := cfg.Auth.NTLMUsername
+		if username == "" {
+			username = whoAmI()
+		}
+		src = fromTerminal().forUser(cfg.Auth.NTLMDomain, username)
+	}
+	a := getNTLMCredentials(cfg, src)
+
 	if *printHash {
 		if a == nil {
 			fmt.Println("Please specify a domain (using -d) and username (using -u)")
@@ -128,95 +257,336 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Build auth chain: Negotiate → NTLM → Basic (matches Chrome's hierarchy;
-	// Basic has the lowest security score because it sends credentials unencrypted).
-	//
-	// Kerberos/Negotiate is auto-detected on macOS: if a valid ticket is
-	// present at startup (or appears within -w seconds), Negotiate is
-	// added to the chain. No flag needed for the common "Apple SSO is
-	// signed in" case — alpaca behaves like the keyring source.
-	var methods []proxyAuthenticator
-	if !*noKerberos {
-		if neg := newNegotiateAuthenticator(); neg != nil {
-			log.Println("Kerberos/Negotiate authentication available")
-			methods = append(methods, neg)
+	// Limits are applied before anything is dialled, and (like the
+	// listeners) they stay as they are until a restart.
+	applyLimits(cfg.limits())
+	// The disk cache has to be set up before the first PAC download, so
+	// that there's something to fall back to if it fails.
+	pacCacheDir = defaultPACCacheDir()
+	handler := new(reloadableHandler)
+	dialer := new(reloadableDialer)
+	access := new(reloadableAccess)
+	h, d := newHandler(cfg, buildAuthChain(cfg, a))
+	handler.swap(h)
+	dialer.swap(d)
+	access.swap(cfg.clientAccess())
+
+	errch := make(chan error)
+
+	// Every listener is recorded, so that they can all be closed when
+	// shutting down.
+	var listenersMu sync.Mutex
+	var listeners []net.Listener
+	track := func(l net.Listener) net.Listener {
+		listenersMu.Lock()
+		defer listenersMu.Unlock()
+		listeners = append(listeners, l)
+		return l
+	}
+
+	// listen serves on the given port of every listen address.
+	listen := func(msg string, port int, serve func(net.Listener) error) {
+		for _, host := range cfg.Listen {
+			address := net.JoinHostPort(host, strconv.Itoa(port))
+			for _, network := range networks(host) {
+				go func(network string) {
+					l, err := net.Listen(network, address)
+					if err != nil {
+						errch <- err
+					} else {
+						slog.Info(msg, "network", network, "address", address)
+						errch <- serve(track(l))
+					}
+				}(network)
+			}
 		}
 	}
-	if a != nil {
-		methods = append(methods, a)
+	s := createServer(handler, access, cfg.limits(), cfg.HTTP2)
+	// Whether SOCKS5 clients have to authenticate is part of the SOCKS5
+	// handshake, so it's settled here, and not changed by a reload.
+	var socksCredentials socks5.CredentialStore
+	if cfg.clientAccess().needsCredentials() {
+		socksCredentials = access
 	}
-	if basicAuth != nil {
-		methods = append(methods, basicAuth)
+	socks := newSocksServer(dialer.dial, socksCredentials)
+	serveSocks := func(l net.Listener) error {
+		return socks.Serve(access.listener(l))
 	}
-	auth := newAuthChain(methods...)
-	if auth != nil {
-		// Resolve the proxy-auth allowlist. Empty / unset is permissive
-		// (any host receives credentials) — parseAuthAllowlist treats
-		// "" as nil. Picking env-var-only (no companion flag) keeps the
-		// "either a flag or an env var, never both" convention the rest
-		// of alpaca already follows for security-sensitive inputs like
-		// BASIC_CREDENTIALS and NTLM_CREDENTIALS.
-		auth.hostAllowlist = parseAuthAllowlist(os.Getenv("ALPACA_PROXY_AUTH_ALLOWLIST"))
-		if len(auth.hostAllowlist) > 0 {
-			log.Printf("Proxy auth allowlist active: %v",
-				auth.hostAllowlist)
-		} else {
-			// Discoverability nudge for users who want to restrict
-			// where credentials go. The default is permissive because
-			// most users trust their PAC implicitly, but a hostile or
-			// MITM'd PAC over plain HTTP could otherwise direct
-			// alpaca to authenticate against attacker-named proxies.
-			// One line at startup; quiet enough not to be noise.
-			log.Println("Proxy auth allowlist: permissive (any host " +
-				"nominated by your PAC will receive credentials). " +
-				"Set ALPACA_PROXY_AUTH_ALLOWLIST to restrict.")
+	transparent := func(l net.Listener) error {
+		return s.Serve(newTransparentListener(access.anonymousListener(l), originalDst,
+			dialer.dial))
+	}
+	activated, err := activationListeners()
+	if err != nil {
+		slog.Error("Error using sockets from systemd", "error", err)
+		os.Exit(1)
+	}
+	if len(activated) > 0 {
+		// With socket activation, systemd owns the listening sockets, so
+		// the listen addresses and port numbers aren't used. The name
+		// of each socket (FileDescriptorName= in the socket unit) says
+		// what it's for; the default is the HTTP proxy.
+		for _, al := range activated {
+			serve := s.Serve
+			switch al.name {
+			case "socks":
+				serve = serveSocks
+			case "transparent":
+				serve = transparent
+			}
+			slog.Info("Listening on socket from systemd", "name", al.name,
+				"address", al.Addr().String())
+			go func() { errch <- serve(track(al.Listener)) }()
+		}
+	} else {
+		if cfg.Port != 0 {
+			listen("Listening", cfg.Port, s.Serve)
+		}
+		if cfg.SocksPort != 0 {
+			listen("Listening for SOCKS5", cfg.SocksPort, serveSocks)
+		}
+		if cfg.TransparentPort != 0 {
+			// Redirected HTTP requests are served by the same server
+			// as the main listener, once their host has been filled in.
+			listen("Listening for redirected connections", cfg.TransparentPort,
+				transparent)
 		}
 	}
-	if auth == nil {
-		log.Println("No authentication methods configured; alpaca will " +
-			"surface proxy 407 responses as 502 Bad Gateway to clients")
+	if cfg.UnixSocket != "" {
+		l, err := listenUnix(cfg.UnixSocket, cfg.unixSocketMode(), cfg.UnixSocketOwner)
+		if err != nil {
+			slog.Error("Error listening on unix socket", "path", cfg.UnixSocket,
+				"error", err)
+			os.Exit(1)
+		}
+		slog.Info("Listening", "network", "unix", "address", cfg.UnixSocket)
+		go func() { errch <- s.Serve(track(l)) }()
 	}
 
-	errch := make(chan error)
-
-	s := createServer(*port, *pacurl, auth, *enableSocks)
-	for _, host := range hosts {
-		address := net.JoinHostPort(host, strconv.Itoa(*port))
-		for _, network := range networks(host) {
-			go func(network string) {
-				l, err := net.Listen(network, address)
-				if err != nil {
-					errch <- err
-				} else {
-					log.Printf("Listening on %s %s", network, address)
-					errch <- s.Serve(l)
-				}
-			}(network)
+	reload := func() {
+		next, err := loadConfig()
+		if err != nil {
+			slog.Error("Error reloading config, keeping current settings", "error", err)
+			return
+		}
+		// The listeners are already open; changing them needs a
+		// restart. Keep the running values so that the PAC we serve
+		// keeps pointing at the right port.
+		if next.Port != cfg.Port || next.SocksPort != cfg.SocksPort ||
+			next.TransparentPort != cfg.TransparentPort ||
+			!slices.Equal(next.Listen, cfg.Listen) || next.UnixSocket != cfg.UnixSocket ||
+			next.UnixSocketMode != cfg.UnixSocketMode ||
+			next.UnixSocketOwner != cfg.UnixSocketOwner {
+			slog.Warn("Changes to listen addresses, port numbers or unix " +
+				"sockets will take effect after a restart")
+			next.Port, next.SocksPort, next.Listen = cfg.Port, cfg.SocksPort, cfg.Listen
+			next.TransparentPort = cfg.TransparentPort
+			next.UnixSocket = cfg.UnixSocket
+			next.UnixSocketMode, next.UnixSocketOwner = cfg.UnixSocketMode, cfg.UnixSocketOwner
+		}
+		if next.Limits != cfg.Limits {
+			slog.Warn("Changes to limits will take effect after a restart")
+			next.Limits = cfg.Limits
 		}
+		setLogger(next)
+		ntlm := a
+		if src == nil {
+			ntlm = getNTLMCredentials(next, nil)
+		}
+		// Build everything before swapping, so that requests keep
+		// being served with the old settings in the meantime. Tunnels
+		// that have already been hijacked don't go through the
+		// handler at all, so they're unaffected by the swap.
+		h, d := newHandler(next, buildAuthChain(next, ntlm))
+		stale := dialer.current.Load()
+		handler.swap(h)
+		dialer.swap(d)
+		access.swap(next.clientAccess())
+		// The new handler starts with a clean slate, so the old one
+		// can stop checking on its failed proxies.
+		stale.finder.close()
+		cfg = next
+		slog.Info("Config reloaded")
 	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	for {
+		select {
+		case <-hup:
+			slog.Info("Received SIGHUP, reloading config")
+			reload()
+		case err := <-errch:
+			slog.Error("Server stopped", "error", err)
+			os.Exit(1)
+		case sig := <-stop:
+			timeout := cfg.shutdownTimeout()
+			slog.Info("Shutting down", "signal", sig.String(), "timeout", timeout)
+			go func() {
+				<-stop
+				slog.Warn("Received another signal, exiting without waiting")
+				os.Exit(1)
+			}()
+			listenersMu.Lock()
+			open := slices.Clone(listeners)
+			listenersMu.Unlock()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			status := shutdown(ctx, s, open, activeTunnels)
+			cancel()
+			os.Exit(status)
+		}
+	}
+}
 
-	log.Fatal(<-errch)
+// getNTLMCredentials returns the NTLM credentials from src, or (if src is
+// nil) from NTLM_CREDENTIALS or the keyring. It returns nil if none are
+// available.
+func getNTLMCredentials(cfg *config, src credentialSource) *authenticator {
+	if src == nil && cfg.Auth.NTLMCredentials != "" {
+		src = fromEnvVar(cfg.Auth.NTLMCredentials)
+	} else if src == nil {
+		src = fromKeyring().forUser(cfg.Auth.NTLMDomain, cfg.Auth.NTLMUsername)
+	}
+	a, err := src.getCredentials()
+	if err != nil {
+		// The keyring source returns an error whenever NoMAD
+		// isn't installed and configured — the dominant case
+		// for any developer Mac without the specific NoMAD
+		// plist. The terminal and env-var sources return an
+		// error when the user supplied creds but they're
+		// malformed; today both cases land on this branch
+		// indistinguishably. Log a calm one-liner so a user
+		// without NoMAD doesn't see what looks like an error.
+		slog.Info("NTLM credentials not available from the configured source")
+		return nil
+	}
+	return a
 }
 
-func createServer(port int, pacurl string, auth *authChain, enableSocks bool) *http.Server {
-	pacWrapper := NewPACWrapper(PACData{Port: port})
-	proxyFinder := NewProxyFinder(pacurl, pacWrapper, enableSocks)
+// buildAuthChain builds the auth chain in the configured order, using the
+// given NTLM credentials (which may be nil). The default order is
+// Negotiate → NTLM → Basic (matches Chrome's hierarchy; Basic has the
+// lowest security score because it sends credentials unencrypted).
+//
+// Kerberos/Negotiate is auto-detected on macOS and Linux: if a valid
+// ticket is present at startup (or appears within -w seconds), Negotiate
+// is added to the chain. No flag needed for the common "Apple SSO is
+// signed in" (or "ran kinit") case — alpaca behaves like the keyring
+// source.
+func buildAuthChain(cfg *config, ntlm *authenticator) *authChain {
+	var methods []proxyAuthenticator
+	for _, method := range cfg.Auth.Methods {
+		switch method {
+		case schemeNegotiate:
+			if neg := newNegotiateAuthenticator(); neg != nil {
+				slog.Info("Kerberos/Negotiate authentication available")
+				methods = append(methods, neg)
+			}
+		case schemeNTLM:
+			if ntlm != nil {
+				methods = append(methods, ntlm)
+			}
+		case schemeBasic:
+			// Basic credentials come from BASIC_CREDENTIALS (or the
+			// config file) to avoid leaking the password into shell
+			// history (mirrors how NTLM_CREDENTIALS works).
+			if value := cfg.Auth.BasicCredentials; value != "" {
+				slog.Info("Basic proxy authentication configured")
+				methods = append(methods, newBasicAuthenticator(value))
+			}
+		}
+	}
+	auth := newAuthChain(methods...)
+	if auth == nil {
+		slog.Info("No authentication methods configured; alpaca will " +
+			"surface proxy 407 responses as 502 Bad Gateway to clients")
+		return nil
+	}
+	// Resolve the proxy-auth allowlist. Empty / unset is permissive
+	// (any host receives credentials) — parseAuthAllowlist treats
+	// "" as nil. Picking env-var or config file only (no companion
+	// flag) keeps the convention the rest of alpaca already follows
+	// for security-sensitive inputs like BASIC_CREDENTIALS and
+	// NTLM_CREDENTIALS.
+	auth.hostAllowlist = parseAuthAllowlist(cfg.allowlist())
+	auth.known = newSchemeCache(cfg.schemeTTL())
+	if len(auth.hostAllowlist) > 0 {
+		slog.Info("Proxy auth allowlist active", "allowlist", auth.hostAllowlist)
+	} else {
+		// Discoverability nudge for users who want to restrict
+		// where credentials go. The default is permissive because
+		// most users trust their PAC implicitly, but a hostile or
+		// MITM'd PAC over plain HTTP could otherwise direct
+		// alpaca to authenticate against attacker-named proxies.
+		// One line at startup; quiet enough not to be noise.
+		slog.Info("Proxy auth allowlist: permissive (any host " +
+			"nominated by your PAC will receive credentials). " +
+			"Set ALPACA_PROXY_AUTH_ALLOWLIST to restrict.")
+	}
+	return auth
+}
+
+// newHandler builds the middleware chain that serves proxy requests and the
+// PAC file, and the dialer for SOCKS5 and transparent clients, which shares
+// its PAC routing and auth chain. It's called at startup and again on every
+// reload; each call creates a fresh ProxyFinder (and so fetches the PAC file
+// again).
+func newHandler(cfg *config, auth *authChain) (http.Handler, *tunnelDialer) {
+	pacWrapper := NewPACWrapper(PACData{Port: cfg.Port})
+	if wpadSupported && cfg.WPAD && cfg.PACURL == "" &&
+		(auth == nil || len(auth.hostAllowlist) == 0) {
+		// Anyone who can answer for the WPAD host (or hand out DHCP
+		// leases) on the local network can pick the proxies, so the
+		// startup nudge isn't enough here.
+		slog.Warn("WPAD discovery is on, but the proxy auth allowlist is permissive, so " +
+			"a discovered PAC can send credentials to any proxy. Set " +
+			"ALPACA_PROXY_AUTH_ALLOWLIST to restrict.")
+	}
+	proxyFinder := NewProxyFinder(cfg.PACURL, cfg.WPAD, pacWrapper, cfg.EnableSocks)
+	proxyFinder.canary = cfg.HealthCheckHost
 	proxyHandler := NewProxyHandler(auth, getProxyFromContext, proxyFinder.blockProxy)
+	if cfg.HTTP2 {
+		proxyHandler.h2 = newH2Pool()
+	}
 	mux := http.NewServeMux()
 	pacWrapper.SetupHandlers(mux)
+	newStatusHandler(proxyFinder, auth).SetupHandlers(mux)
+	setupMetricsHandler(mux)
 
 	// build the handler by wrapping middleware upon middleware
 	var handler http.Handler = mux
 	handler = RequestLogger(handler)
 	handler = proxyHandler.WrapHandler(handler)
 	handler = proxyFinder.WrapHandler(handler)
-	handler = AddContextID(handler)
+	return handler, &tunnelDialer{proxyFinder, proxyHandler}
+}
+
+// createServer returns the server for alpaca's listeners. With http2, clients
+// can also speak HTTP/2 without TLS ("prior knowledge"), and open CONNECT
+// tunnels as streams on one connection.
+func createServer(handler http.Handler, access *reloadableAccess, l limits,
+	http2 bool) *http.Server {
 
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(http2)
 	return &http.Server{
-		Handler: handler,
-		// TODO: Implement HTTP/2 support. In the meantime, set TLSNextProto to a non-nil
-		// value to disable HTTP/2.
-		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+		// AddContextID sits outside of the (reloadable) handler so that
+		// request IDs keep increasing across reloads. Clients that aren't
+		// allowed in are turned away before they're given an ID. A
+		// redirected request is turned into a proxy request before
+		// access.WrapHandler sees it, so that it's checked like one.
+		Handler:     transparentHTTP(access.WrapHandler(AddContextID(handler))),
+		ConnContext: transparentContext,
+		// Tunnels are hijacked, so these only apply to plain requests
+		// (and to clients waiting to send their next request).
+		ReadHeaderTimeout: l.headerTimeout,
+		IdleTimeout:       l.idleTimeout,
+		MaxHeaderBytes:    l.maxHeaderBytes,
+		// Alpaca's listeners don't use TLS, so HTTP/2 over TLS never
+		// comes up.
+		Protocols: &protocols,
 	}
 }
 
@@ -226,7 +596,8 @@ func networks(hostname string) []string {
 	}
 	addrs, err := net.LookupIP(hostname)
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("Error resolving listen address", "host", hostname, "error", err)
+		os.Exit(1)
 	}
 	nets := make([]string, 0, 2)
 	ipv4 := false
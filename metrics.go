@@ -0,0 +1,133 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are package-level so that they survive a config reload, which
+// rebuilds every handler but should not reset the counters.
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "alpaca",
+		Name:      "requests_total",
+		Help:      "Proxied requests, by method, upstream proxy and response status code.",
+	}, []string{"method", "proxy", "code"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "alpaca",
+		Name:      "upstream_duration_seconds",
+		Help: "Time taken to receive response headers (or to establish a tunnel) " +
+			"from the upstream proxy or server, including any authentication.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"proxy"})
+
+	authAttemptsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "alpaca",
+		Name:      "auth_attempts_total",
+		Help: "Proxy authentication attempts, by proxy, scheme and result " +
+			"(success, rejected or error).",
+	}, []string{"proxy", "scheme", "result"})
+
+	blockedProxiesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "alpaca",
+		Name:      "proxy_blocks_total",
+		Help:      "Number of times a proxy was temporarily blocked after failing.",
+	}, []string{"proxy"})
+
+	pacFetchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "alpaca",
+		Name:      "pac_fetches_total",
+		Help:      "PAC file downloads, by result (success, not_modified or failure).",
+	}, []string{"result"})
+
+	tunnelBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "alpaca",
+		Name:      "tunnel_bytes_total",
+		Help: "Bytes copied through CONNECT tunnels, by direction (upstream " +
+			"is client to server, downstream is server to client).",
+	}, []string{"direction"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestsTotal,
+		upstreamDuration,
+		authAttemptsTotal,
+		blockedProxiesTotal,
+		pacFetchesTotal,
+		tunnelBytesTotal,
+	)
+}
+
+// setupMetricsHandler serves the metrics in the Prometheus text format at
+// /metrics.
+func setupMetricsHandler(mux *http.ServeMux) {
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+}
+
+// proxyLabel returns the value of the "proxy" label for the given upstream
+// proxy, which is "DIRECT" when there isn't one.
+func proxyLabel(proxyURL *url.URL) string {
+	if proxyURL == nil {
+		return "DIRECT"
+	}
+	return proxyURL.Host
+}
+
+// methodLabel returns the value of the "method" label for a request. Any
+// token is a valid method, so anything other than the standard methods is
+// counted as "OTHER", to stop clients from creating unlimited label values.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodConnect, http.MethodOptions,
+		http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+// observeRequest records the outcome of a proxied request that started at
+// the given time.
+func observeRequest(req *http.Request, proxyURL *url.URL, code int, start time.Time) {
+	proxy := proxyLabel(proxyURL)
+	requestsTotal.WithLabelValues(methodLabel(req.Method), proxy, strconv.Itoa(code)).Inc()
+	upstreamDuration.WithLabelValues(proxy).Observe(time.Since(start).Seconds())
+}
+
+// observeAuthAttempt records the result of a single authenticator's do()
+// call.
+func observeAuthAttempt(proxyHost, scheme string, resp *http.Response, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	} else if resp.StatusCode == http.StatusProxyAuthRequired {
+		result = "rejected"
+	}
+	authAttemptsTotal.WithLabelValues(proxyHost, scheme, result).Inc()
+}
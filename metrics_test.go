@@ -0,0 +1,90 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsForAuthenticatedRequest(t *testing.T) {
+	proxy := newScriptedProxy([]string{"Negotiate", "NTLM"}, "NTLM good")
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+	host := proxyURL.Host
+	chain := newAuthChain(
+		realisticFake("Negotiate", "Negotiate bad"),
+		realisticFake("NTLM", "NTLM good"))
+	ph := NewProxyHandler(chain, getProxyFromContext, func(*url.URL) {})
+	alpaca := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			ctx := context.WithValue(req.Context(), contextKeyProxy, proxyURL)
+			ph.ServeHTTP(w, req.WithContext(ctx))
+		}))
+	defer alpaca.Close()
+
+	requests := requestsTotal.WithLabelValues(http.MethodGet, host, "200")
+	rejected := authAttemptsTotal.WithLabelValues(host, "Negotiate", "rejected")
+	succeeded := authAttemptsTotal.WithLabelValues(host, "NTLM", "success")
+	before := []float64{
+		testutil.ToFloat64(requests),
+		testutil.ToFloat64(rejected),
+		testutil.ToFloat64(succeeded),
+	}
+
+	client := &http.Client{Transport: &http.Transport{Proxy: proxyServer(t, alpaca)}}
+	resp, err := client.Get("http://example.test/")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	assert.Equal(t, before[0]+1, testutil.ToFloat64(requests))
+	assert.Equal(t, before[1]+1, testutil.ToFloat64(rejected))
+	assert.Equal(t, before[2]+1, testutil.ToFloat64(succeeded))
+}
+
+func TestMethodLabel(t *testing.T) {
+	assert.Equal(t, http.MethodGet, methodLabel(http.MethodGet))
+	assert.Equal(t, http.MethodConnect, methodLabel(http.MethodConnect))
+	assert.Equal(t, "OTHER", methodLabel("PROPFIND"))
+	assert.Equal(t, "OTHER", methodLabel("get"))
+	assert.Equal(t, "OTHER", methodLabel("X-RANDOM-12345"))
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	pacFetches := testutil.ToFloat64(pacFetchesTotal.WithLabelValues("success"))
+	server := httptest.NewServer(pacjsHandler("function FindProxyForURL() {}"))
+	defer server.Close()
+	newPACFetcher(server.URL, false).download()
+	assert.Equal(t, pacFetches+1, testutil.ToFloat64(pacFetchesTotal.WithLabelValues("success")))
+
+	mux := http.NewServeMux()
+	setupMetricsHandler(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	body, err := io.ReadAll(w.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `alpaca_pac_fetches_total{result="success"}`)
+}
@@ -16,7 +16,7 @@ package main
 
 import (
 	"errors"
-	"log"
+	"log/slog"
 	"strings"
 )
 
@@ -39,6 +39,9 @@ import (
 type authChain struct {
 	methods       []proxyAuthenticator
 	hostAllowlist []string // nil = permit any host (the default)
+	// known remembers which scheme each proxy accepted last, for
+	// proactive authentication (see schemecache.go). nil = disabled.
+	known *schemeCache
 }
 
 // newAuthChain builds an authChain from the given methods, skipping nil
@@ -98,9 +101,10 @@ func (c *authChain) pick(schemes []string, proxyHost string) []proxyAuthenticato
 	// authenticate against my proxy" and the user needs to
 	// self-diagnose.
 	if !c.allowedHost(proxyHost) {
-		log.Printf("Proxy %q not in proxy-auth allowlist (allowed: %v); "+
+		slog.Warn("Proxy not in proxy-auth allowlist; "+
 			"set ALPACA_PROXY_AUTH_ALLOWLIST to include this host, "+
-			"or unset to permit any host", proxyHost, c.hostAllowlist)
+			"or unset to permit any host",
+			"proxy", proxyHost, "allowlist", c.hostAllowlist)
 		return nil
 	}
 	// RFC 9110 alignment: a 407 without a parseable Proxy-Authenticate
@@ -110,9 +114,9 @@ func (c *authChain) pick(schemes []string, proxyHost string) []proxyAuthenticato
 	// (workstation hostname, SPN) to a misbehaving proxy. Browsers do
 	// the same.
 	if len(schemes) == 0 {
-		log.Printf("Proxy %q returned 407 with no parseable "+
+		slog.Warn("Proxy returned 407 with no parseable "+
 			"Proxy-Authenticate header; refusing to send credentials",
-			proxyHost)
+			"proxy", proxyHost)
 		return nil
 	}
 	// Per-authenticator runtime policy (e.g. Negotiate's ticket-presence
@@ -121,8 +125,8 @@ func (c *authChain) pick(schemes []string, proxyHost string) []proxyAuthenticato
 	applicable := make([]proxyAuthenticator, 0, len(c.methods))
 	for _, m := range c.methods {
 		if !m.applicableTo(proxyHost) {
-			log.Printf("Auth method %s declines for proxy host %q",
-				m.scheme(), proxyHost)
+			slog.Info("Auth method declines for proxy host",
+				"scheme", m.scheme(), "proxy", proxyHost)
 			continue
 		}
 		applicable = append(applicable, m)
@@ -142,8 +146,8 @@ func (c *authChain) pick(schemes []string, proxyHost string) []proxyAuthenticato
 		}
 	}
 	if len(matched) == 0 {
-		log.Printf("Proxy advertises %v but no matching authenticator is configured",
-			schemes)
+		slog.Warn("Proxy advertises no scheme that a configured authenticator supports",
+			"proxy", proxyHost, "schemes", schemes)
 	}
 	return matched
 }
@@ -204,7 +208,7 @@ func parseAuthAllowlist(value string) []string {
 			return nil
 		}
 		if !isAllowlistEntry(part) {
-			log.Printf("Ignoring malformed proxy-auth allowlist entry %q", part)
+			slog.Warn("Ignoring malformed proxy-auth allowlist entry", "entry", part)
 			continue
 		}
 		// Normalise to dot-prefixed canonical form so allowedHost is
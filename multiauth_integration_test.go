@@ -75,9 +75,11 @@ func runProxyRequest(t *testing.T, proxy *scriptedProxy, chain *authChain,
 	require.NoError(t, err)
 	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
 	defer tr.CloseIdleConnections()
-	rd := bytes.NewReader(body)
-	req, err := http.NewRequest(http.MethodPost, "http://example.com",
-		io.NopCloser(rd))
+	rb := newReplayBuffer(bytes.NewReader(body))
+	t.Cleanup(func() { _ = rb.Close() })
+	rd, err := rb.reader(replayMaxBytes)
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, "http://example.com", rd)
 	require.NoError(t, err)
 	// Mirror the ProxyHandler middleware: stash the proxy URL on the
 	// context so applicableTo / negotiateAuthenticator can find it.
@@ -92,7 +94,8 @@ func runProxyRequest(t *testing.T, proxy *scriptedProxy, chain *authChain,
 	}
 	schemes := parseProxyAuthenticateSchemes(resp.Header)
 	_ = resp.Body.Close()
-	return retryProxyRequestWithAuth(req, tr, chain, schemes, rd)
+	resp, _, err = retryProxyRequestWithAuth(req, tr, chain, schemes, rb)
+	return resp, err
 }
 
 func TestRetryProxyRequest_FirstMethodWins(t *testing.T) {
@@ -286,9 +289,11 @@ func TestRetryProxyRequest_BodyPreservedAcrossAttempts(t *testing.T) {
 	require.NoError(t, err)
 	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
 	defer tr.CloseIdleConnections()
-	rd := bytes.NewReader([]byte(payload))
-	req, err := http.NewRequest(http.MethodPost, "http://example.com",
-		io.NopCloser(rd))
+	rb := newReplayBuffer(bytes.NewReader([]byte(payload)))
+	defer rb.Close() //nolint:errcheck
+	rd, err := rb.reader(replayMaxBytes)
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, "http://example.com", rd)
 	require.NoError(t, err)
 	req = req.WithContext(context.WithValue(req.Context(),
 		contextKeyProxy, proxyURL))
@@ -306,7 +311,7 @@ func TestRetryProxyRequest_BodyPreservedAcrossAttempts(t *testing.T) {
 	schemes := parseProxyAuthenticateSchemes(resp.Header)
 	_ = resp.Body.Close()
 
-	resp, err = retryProxyRequestWithAuth(req, tr, chain, schemes, rd)
+	resp, _, err = retryProxyRequestWithAuth(req, tr, chain, schemes, rb)
 	require.NoError(t, err)
 	defer resp.Body.Close() //nolint:errcheck
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
@@ -15,53 +15,93 @@
 package main
 
 import (
-	"log"
+	"bufio"
+	"bytes"
+	"log/slog"
 	"net"
+	"os"
 	"slices"
+	"sort"
+	"strings"
+	"sync"
 )
 
 type netMonitor interface {
 	addrsChanged() bool
+	// lastSeen returns the interface addresses and probed routes that were
+	// recorded by the most recent call to addrsChanged. It is used for
+	// diagnostics only (see the /alpaca/status endpoint).
+	lastSeen() (addrs []string, routes map[string]string)
 }
 
+// Probe for routes to a set of remote addresses. These addresses are the same
+// as those used by myIpAddressEx.
+// TODO: Cache the results so they don't need to be recalculated in
+// myIpAddress (and myIpAddressEx, when implemented).
+var probeRemotes = []string{
+	"8.8.8.8", "2001:4860:4860::8888", // public addresses
+	"10.0.0.0", "172.16.0.0", "192.168.0.0", "FC00::", // private addresses
+}
+
+// resolvConfPath is where the DNS search domains are read from (by WPAD
+// discovery, and for networkFingerprint). It's a variable so that tests can
+// replace it.
+var resolvConfPath = "/etc/resolv.conf"
+
 type netMonitorImpl struct {
+	// mu guards writes to addrs and routes, which are only made by
+	// addrsChanged, so that lastSeen can be called at the same time.
+	mu       sync.Mutex
 	addrs    map[string]struct{}
 	routes   []net.IP
 	getAddrs func() ([]net.Addr, error)
 	dial     func(network, addr string) (net.Conn, error)
 }
 
-func newNetMonitor() *netMonitorImpl {
+// newPollingNetMonitor returns a netMonitor that checks the interface
+// addresses and routes every time that it's asked whether they've changed.
+func newPollingNetMonitor() *netMonitorImpl {
 	return &netMonitorImpl{getAddrs: net.InterfaceAddrs, dial: net.Dial}
 }
 
 func (nm *netMonitorImpl) addrsChanged() bool {
 	addrs, err := nm.getAddrs()
 	if err != nil {
-		log.Printf("Error while getting network interface addresses: %q", err)
+		slog.Error("Error while getting network interface addresses", "error", err)
 		return false
 	}
 	set := addrSliceToSet(addrs)
-	// Probe for routes to a set of remote addresses. These addresses are
-	// the same as those used by myIpAddressEx.
-	// TODO: Cache the results so they don't need to be recalculated in
-	// myIpAddress (and myIpAddressEx, when implemented).
-	remotes := []string{
-		"8.8.8.8", "2001:4860:4860::8888", // public addresses
-		"10.0.0.0", "172.16.0.0", "192.168.0.0", "FC00::", // private addresses
-	}
-	locals := make([]net.IP, len(remotes))
-	for i, remote := range remotes {
+	locals := make([]net.IP, len(probeRemotes))
+	for i, remote := range probeRemotes {
 		locals[i] = nm.probeRoute(remote, false)
 	}
 	if setsAreEqual(set, nm.addrs) && slices.EqualFunc(locals, nm.routes, net.IP.Equal) {
 		return false
 	}
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
 	nm.addrs = set
 	nm.routes = locals
 	return true
 }
 
+func (nm *netMonitorImpl) lastSeen() ([]string, map[string]string) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	addrs := make([]string, 0, len(nm.addrs))
+	for addr := range nm.addrs {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	routes := make(map[string]string, len(nm.routes))
+	for i, local := range nm.routes {
+		if local != nil {
+			routes[probeRemotes[i]] = local.String()
+		}
+	}
+	return addrs, routes
+}
+
 func addrSliceToSet(slice []net.Addr) map[string]struct{} {
 	set := make(map[string]struct{})
 	for _, addr := range slice {
@@ -103,7 +143,8 @@ func (nm *netMonitorImpl) probeRoute(host string, ipv4only bool) net.IP {
 		// expect this to be a *net.UDPAddr. If this fails, it's a bug
 		// in Alpaca, and hopefully users will report it. But it's not
 		// worth panicking over so we won't end the request here.
-		log.Printf("unexpected: probeRoute host=%q ipv4only=%t: %v", host, ipv4only, err)
+		slog.Error("Unexpected error from probeRoute",
+			"host", host, "ipv4only", ipv4only, "error", err)
 		return nil
 	}
 	if ip := local.IP; ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
@@ -111,3 +152,21 @@ func (nm *netMonitorImpl) probeRoute(host string, ipv4only bool) net.IP {
 	}
 	return local.IP
 }
+
+// searchDomains returns the DNS search domains from a resolv.conf file. As
+// in the resolver, the last "search" or "domain" line wins.
+func searchDomains(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var domains []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && (fields[0] == "search" || fields[0] == "domain") {
+			domains = fields[1:]
+		}
+	}
+	return domains, nil
+}
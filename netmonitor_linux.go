@@ -0,0 +1,174 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// newNetMonitor returns a netlinkMonitor, or a polling netMonitor if alpaca
+// can't subscribe to netlink notifications (e.g. in a restrictive sandbox).
+func newNetMonitor() netMonitor {
+	nm, err := newNetlinkMonitor()
+	if err != nil {
+		slog.Warn("Error subscribing to network changes; checking for them on every "+
+			"request instead", "error", err)
+		return newPollingNetMonitor()
+	}
+	return nm
+}
+
+// netlinkMonitor is the netMonitor for Linux. Rather than checking the
+// interface addresses and routes on every request, it listens in the
+// background for the kernel's netlink notifications about links, addresses
+// and routes, and only checks again once one has arrived. Until then, asking
+// whether anything has changed is just an atomic load.
+type netlinkMonitor struct {
+	*netMonitorImpl
+	sock    *os.File
+	changed atomic.Bool
+	// polling is set if notifications stop arriving because of an error,
+	// in which case every call to addrsChanged checks again.
+	polling atomic.Bool
+}
+
+func newNetlinkMonitor() (*netlinkMonitor, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK,
+		unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	sa := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR |
+			unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_ROUTE,
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		_ = unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	nm := &netlinkMonitor{
+		netMonitorImpl: newPollingNetMonitor(),
+		// The socket is non-blocking, so reads go through the runtime's
+		// poller, and Close interrupts them.
+		sock: os.NewFile(uintptr(fd), "netlink"),
+	}
+	nm.changed.Store(true)
+	go nm.listen()
+	return nm, nil
+}
+
+// listen waits for notifications until the socket is closed. Their contents
+// don't matter; any notification means that it's time to check again.
+func (nm *netlinkMonitor) listen() {
+	buf := make([]byte, os.Getpagesize())
+	for {
+		_, err := nm.sock.Read(buf)
+		switch {
+		case err == nil, errors.Is(err, unix.ENOBUFS):
+			// ENOBUFS means that the kernel had to drop notifications,
+			// which is no reason to think that nothing changed.
+			nm.changed.Store(true)
+		case errors.Is(err, os.ErrClosed):
+			return
+		default:
+			slog.Error("Error reading network change notifications; checking for "+
+				"changes on every request instead", "error", err)
+			nm.polling.Store(true)
+			return
+		}
+	}
+}
+
+func (nm *netlinkMonitor) addrsChanged() bool {
+	if !nm.changed.Swap(false) && !nm.polling.Load() {
+		return false
+	}
+	return nm.netMonitorImpl.addrsChanged()
+}
+
+// Close stops listening for notifications.
+func (nm *netlinkMonitor) Close() error {
+	return nm.sock.Close()
+}
+
+// defaultGateways returns the gateways of the default routes, from the
+// kernel's IPv4 and IPv6 routing tables.
+func defaultGateways() []string {
+	var gateways []string
+	if data, err := os.ReadFile("/proc/net/route"); err == nil {
+		gateways = append(gateways, parseIPv4DefaultGateways(data)...)
+	}
+	if data, err := os.ReadFile("/proc/net/ipv6_route"); err == nil {
+		gateways = append(gateways, parseIPv6DefaultGateways(data)...)
+	}
+	return gateways
+}
+
+// parseIPv4DefaultGateways parses /proc/net/route, which has a header line,
+// and then a line for each route, with fields for the interface,
+// destination, gateway, and so on. The addresses are hex, in host byte
+// order.
+func parseIPv4DefaultGateways(data []byte) []string {
+	var gateways []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" || fields[2] == "00000000" {
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+		var addr [4]byte
+		binary.BigEndian.PutUint32(addr[:], binary.NativeEndian.Uint32(b))
+		gateways = append(gateways, netip.AddrFrom4(addr).String())
+	}
+	return gateways
+}
+
+// parseIPv6DefaultGateways parses /proc/net/ipv6_route, which has a line
+// for each route, with fields for the destination, its prefix length, the
+// source and its prefix length, the next hop, and so on. The addresses are
+// hex, in network byte order.
+func parseIPv6DefaultGateways(data []byte) []string {
+	const zero = "00000000000000000000000000000000"
+	var gateways []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[0] != zero || fields[1] != "00" || fields[4] == zero {
+			continue
+		}
+		b, err := hex.DecodeString(fields[4])
+		if err != nil || len(b) != 16 {
+			continue
+		}
+		gateways = append(gateways, netip.AddrFrom16([16]byte(b)).String())
+	}
+	return gateways
+}
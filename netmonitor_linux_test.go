@@ -0,0 +1,88 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// notify sends an empty netlink message straight to nm's socket, which looks
+// the same to it as a notification from the kernel.
+func notify(t *testing.T, nm *netlinkMonitor) {
+	rc, err := nm.sock.SyscallConn()
+	require.NoError(t, err)
+	var sa unix.Sockaddr
+	require.NoError(t, rc.Control(func(fd uintptr) {
+		sa, err = unix.Getsockname(int(fd))
+	}))
+	require.NoError(t, err)
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	require.NoError(t, err)
+	defer unix.Close(fd) //nolint:errcheck
+	msg := make([]byte, unix.NLMSG_HDRLEN)
+	binary.NativeEndian.PutUint32(msg, unix.NLMSG_HDRLEN)
+	dst := &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Pid: sa.(*unix.SockaddrNetlink).Pid}
+	require.NoError(t, unix.Sendto(fd, msg, 0, dst))
+}
+
+func TestNetlinkMonitor(t *testing.T) {
+	nm, err := newNetlinkMonitor()
+	if err != nil {
+		t.Skipf("can't subscribe to netlink notifications: %v", err)
+	}
+	defer nm.Close() //nolint:errcheck
+	var network mockNet
+	nm.netMonitorImpl = &netMonitorImpl{getAddrs: network.interfaceAddrs, dial: network.dial}
+
+	network.state = "offline"
+	assert.True(t, nm.addrsChanged(), "first check")
+	// Without a notification, the change goes unnoticed.
+	network.state = "wifi"
+	assert.False(t, nm.addrsChanged())
+	notify(t, nm)
+	assert.Eventually(t, nm.addrsChanged, time.Second, 10*time.Millisecond)
+	assert.False(t, nm.addrsChanged())
+	// A notification only prompts a check: if the addresses are the same
+	// (e.g. it was for a route that alpaca doesn't care about), nothing
+	// has changed.
+	notify(t, nm)
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, nm.addrsChanged())
+}
+
+func TestParseDefaultGateways(t *testing.T) {
+	// /proc/net/route has addresses in host byte order.
+	gateway := make([]byte, 4)
+	binary.NativeEndian.PutUint32(gateway, binary.BigEndian.Uint32([]byte{192, 0, 2, 1}))
+	ipv4 := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\n" +
+		"eth0\t00000000\t" + strings.ToUpper(hex.EncodeToString(gateway)) +
+		"\t0003\t0\t0\t0\t00000000\n" +
+		"eth0\t000200C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\n"
+	assert.Equal(t, []string{"192.0.2.1"}, parseIPv4DefaultGateways([]byte(ipv4)))
+
+	ipv6 := "20010db8000000000000000000000000 40 00000000000000000000000000000000 00 " +
+		"00000000000000000000000000000000 00000100 00000001 00000000 00000001 eth0\n" +
+		"00000000000000000000000000000000 00 00000000000000000000000000000000 00 " +
+		"fe800000000000000000000000000001 00000400 00000002 00000000 00000003 eth0\n"
+	assert.Equal(t, []string{"fe80::1"}, parseIPv6DefaultGateways([]byte(ipv6)))
+}
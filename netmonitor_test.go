@@ -18,10 +18,13 @@ import (
 	"errors"
 	"math/rand/v2"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // In order to test netMonitor, we use mock implementations of the
@@ -181,8 +184,25 @@ func TestNetworkMonitor(t *testing.T) {
 	network.state = "wifi"
 	assert.True(t, nm.addrsChanged())
 	assert.False(t, nm.addrsChanged())
+	addrs, routes := nm.lastSeen()
+	assert.Equal(t, []string{
+		"127.0.0.1/8", "192.168.1.2/24", "::1/128", "fe80::fedc:ba98:7654:3210/64",
+	}, addrs)
+	assert.Equal(t, map[string]string{
+		"8.8.8.8": "192.168.1.2", "10.0.0.0": "192.168.1.2",
+		"172.16.0.0": "192.168.1.2", "192.168.0.0": "192.168.1.2",
+	}, routes)
 	network.state = "vpn"
 	assert.True(t, nm.addrsChanged())
 	network.state = "offline"
 	assert.True(t, nm.addrsChanged())
 }
+
+func TestSearchDomains(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	require.NoError(t, os.WriteFile(path, []byte("domain old.example.com\n"+
+		"nameserver 192.0.2.53\nsearch eng.example.com example.org\noptions edns0\n"), 0600))
+	domains, err := searchDomains(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"eng.example.com", "example.org"}, domains)
+}
@@ -0,0 +1,82 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build freebsd || linux || netbsd || openbsd
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const nmService = "org.freedesktop.NetworkManager"
+
+// networkManagerPACURL asks NetworkManager (over D-Bus) for the proxy settings
+// of the primary connection, and returns the PAC URL from them, if they're
+// set to use one.
+func networkManagerPACURL() (string, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return "", err
+	}
+	primary, err := conn.Object(nmService, "/org/freedesktop/NetworkManager").
+		GetProperty(nmService + ".PrimaryConnection")
+	var dbusErr dbus.Error
+	if errors.As(err, &dbusErr) && dbusErr.Name == "org.freedesktop.DBus.Error.ServiceUnknown" {
+		// NetworkManager isn't running.
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	active, ok := primary.Value().(dbus.ObjectPath)
+	if !ok || active == "/" {
+		return "", nil
+	}
+	settingsPath, err := conn.Object(nmService, active).
+		GetProperty(nmService + ".Connection.Active.Connection")
+	if err != nil {
+		return "", err
+	}
+	path, ok := settingsPath.Value().(dbus.ObjectPath)
+	if !ok {
+		return "", nil
+	}
+	var settings map[string]map[string]dbus.Variant
+	err = conn.Object(nmService, path).
+		Call(nmService+".Settings.Connection.GetSettings", 0).Store(&settings)
+	if err != nil {
+		return "", err
+	}
+	return nmProxyPACURL(settings["proxy"]), nil
+}
+
+// nmProxyPACURL returns the PAC URL from the "proxy" settings of a
+// NetworkManager connection, if its method is auto (1). A PAC script that's
+// given inline is returned as a data URL.
+func nmProxyPACURL(proxy map[string]dbus.Variant) string {
+	if method, _ := proxy["method"].Value().(int32); method != 1 {
+		return ""
+	}
+	if url, _ := proxy["pac-url"].Value().(string); url != "" {
+		return url
+	}
+	if script, _ := proxy["pac-script"].Value().(string); script != "" {
+		return "data:application/x-ns-proxy-autoconfig;base64," +
+			base64.StdEncoding.EncodeToString([]byte(script))
+	}
+	return ""
+}
@@ -0,0 +1,54 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build freebsd || linux || netbsd || openbsd
+
+package main
+
+import (
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNMProxyPACURL(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		proxy    map[string]dbus.Variant
+		expected string
+	}{
+		{"NoProxySettings", nil, ""},
+		{"MethodNone", map[string]dbus.Variant{
+			"method":  dbus.MakeVariant(int32(0)),
+			"pac-url": dbus.MakeVariant("http://pac.test/proxy.pac"),
+		}, ""},
+		{"PACURL", map[string]dbus.Variant{
+			"method":  dbus.MakeVariant(int32(1)),
+			"pac-url": dbus.MakeVariant("http://pac.test/proxy.pac"),
+		}, "http://pac.test/proxy.pac"},
+		{"PACScript", map[string]dbus.Variant{
+			"method":     dbus.MakeVariant(int32(1)),
+			"pac-script": dbus.MakeVariant("function FindProxyForURL(u, h) {}"),
+		}, "data:application/x-ns-proxy-autoconfig;base64," +
+			"ZnVuY3Rpb24gRmluZFByb3h5Rm9yVVJMKHUsIGgpIHt9"},
+		{"AutoWithoutPAC", map[string]dbus.Variant{
+			"method": dbus.MakeVariant(int32(1)),
+		}, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, nmProxyPACURL(test.proxy))
+		})
+	}
+}
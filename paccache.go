@@ -0,0 +1,165 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// pacCacheDir is where the last good PAC script for each PAC URL is kept, so
+// that Alpaca can fall back to it when the PAC server can't be reached (e.g.
+// if Alpaca starts before the VPN is up). It's set by main; if it's empty,
+// nothing is kept.
+var pacCacheDir string
+
+// defaultPACCacheDir returns the directory that PAC scripts are cached in,
+// e.g. ~/.cache/alpaca/pac on Linux. It returns "" if the user's cache
+// directory can't be determined.
+func defaultPACCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "alpaca", "pac")
+}
+
+// cachedPAC is a PAC script that has been fetched and run successfully, as
+// it's kept on disk.
+type cachedPAC struct {
+	URL string `json:"url"`
+	// Fingerprint identifies the network that the script was fetched on
+	// (see networkFingerprint). The script is only used on the same one.
+	Fingerprint string    `json:"fingerprint"`
+	Fetched     time.Time `json:"fetched"`
+	ETag        string    `json:"etag,omitempty"`
+	Modified    string    `json:"modified,omitempty"`
+	PAC         string    `json:"pac"`
+}
+
+// pacCachePath returns the file that the PAC script from pacurl is cached in,
+// or "" if it isn't cached. Only scripts from HTTP(S) URLs are cached, since
+// a data URL or a local file is always available.
+func pacCachePath(pacurl string) string {
+	if pacCacheDir == "" ||
+		!strings.HasPrefix(pacurl, "http:") && !strings.HasPrefix(pacurl, "https:") {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(pacurl))
+	return filepath.Join(pacCacheDir, hex.EncodeToString(sum[:])+".json")
+}
+
+// loadCachedPAC returns the cached PAC script from pacurl, if there is one
+// that was fetched on the network with the given fingerprint.
+func loadCachedPAC(pacurl, fingerprint string) *cachedPAC {
+	path := pacCachePath(pacurl)
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		slog.Warn("Error reading cached PAC script", "path", path, "error", err)
+		return nil
+	}
+	var entry cachedPAC
+	if err := json.Unmarshal(data, &entry); err != nil {
+		slog.Warn("Error parsing cached PAC script", "path", path, "error", err)
+		return nil
+	}
+	if entry.URL != pacurl || entry.Fingerprint != fingerprint {
+		slog.Debug("Not using cached PAC script from another network", "url", pacurl)
+		return nil
+	}
+	return &entry
+}
+
+// storeCachedPAC writes entry to the cache, replacing the file atomically so
+// that a crash can't leave half a script behind.
+func storeCachedPAC(entry *cachedPAC) error {
+	path := pacCachePath(entry.URL)
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".pac-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) //nolint:errcheck
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// networkFingerprint identifies the network that Alpaca is on, from things
+// that stay the same for as long as it's on that network: the subnet of the
+// local address of each route that nm probed, the default gateways, and the
+// DNS search domains. The interface addresses themselves aren't used, since
+// IPv6 temporary addresses rotate, DHCP can hand out a different address
+// after a reboot, and bridges for containers and VMs come and go.
+func networkFingerprint(nm netMonitor) string {
+	addrs, routes := nm.lastSeen()
+	h := sha256.New()
+	write := func(s string) { _, _ = h.Write([]byte(s + "\n")) }
+	for _, remote := range slices.Sorted(maps.Keys(routes)) {
+		write("route " + remote + " " + subnetOf(routes[remote], addrs))
+	}
+	for _, gateway := range defaultGateways() {
+		write("gateway " + gateway)
+	}
+	domains, _ := searchDomains(resolvConfPath)
+	for _, domain := range domains {
+		write("search " + domain)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// subnetOf returns the subnet (e.g. 192.168.1.0/24) of the interface address
+// in addrs that's the same as ip, or ip itself if there isn't one (as with
+// some VPN clients). addrs are in CIDR form, as net.InterfaceAddrs returns
+// them.
+func subnetOf(ip string, addrs []string) string {
+	for _, addr := range addrs {
+		prefix, err := netip.ParsePrefix(addr)
+		if err == nil && prefix.Addr().String() == ip {
+			return prefix.Masked().String()
+		}
+	}
+	return ip
+}
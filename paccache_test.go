@@ -0,0 +1,199 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withPACCacheDir points the disk cache at a temporary directory for the
+// rest of the test.
+func withPACCacheDir(t *testing.T) {
+	old := pacCacheDir
+	pacCacheDir = t.TempDir()
+	t.Cleanup(func() { pacCacheDir = old })
+}
+
+func TestPACCache(t *testing.T) {
+	withPACCacheDir(t)
+	entry := &cachedPAC{
+		URL:         "http://pac.test/proxy.pac",
+		Fingerprint: "office",
+		Fetched:     time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		ETag:        `"1"`,
+		PAC:         "test script",
+	}
+	require.NoError(t, storeCachedPAC(entry))
+	assert.Equal(t, entry, loadCachedPAC("http://pac.test/proxy.pac", "office"))
+	assert.Nil(t, loadCachedPAC("http://pac.test/proxy.pac", "home"))
+	assert.Nil(t, loadCachedPAC("http://pac.test/other.pac", "office"))
+	// Overwriting an entry replaces it.
+	entry.PAC = "test script 2"
+	require.NoError(t, storeCachedPAC(entry))
+	assert.Equal(t, "test script 2", loadCachedPAC("http://pac.test/proxy.pac", "office").PAC)
+}
+
+func TestPACCachePath(t *testing.T) {
+	withPACCacheDir(t)
+	assert.NotEmpty(t, pacCachePath("http://pac.test/proxy.pac"))
+	assert.NotEmpty(t, pacCachePath("https://pac.test/proxy.pac"))
+	assert.NotEqual(t, pacCachePath("http://pac.test/proxy.pac"),
+		pacCachePath("https://pac.test/proxy.pac"))
+	assert.Empty(t, pacCachePath("data:,test"))
+	assert.Empty(t, pacCachePath("file:///etc/proxy.pac"))
+	pacCacheDir = ""
+	assert.Empty(t, pacCachePath("http://pac.test/proxy.pac"))
+}
+
+func TestNetworkFingerprint(t *testing.T) {
+	var network mockNet
+	nm := &netMonitorImpl{getAddrs: network.interfaceAddrs, dial: network.dial}
+	fingerprints := make(map[string]string)
+	for _, state := range []string{"offline", "wifi", "vpn"} {
+		network.state = state
+		nm.addrsChanged()
+		fingerprints[state] = networkFingerprint(nm)
+	}
+	assert.Len(t, fingerprints, 3)
+	assert.NotEqual(t, fingerprints["wifi"], fingerprints["vpn"])
+	assert.NotEqual(t, fingerprints["wifi"], fingerprints["offline"])
+	network.state = "wifi"
+	nm.addrsChanged()
+	assert.Equal(t, fingerprints["wifi"], networkFingerprint(nm))
+}
+
+// stableNet is a network where the route probes always go out from the
+// same interface, whose addresses can be changed.
+type stableNet struct {
+	addrs      []string
+	ipv4, ipv6 string // the addresses that routes go out from
+}
+
+func (n *stableNet) interfaceAddrs() ([]net.Addr, error) {
+	return toAddrs(n.addrs...), nil
+}
+
+func (n *stableNet) dial(network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	local := n.ipv4
+	if strings.Contains(host, ":") {
+		local = n.ipv6
+	}
+	return mockConn{&net.UDPAddr{IP: net.ParseIP(local), Port: 12345}}, nil
+}
+
+func TestNetworkFingerprintIsStable(t *testing.T) {
+	resolvConf := filepath.Join(t.TempDir(), "resolv.conf")
+	require.NoError(t, os.WriteFile(resolvConf, []byte("search corp.example.com\n"), 0600))
+	oldResolvConf := resolvConfPath
+	resolvConfPath = resolvConf
+	defer func() { resolvConfPath = oldResolvConf }()
+	network := &stableNet{
+		addrs: []string{"127.0.0.1/8", "192.168.1.2/24", "2001:db8:1:2::abcd/64",
+			"2001:db8:1:2::1/64"},
+		ipv4: "192.168.1.2",
+		ipv6: "2001:db8:1:2::abcd",
+	}
+	nm := &netMonitorImpl{getAddrs: network.interfaceAddrs, dial: network.dial}
+	fingerprint := func() string {
+		nm.addrsChanged()
+		return networkFingerprint(nm)
+	}
+	office := fingerprint()
+
+	// The temporary IPv6 address rotates, DHCP hands out another IPv4
+	// address, and a container bridge appears.
+	network.addrs = []string{"127.0.0.1/8", "192.168.1.7/24", "2001:db8:1:2::1234/64",
+		"2001:db8:1:2::1/64", "172.17.0.1/16"}
+	network.ipv4, network.ipv6 = "192.168.1.7", "2001:db8:1:2::1234"
+	assert.Equal(t, office, fingerprint())
+
+	// A different subnet is a different network...
+	network.addrs = []string{"127.0.0.1/8", "10.1.2.3/16"}
+	network.ipv4, network.ipv6 = "10.1.2.3", ""
+	home := fingerprint()
+	assert.NotEqual(t, office, home)
+	// ...and so are different search domains.
+	require.NoError(t, os.WriteFile(resolvConf, []byte("search home.example\n"), 0600))
+	assert.NotEqual(t, home, fingerprint())
+}
+
+func TestDownloadFallsBackToDiskCache(t *testing.T) {
+	withPACCacheDir(t)
+	s := &cachingPACServer{pacjs: "test script", etag: `"1"`}
+	var down atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		s.ServeHTTP(w, req)
+	}))
+	defer server.Close()
+	var network mockNet
+	network.state = "vpn"
+	restart := func() *pacFetcher {
+		pf := newPACFetcher(server.URL, false)
+		pf.monitor = &netMonitorImpl{getAddrs: network.interfaceAddrs, dial: network.dial}
+		return pf
+	}
+	pf := restart()
+	pacjs := pf.download()
+	require.Equal(t, []byte("test script"), pacjs)
+	pf.persist(pacjs)
+	fetched := pf.status().Fetched
+
+	// After a restart, the PAC server is down, but the network is the same,
+	// so the cached script is used.
+	down.Store(true)
+	pf = restart()
+	assert.Equal(t, []byte("test script"), pf.download())
+	st := pf.status()
+	assert.True(t, st.Connected)
+	assert.True(t, st.Stale)
+	assert.True(t, fetched.Equal(st.Fetched))
+	assert.WithinDuration(t, time.Now().Add(minPACRefresh), st.Expires, 10*time.Second)
+
+	// Once the server is back, the script is revalidated, and is no longer
+	// stale.
+	down.Store(false)
+	pf.expiry = time.Now().Add(-time.Second)
+	assert.Nil(t, pf.download())
+	assert.Equal(t, 1, s.conditional)
+	st = pf.status()
+	assert.True(t, st.Connected)
+	assert.False(t, st.Stale)
+
+	// On another network, the cached script isn't used.
+	down.Store(true)
+	network.state = "wifi"
+	pf = restart()
+	assert.Nil(t, pf.download())
+	assert.False(t, pf.isConnected())
+}
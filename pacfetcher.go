@@ -19,11 +19,13 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -39,23 +41,44 @@ const maxDataURLLength = 512 * 1024 * 1024
 // https://cs.chromium.org/chromium/src/net/proxy_resolution/proxy_resolution_service.cc?l=96&rcl=3db5f65968c3ecab3932c1ff7367ad28834f9502
 var delayAfterFailedDownload = 2 * time.Second
 
+// How often the PAC script is revalidated, even if the network hasn't changed. A server can ask
+// for a different interval with Cache-Control: max-age, within the bounds of minPACRefresh and
+// maxPACRefresh. If revalidation fails, it's retried after minPACRefresh.
+const (
+	defaultPACRefresh = 30 * time.Minute
+	minPACRefresh     = time.Minute
+	maxPACRefresh     = 24 * time.Hour
+)
+
 type pacFetcher struct {
 	pacFinder *pacFinder
 	monitor   netMonitor
 	client    *http.Client
+	// The last PAC script that was downloaded, and the validators that came with it. These are
+	// only used by download, which runs on one goroutine at a time.
+	cache    []byte
+	etag     string
+	modified string // the Last-Modified header, as sent by the server
+	// mu guards the fields below, which requests and the status endpoint read while a download
+	// is in progress.
+	mu        sync.Mutex
 	connected bool
-	//cache  []byte
-	//modified time.Time
-	//fetched time.Time
-	//expiry   time.Time
-	//etag     string
+	pacurl    string    // the most recently detected PAC URL
+	fetched   time.Time // when the PAC script was last fetched (or revalidated) successfully
+	expiry    time.Time // when the PAC script is due to be revalidated (zero for never)
+	// stale is set while the PAC script is one from the disk cache that hasn't been revalidated.
+	stale bool
 }
 
-func newPACFetcher(pacurl string) *pacFetcher {
+// newPACFetcher returns a pacFetcher for pacurl, or for the PAC URL in the system settings if
+// pacurl is empty. If wpad is set and there isn't one there either, it falls back to WPAD
+// discovery (see discoverWPAD). That's only done on Linux and other Unix-like systems; on macOS
+// and Windows, WPAD is part of the system proxy settings, and wpad is ignored.
+func newPACFetcher(pacurl string, wpad bool) *pacFetcher {
 	client := &http.Client{Timeout: 30 * time.Second}
 	if strings.HasPrefix(pacurl, "file:") {
-		log.Print("Warning: When using a local PAC file, the online/offline status can't ",
-			"be determined by the fact that the PAC file is downloaded. Make sure you ",
+		slog.Warn("When using a local PAC file, the online/offline status can't " +
+			"be determined by the fact that the PAC file is downloaded. Make sure you " +
 			"check for proxy connectivity in your PAC file!")
 		if runtime.GOOS == "windows" {
 			client.Transport = http.NewFileTransport(http.Dir("C:"))
@@ -70,7 +93,7 @@ func newPACFetcher(pacurl string) *pacFetcher {
 		client.Transport = &http.Transport{Proxy: nil}
 	}
 	return &pacFetcher{
-		pacFinder: newPacFinder(pacurl),
+		pacFinder: newPacFinder(pacurl, wpad),
 		monitor:   newNetMonitor(),
 		client:    client,
 	}
@@ -126,69 +149,260 @@ func decodeDataURL(uri string) ([]byte, error) {
 	return []byte(decoded), nil
 }
 
+// download checks for a new PAC script, and returns it, or nil if there isn't one. If the network
+// has changed, it detects the PAC URL again and downloads the script from scratch. Otherwise, it
+// revalidates the script once it has expired. It can take a while, so it's run in the background
+// (see ProxyFinder.refreshLoop) rather than while a request waits.
 func (pf *pacFetcher) download() []byte {
 	// TODO: Combine pacChanged() and findPACURL() as described in
 	// https://github.com/samuong/alpaca/pull/156#issuecomment-3125070335
-	if !pf.monitor.addrsChanged() && !pf.pacFinder.pacChanged() {
+	if pf.monitor.addrsChanged() || pf.pacFinder.pacChanged() {
+		return pf.redetect()
+	}
+	pf.mu.Lock()
+	pacurl, expiry := pf.pacurl, pf.expiry
+	pf.mu.Unlock()
+	if expiry.IsZero() || time.Now().Before(expiry) {
 		return nil
 	}
-	pf.connected = false
+	return pf.fetch(pacurl)
+}
 
+// redetect looks for the PAC URL after a network change, and downloads the PAC script from it.
+func (pf *pacFetcher) redetect() []byte {
 	// We've just detected a change in network state, so close any "idle"
 	// connections from the previous network. This forces a fresh DNS
 	// lookup and TCP dial during the next PAC download. For context, see
 	// <https://github.com/samuong/alpaca/issues/165>.
 	pf.client.CloseIdleConnections()
+	// The cached script came from the previous network, so it can't be revalidated.
+	pf.cache, pf.etag, pf.modified = nil, "", ""
 
 	pacurl, err := pf.pacFinder.findPACURL()
-	if err != nil {
-		log.Printf("Error while trying to detect PAC URL: %v", err)
-		return nil
-	} else if pacurl == "" {
-		log.Println("No PAC URL specified or detected; all requests will be made directly")
+	if err != nil || pacurl == "" {
+		if err != nil {
+			slog.Error("Error while trying to detect PAC URL", "error", err)
+		} else {
+			slog.Info("No PAC URL specified or detected; all requests will be made directly")
+		}
+		pf.mu.Lock()
+		pf.pacurl, pf.connected, pf.stale, pf.expiry = pacurl, false, false, time.Time{}
+		pf.mu.Unlock()
 		return nil
 	}
+	pf.mu.Lock()
+	pf.pacurl = pacurl
+	pf.mu.Unlock()
+	return pf.fetch(pacurl)
+}
 
-	log.Printf("Attempting to download PAC from %s", pacurl)
+// fetch downloads the PAC script from pacurl, and returns it, or nil if it couldn't be downloaded
+// or hasn't changed since the last download. If there's a cached script, the request is
+// conditional on it having changed, and a failure leaves the cached script in use.
+func (pf *pacFetcher) fetch(pacurl string) []byte {
+	revalidating := pf.cache != nil
+	if revalidating {
+		slog.Debug("Revalidating PAC", "url", pacurl)
+	} else {
+		slog.Info("Attempting to download PAC", "url", pacurl)
+	}
 
 	pac, err := decodeDataURL(pacurl)
 	if err != nil {
-		log.Printf("Error downloading PAC file: %v", err)
-		return nil
+		slog.Error("Error downloading PAC file", "url", pacurl, "error", err)
+		return pf.failed(pacurl)
 	}
 
 	if pac != nil {
-		pf.connected = true
+		// A data URL can't change, so there's nothing to revalidate.
+		pacFetchesTotal.WithLabelValues("success").Inc()
+		pf.succeeded(pac, time.Time{})
 		return pac
 	}
 
-	resp, err := requireOK(pf.client.Get(pacurl))
+	resp, err := pf.get(pacurl)
 	if err != nil {
 		// Sometimes, if we try to download too soon after a network change, the PAC
 		// download can fail. See https://github.com/samuong/alpaca/issues/8 for details.
-		log.Printf("Error downloading PAC file, will retry after %v: %q",
-			delayAfterFailedDownload, err)
+		slog.Warn("Error downloading PAC file, will retry",
+			"url", pacurl, "delay", delayAfterFailedDownload, "error", err)
 		time.Sleep(delayAfterFailedDownload)
-		if resp, err = requireOK(pf.client.Get(pacurl)); err != nil {
-			log.Printf("Error downloading PAC file, giving up: %q", err)
-			return nil
+		if resp, err = pf.get(pacurl); err != nil {
+			slog.Error("Error downloading PAC file, giving up", "url", pacurl, "error", err)
+			pacFetchesTotal.WithLabelValues("failure").Inc()
+			return pf.failed(pacurl)
 		}
 	}
 	defer resp.Body.Close() //nolint:errcheck
+	expiry := time.Now().Add(pacLifetime(resp.Header))
+	if resp.StatusCode == http.StatusNotModified {
+		slog.Debug("PAC file hasn't changed", "url", pacurl, "expiry", expiry)
+		pacFetchesTotal.WithLabelValues("not_modified").Inc()
+		if etag := resp.Header.Get("ETag"); etag != "" {
+			pf.etag = etag
+		}
+		pf.succeeded(pf.cache, expiry)
+		return nil
+	}
 	var buf bytes.Buffer
 	_, err = io.CopyN(&buf, resp.Body, maxResponseBytes)
 	if err == io.EOF {
-		pf.connected = true
+		pacFetchesTotal.WithLabelValues("success").Inc()
+		pf.etag = resp.Header.Get("ETag")
+		pf.modified = resp.Header.Get("Last-Modified")
+		unchanged := revalidating && bytes.Equal(buf.Bytes(), pf.cache)
+		pf.succeeded(buf.Bytes(), expiry)
+		if unchanged {
+			return nil
+		}
 		return buf.Bytes()
-	} else if err != nil {
-		log.Printf("Error reading PAC JS from response body: %q", err)
-		return nil
+	}
+	pacFetchesTotal.WithLabelValues("failure").Inc()
+	if err != nil {
+		slog.Error("Error reading PAC JS from response body", "url", pacurl, "error", err)
 	} else {
-		log.Printf("PAC JS is too big (limit is %d bytes)", maxResponseBytes)
+		slog.Error("PAC JS is too big", "url", pacurl, "limit", maxResponseBytes)
+	}
+	return pf.failed(pacurl)
+}
+
+// get sends a GET request for pacurl, which is conditional on the PAC script having changed if
+// there's a cached copy.
+func (pf *pacFetcher) get(pacurl string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, pacurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if pf.cache != nil {
+		if pf.etag != "" {
+			req.Header.Set("If-None-Match", pf.etag)
+		}
+		if pf.modified != "" {
+			req.Header.Set("If-Modified-Since", pf.modified)
+		}
+	}
+	resp, err := pf.client.Do(req)
+	if err == nil && resp.StatusCode == http.StatusNotModified && pf.cache != nil {
+		return resp, nil
+	}
+	return requireOK(resp, err)
+}
+
+// succeeded records a successful download (or revalidation) of pac, which is due to be
+// revalidated at expiry.
+func (pf *pacFetcher) succeeded(pac []byte, expiry time.Time) {
+	pf.cache = pac
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if pf.stale {
+		slog.Info("PAC script is up to date again", "url", pf.pacurl)
+	}
+	pf.connected = true
+	pf.stale = false
+	pf.fetched = time.Now()
+	pf.expiry = expiry
+}
+
+// failed records a failed download of the PAC script from pacurl, and returns the script to use
+// instead, if there's a new one. If it was a revalidation, the cached script stays in use, and the
+// download is retried later. Otherwise, it falls back to the copy in the disk cache, if one was
+// fetched on the same network. Failing that, there's no PAC script to use until the network
+// changes.
+func (pf *pacFetcher) failed(pacurl string) []byte {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if pf.cache != nil {
+		slog.Warn("Carrying on with the cached PAC script", "url", pacurl,
+			"stale", pf.stale, "retry", minPACRefresh)
+		pf.expiry = time.Now().Add(minPACRefresh)
 		return nil
 	}
+	if entry := loadCachedPAC(pacurl, networkFingerprint(pf.monitor)); entry != nil {
+		slog.Warn("Using a stale copy of the PAC script from the disk cache until the PAC "+
+			"server can be reached", "url", pacurl, "fetched", entry.Fetched,
+			"retry", minPACRefresh)
+		pf.cache = []byte(entry.PAC)
+		pf.etag, pf.modified = entry.ETag, entry.Modified
+		pf.connected = true
+		pf.stale = true
+		pf.fetched = entry.Fetched
+		pf.expiry = time.Now().Add(minPACRefresh)
+		return pf.cache
+	}
+	pf.connected = false
+	pf.stale = false
+	pf.expiry = time.Time{}
+	return nil
+}
+
+// persist writes pac to the disk cache, once it has run successfully. A stale script is already
+// there, so it's left alone.
+func (pf *pacFetcher) persist(pac []byte) {
+	pf.mu.Lock()
+	entry := &cachedPAC{
+		URL:         pf.pacurl,
+		Fingerprint: networkFingerprint(pf.monitor),
+		Fetched:     pf.fetched,
+		ETag:        pf.etag,
+		Modified:    pf.modified,
+		PAC:         string(pac),
+	}
+	stale := pf.stale
+	pf.mu.Unlock()
+	if stale {
+		return
+	}
+	if err := storeCachedPAC(entry); err != nil {
+		slog.Warn("Error caching PAC script", "url", entry.URL, "error", err)
+	}
+}
+
+// pacLifetime returns how long a PAC script can be used for before it's revalidated, based on the
+// Cache-Control header of the response that it came in.
+func pacLifetime(header http.Header) time.Duration {
+	cacheControl := strings.Join(header.Values("Cache-Control"), ",")
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-cache", "no-store":
+			return minPACRefresh
+		case "max-age":
+			seconds, err := strconv.ParseUint(strings.Trim(value, `"`), 10, 64)
+			if err != nil {
+				continue
+			} else if seconds >= uint64(maxPACRefresh/time.Second) {
+				return maxPACRefresh
+			} else if lifetime := time.Duration(seconds) * time.Second; lifetime > minPACRefresh {
+				return lifetime
+			}
+			return minPACRefresh
+		}
+	}
+	return defaultPACRefresh
 }
 
 func (pf *pacFetcher) isConnected() bool {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
 	return pf.connected
 }
+
+// expiresAt returns when the PAC script is due to be revalidated, or the zero time if it never
+// is.
+func (pf *pacFetcher) expiresAt() time.Time {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	return pf.expiry
+}
+
+func (pf *pacFetcher) status() pacStatus {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	return pacStatus{
+		URL:       pf.pacurl,
+		Fetched:   pf.fetched,
+		Expires:   pf.expiry,
+		Connected: pf.connected,
+		Stale:     pf.stale,
+	}
+}
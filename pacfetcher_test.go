@@ -22,7 +22,9 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -62,10 +64,14 @@ func (nm *fakeNetMonitor) addrsChanged() bool {
 	return tmp
 }
 
+func (nm *fakeNetMonitor) lastSeen() ([]string, map[string]string) {
+	return nil, nil
+}
+
 func TestDownload(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(pacjsHandler("test script")))
 	defer server.Close()
-	pf := newPACFetcher(server.URL)
+	pf := newPACFetcher(server.URL, false)
 	assert.Equal(t, []byte("test script"), pf.download())
 	assert.True(t, pf.isConnected())
 }
@@ -74,7 +80,7 @@ func TestDownloadFailsOnFirstTry(t *testing.T) {
 	s := &pacServerWhichFailsOnFirstTry{t: t, count: 0}
 	server := httptest.NewServer(s)
 	defer server.Close()
-	pf := newPACFetcher(server.URL)
+	pf := newPACFetcher(server.URL, false)
 	require.Equal(t, 0, s.count)
 	assert.Equal(t, []byte("test script"), pf.download())
 	require.Equal(t, 2, s.count)
@@ -85,7 +91,7 @@ func TestDownloadWithNetworkChanges(t *testing.T) {
 	// Initially, the download succeeds and we are connected (to the PAC server).
 	s1 := httptest.NewServer(http.HandlerFunc(pacjsHandler("test script 1")))
 	nm := &fakeNetMonitor{true}
-	pf := newPACFetcher(s1.URL)
+	pf := newPACFetcher(s1.URL, false)
 	pf.monitor = nm
 	assert.Equal(t, []byte("test script 1"), pf.download())
 	assert.True(t, pf.isConnected())
@@ -101,7 +107,7 @@ func TestDownloadWithNetworkChanges(t *testing.T) {
 	s2 := httptest.NewServer(http.HandlerFunc(pacjsHandler("test script 2")))
 	defer s2.Close()
 	nm.changed = true
-	pf.pacFinder = newPacFinder(s2.URL)
+	pf.pacFinder = newPacFinder(s2.URL, false)
 	assert.Equal(t, []byte("test script 2"), pf.download())
 	assert.True(t, pf.isConnected())
 }
@@ -110,7 +116,7 @@ func TestResponseLimit(t *testing.T) {
 	bigscript := strings.Repeat("x", 2*1024*1024) // 2 MB
 	server := httptest.NewServer(http.HandlerFunc(pacjsHandler(bigscript)))
 	defer server.Close()
-	pf := newPACFetcher(server.URL)
+	pf := newPACFetcher(server.URL, false)
 	assert.Nil(t, pf.download())
 	assert.False(t, pf.isConnected())
 }
@@ -124,7 +130,7 @@ func TestPacFromFilesystem(t *testing.T) {
 	pacPath := path.Join(tempdir, "test.pac")
 	require.NoError(t, os.WriteFile(pacPath, content, 0644))
 	pacURL := &url.URL{Scheme: "file", Path: filepath.ToSlash(pacPath)}
-	pf := newPACFetcher(pacURL.String())
+	pf := newPACFetcher(pacURL.String(), false)
 	pf.monitor = newNetMonitor()
 	assert.Equal(t, content, pf.download())
 	assert.True(t, pf.isConnected())
@@ -157,7 +163,7 @@ func TestDecodeDataURL(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			pf := newPACFetcher(test.uri)
+			pf := newPACFetcher(test.uri, false)
 			assert.Equal(t, test.expected, string(pf.download()))
 		})
 	}
@@ -169,3 +175,107 @@ func TestDecodeDataURL_NonDataScheme(t *testing.T) {
 	assert.Nil(t, got)
 	assert.NoError(t, err)
 }
+
+// cachingPACServer serves a PAC script with an ETag, and answers conditional
+// requests for it with 304 Not Modified.
+type cachingPACServer struct {
+	mu           sync.Mutex
+	pacjs        string
+	etag         string
+	cacheControl string
+	conditional  int // the number of conditional requests
+}
+
+func (s *cachingPACServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cacheControl != "" {
+		w.Header().Set("Cache-Control", s.cacheControl)
+	}
+	w.Header().Set("ETag", s.etag)
+	if match := req.Header.Get("If-None-Match"); match != "" {
+		s.conditional++
+		if match == s.etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	_, _ = w.Write([]byte(s.pacjs))
+}
+
+func (s *cachingPACServer) set(pacjs, etag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pacjs, s.etag = pacjs, etag
+}
+
+func TestDownloadRevalidates(t *testing.T) {
+	s := &cachingPACServer{pacjs: "test script 1", etag: `"1"`, cacheControl: "max-age=300"}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	pf := newPACFetcher(server.URL, false)
+	pf.monitor = &fakeNetMonitor{true}
+	assert.Equal(t, []byte("test script 1"), pf.download())
+	assert.WithinDuration(t, time.Now().Add(5*time.Minute), pf.expiresAt(), time.Minute)
+	// The script hasn't expired yet, so it isn't checked.
+	assert.Nil(t, pf.download())
+	assert.Equal(t, 0, s.conditional)
+	// Once it has expired, it's revalidated, but it hasn't changed.
+	pf.expiry = time.Now().Add(-time.Second)
+	assert.Nil(t, pf.download())
+	assert.Equal(t, 1, s.conditional)
+	assert.True(t, pf.isConnected())
+	assert.True(t, pf.expiresAt().After(time.Now()))
+	// Now it has.
+	s.set("test script 2", `"2"`)
+	pf.expiry = time.Now().Add(-time.Second)
+	assert.Equal(t, []byte("test script 2"), pf.download())
+	assert.Equal(t, 2, s.conditional)
+	// If the server goes away, the cached script stays in use.
+	server.Close()
+	pf.expiry = time.Now().Add(-time.Second)
+	assert.Nil(t, pf.download())
+	assert.True(t, pf.isConnected())
+	assert.WithinDuration(t, time.Now().Add(minPACRefresh), pf.expiresAt(), 10*time.Second)
+}
+
+func TestDownloadAfterNetworkChangeIsUnconditional(t *testing.T) {
+	s := &cachingPACServer{pacjs: "test script", etag: `"1"`}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	nm := &fakeNetMonitor{true}
+	pf := newPACFetcher(server.URL, false)
+	pf.monitor = nm
+	assert.Equal(t, []byte("test script"), pf.download())
+	assert.WithinDuration(t, time.Now().Add(defaultPACRefresh), pf.expiresAt(), time.Minute)
+	nm.changed = true
+	assert.Equal(t, []byte("test script"), pf.download())
+	assert.Equal(t, 0, s.conditional)
+}
+
+func TestPACLifetime(t *testing.T) {
+	for _, test := range []struct {
+		cacheControl []string
+		expected     time.Duration
+	}{
+		{nil, defaultPACRefresh},
+		{[]string{"public"}, defaultPACRefresh},
+		{[]string{"max-age=600"}, 10 * time.Minute},
+		{[]string{"public, max-age=600"}, 10 * time.Minute},
+		{[]string{"public", "Max-Age=600"}, 10 * time.Minute},
+		{[]string{`max-age="600"`}, 10 * time.Minute},
+		{[]string{"max-age=0"}, minPACRefresh},
+		{[]string{"max-age=31536000"}, maxPACRefresh},
+		{[]string{"max-age=99999999999999999999"}, defaultPACRefresh},
+		{[]string{"max-age=-1"}, defaultPACRefresh},
+		{[]string{"no-cache"}, minPACRefresh},
+	} {
+		t.Run(strings.Join(test.cacheControl, ";"), func(t *testing.T) {
+			header := make(http.Header)
+			for _, value := range test.cacheControl {
+				header.Add("Cache-Control", value)
+			}
+			assert.Equal(t, test.expected, pacLifetime(header))
+		})
+	}
+}
@@ -26,7 +26,7 @@ typedef const CFStringRef CFStringRef_Const;
 */
 import "C"
 import (
-	"log"
+	"log/slog"
 	"unsafe"
 )
 
@@ -35,13 +35,13 @@ type pacFinder struct {
 	storeRef C.SCDynamicStoreRef
 }
 
-func newPacFinder(pacUrl string) *pacFinder {
+func newPacFinder(pacUrl string, _ bool) *pacFinder {
 	if pacUrl != "" {
 		return &pacFinder{pacUrl, 0}
 	}
 	storeRef := C.SCDynamicStoreCreate_trampoline()
 	if storeRef == 0 {
-		log.Print("Unable to access system network information")
+		slog.Error("Unable to access system network information")
 		return &pacFinder{"", 0}
 	}
 	return &pacFinder{"", storeRef}
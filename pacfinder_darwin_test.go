@@ -24,7 +24,7 @@ import (
 
 func TestFindPACURLStatic(t *testing.T) {
 	pac := "http://internal.example.com/proxy.pac"
-	finder := newPacFinder(pac)
+	finder := newPacFinder(pac, false)
 
 	foundPac, _ := finder.findPACURL()
 	require.Equal(t, pac, foundPac)
@@ -40,7 +40,7 @@ func TestFallbackToDefaultWhenNoPACUrl(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	finder := newPacFinder("")
+	finder := newPacFinder("", false)
 
 	// act
 	foundPac, _ := finder.findPACURL()
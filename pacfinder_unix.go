@@ -18,26 +18,97 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
+// pacSettingsInterval is how often pacChanged looks at the system settings.
+// Looking runs gsettings, reads kioslaverc and makes several D-Bus calls, and
+// pacChanged is called for every request (via ProxyFinder.checkForUpdates), so
+// it's only done this often. A network change is picked up straight away
+// regardless, since findPACURL is called after one.
+const pacSettingsInterval = 30 * time.Second
+
 type pacFinder struct {
-	pacUrl string
-	auto   bool
+	pacUrl  string
+	auto    bool
+	wpad    bool
+	checked time.Time // when pacChanged last looked at the system settings
+}
+
+func newPacFinder(pacUrl string, wpad bool) *pacFinder {
+	return &pacFinder{pacUrl: pacUrl, auto: pacUrl == "", wpad: wpad}
 }
 
-func newPacFinder(pacUrl string) *pacFinder {
-	return &pacFinder{pacUrl, pacUrl == ""}
+// pacSource is somewhere that a PAC URL can be configured.
+type pacSource struct {
+	name string
+	find func() (string, error)
+}
+
+// pacSources are the places that findPACURL looks for a PAC URL, in order. The
+// first one that has a PAC URL wins.
+var pacSources = []pacSource{
+	{"environment", envPACURL},
+	{"GNOME", gsettingsPACURL},
+	{"KDE", kdePACURL},
+	{"NetworkManager", networkManagerPACURL},
 }
 
 func (finder *pacFinder) findPACURL() (string, error) {
 	if !finder.auto {
 		return finder.pacUrl, nil
 	}
+	url, source, err := systemPACURL()
+	if url != "" {
+		slog.Info("Found PAC URL in system settings", "url", url, "source", source)
+		return url, nil
+	} else if !finder.wpad {
+		return "", err
+	}
+	if err != nil {
+		slog.Debug("Couldn't get PAC URL from system settings; trying WPAD", "error", err)
+	}
+	return discoverWPAD()
+}
 
+// systemPACURL returns the first PAC URL from pacSources, and the name of the
+// source that it came from. If none of them has one, it returns the errors
+// from the sources that couldn't be checked.
+func systemPACURL() (url, source string, err error) {
+	var errs []error
+	for _, source := range pacSources {
+		url, err := source.find()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", source.name, err))
+		} else if url != "" {
+			return url, source.name, nil
+		}
+	}
+	return "", "", errors.Join(errs...)
+}
+
+// envPACURL returns the PAC URL from the auto_proxy environment variable,
+// which some browsers and libproxy understand, for desktops that don't have
+// proxy settings of their own (e.g. tiling window managers).
+func envPACURL() (string, error) {
+	if url := os.Getenv("auto_proxy"); url != "" {
+		return url, nil
+	}
+	return os.Getenv("AUTO_PROXY"), nil
+}
+
+func gsettingsPACURL() (string, error) {
 	// Hopefully Linux, FreeBSD, Solaris, etc. will have GNOME 3 installed...
-	// TODO: Figure out how to do this for KDE.
 	cmd := exec.Command("gsettings", "get", "org.gnome.system.proxy", "autoconfig-url")
 	out, err := cmd.Output()
 	if err != nil {
@@ -46,8 +117,75 @@ func (finder *pacFinder) findPACURL() (string, error) {
 	return strings.Trim(string(out), "'\n"), nil
 }
 
+// kdePACURL returns the PAC URL from KDE's proxy settings, in kioslaverc, if
+// they're set to use one.
+func kdePACURL() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", nil
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "kioslaverc"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return parseKioslaverc(data), nil
+}
+
+// parseKioslaverc returns the "Proxy Config Script" from the [Proxy Settings]
+// group of a kioslaverc file, if ProxyType is 2 (which is "Use proxy
+// auto configuration URL" in System Settings). A local path is turned into a
+// file: URL.
+func parseKioslaverc(data []byte) string {
+	var group, proxyType, script string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			group = line[1 : len(line)-1]
+			continue
+		} else if group != "Proxy Settings" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		// Keys can have flags, like "[$e]" for values that contain
+		// environment variables.
+		if name, flags, ok := strings.Cut(key, "["); ok {
+			key = strings.TrimSpace(name)
+			if strings.Contains(flags, "$e") {
+				value = os.ExpandEnv(value)
+			}
+		}
+		switch key {
+		case "ProxyType":
+			proxyType = value
+		case "Proxy Config Script":
+			script = value
+		}
+	}
+	if proxyType != "2" {
+		return ""
+	} else if strings.HasPrefix(script, "/") {
+		return "file://" + script
+	}
+	return script
+}
+
+// pacChanged reports whether the PAC URL in the system settings has changed.
+// It only looks once every pacSettingsInterval, and reports no change in
+// between. WPAD isn't checked here, since it's only worth doing after a
+// network change (when findPACURL is called anyway).
 func (finder *pacFinder) pacChanged() bool {
-	if url, _ := finder.findPACURL(); finder.pacUrl != url {
+	if !finder.auto || time.Since(finder.checked) < pacSettingsInterval {
+		return false
+	}
+	finder.checked = time.Now()
+	if url, _, _ := systemPACURL(); finder.pacUrl != url {
 		finder.pacUrl = url
 		return true
 	}
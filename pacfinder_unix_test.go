@@ -20,13 +20,33 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+// isolatePACSources stops findPACURL from seeing the settings of the user
+// who's running the tests: the environment variable, KDE's config file, and
+// NetworkManager.
+func isolatePACSources(t *testing.T) {
+	t.Setenv("auto_proxy", "")
+	t.Setenv("AUTO_PROXY", "")
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	old := pacSources
+	pacSources = slices.Clone(old)
+	for i, source := range pacSources {
+		if source.name == "NetworkManager" {
+			pacSources[i].find = func() (string, error) { return "", nil }
+		}
+	}
+	t.Cleanup(func() { pacSources = old })
+}
+
 func TestFindPACURL(t *testing.T) {
+	isolatePACSources(t)
 	dir, err := os.MkdirTemp("", "alpaca")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir) //nolint:errcheck
@@ -38,20 +58,112 @@ func TestFindPACURL(t *testing.T) {
 	mockcmd := "#!/bin/sh\necho \\'http://internal.example.com/proxy.pac\\'\n"
 	require.NoError(t, os.WriteFile(tmpfn, []byte(mockcmd), 0700))
 
-	pf := newPacFinder("")
+	pf := newPacFinder("", false)
 	pacURL, err := pf.findPACURL()
 	require.NoError(t, err)
 	assert.Equal(t, "http://internal.example.com/proxy.pac", pacURL)
 }
 
 func TestFindPACURLWhenGsettingsIsntAvailable(t *testing.T) {
+	isolatePACSources(t)
 	dir, err := os.MkdirTemp("", "alpaca")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir) //nolint:errcheck
 	oldpath := os.Getenv("PATH")
 	defer require.NoError(t, os.Setenv("PATH", oldpath))
 	require.NoError(t, os.Setenv("PATH", dir))
-	pf := newPacFinder("")
+	pf := newPacFinder("", false)
 	_, err = pf.findPACURL()
 	require.NotNil(t, err)
 }
+
+func TestFindPACURLFallsBackToWPAD(t *testing.T) {
+	isolatePACSources(t)
+	oldGlobs, oldResolvConf := wpadLeaseGlobs, resolvConfPath
+	defer func() { wpadLeaseGlobs, resolvConfPath = oldGlobs, oldResolvConf }()
+	dir := t.TempDir()
+	t.Setenv("PATH", dir) // no gsettings
+	wpadLeaseGlobs = []string{filepath.Join(dir, "*.leases")}
+	resolvConfPath = filepath.Join(dir, "resolv.conf")
+	require.NoError(t, os.WriteFile(resolvConfPath, nil, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "dhclient.leases"),
+		[]byte("lease {\n  option wpad \"http://wpad.test/wpad.dat\";\n}\n"), 0600))
+
+	pf := newPacFinder("", false)
+	pacURL, err := pf.findPACURL()
+	require.NotNil(t, err, "WPAD is off by default")
+	assert.Empty(t, pacURL)
+	pf.wpad = true
+	pacURL, err = pf.findPACURL()
+	require.NoError(t, err)
+	assert.Equal(t, "http://wpad.test/wpad.dat", pacURL)
+	// Discovery doesn't count as a change in the system settings.
+	assert.False(t, pf.pacChanged())
+}
+
+func TestFindPACURLFromOtherSources(t *testing.T) {
+	isolatePACSources(t)
+	t.Setenv("PATH", t.TempDir()) // no gsettings
+	kioslaverc := "[Proxy Settings]\nProxyType=2\n" +
+		"Proxy Config Script=http://kde.example.com/proxy.pac\n"
+	require.NoError(t, os.WriteFile(filepath.Join(os.Getenv("XDG_CONFIG_HOME"), "kioslaverc"),
+		[]byte(kioslaverc), 0600))
+
+	pf := newPacFinder("", false)
+	pacURL, err := pf.findPACURL()
+	require.NoError(t, err, "a missing gsettings doesn't matter if KDE has a PAC URL")
+	assert.Equal(t, "http://kde.example.com/proxy.pac", pacURL)
+	assert.True(t, pf.pacChanged())
+	pf.checked = time.Time{}
+	assert.False(t, pf.pacChanged())
+
+	// The environment variable takes precedence, and a change to it is
+	// picked up by pacChanged.
+	t.Setenv("auto_proxy", "http://env.example.com/proxy.pac")
+	pf.checked = time.Time{}
+	assert.True(t, pf.pacChanged())
+	pacURL, err = pf.findPACURL()
+	require.NoError(t, err)
+	assert.Equal(t, "http://env.example.com/proxy.pac", pacURL)
+}
+
+func TestPACChangedIsThrottled(t *testing.T) {
+	isolatePACSources(t)
+	t.Setenv("PATH", t.TempDir()) // no gsettings
+	t.Setenv("auto_proxy", "http://one.example.com/proxy.pac")
+	pf := newPacFinder("", false)
+	assert.True(t, pf.pacChanged())
+
+	// A change to the settings isn't seen until pacSettingsInterval has
+	// passed since the last look.
+	t.Setenv("auto_proxy", "http://two.example.com/proxy.pac")
+	assert.False(t, pf.pacChanged())
+	pf.checked = time.Now().Add(-pacSettingsInterval)
+	assert.True(t, pf.pacChanged())
+	assert.Equal(t, "http://two.example.com/proxy.pac", pf.pacUrl)
+	assert.False(t, pf.pacChanged())
+}
+
+func TestParseKioslaverc(t *testing.T) {
+	t.Setenv("PAC_DIR", "/etc/proxy")
+	for _, test := range []struct {
+		name     string
+		settings string
+		expected string
+	}{
+		{"ConfigScript", "ProxyType=2\nProxy Config Script=http://pac.test/proxy.pac",
+			"http://pac.test/proxy.pac"},
+		{"ManualProxy", "ProxyType=1\nProxy Config Script=http://pac.test/proxy.pac", ""},
+		{"NoProxyType", "Proxy Config Script=http://pac.test/proxy.pac", ""},
+		{"LocalFile", "ProxyType=2\nProxy Config Script=/etc/proxy/proxy.pac",
+			"file:///etc/proxy/proxy.pac"},
+		{"EnvironmentVariable", "ProxyType=2\nProxy Config Script[$e]=$PAC_DIR/proxy.pac",
+			"file:///etc/proxy/proxy.pac"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			data := "[General]\nProxy Config Script=http://other.test/\n\n" +
+				"[Proxy Settings]\n" + test.settings + "\n"
+			assert.Equal(t, test.expected, parseKioslaverc([]byte(data)))
+		})
+	}
+}
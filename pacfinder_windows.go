@@ -18,7 +18,7 @@ type pacFinder struct {
 	pacURL string
 }
 
-func newPacFinder(pacURL string) *pacFinder {
+func newPacFinder(pacURL string, _ bool) *pacFinder {
 	return &pacFinder{pacURL: pacURL}
 }
 
@@ -16,8 +16,9 @@ package main
 
 import (
 	"bytes"
-	"log"
+	"log/slog"
 	"net/http"
+	"sync"
 	"text/template"
 )
 
@@ -32,8 +33,11 @@ type pacData struct {
 }
 
 type PACWrapper struct {
-	data      pacData
-	tmpl      *template.Template
+	data pacData
+	tmpl *template.Template
+	// mu guards alpacaPAC, which is replaced in the background whenever the upstream PAC
+	// changes.
+	mu        sync.Mutex
 	alpacaPAC string
 }
 
@@ -54,18 +58,20 @@ function FindProxyForURL(url, host) {
 
 func NewPACWrapper(data PACData) *PACWrapper {
 	t := template.Must(template.New("alpaca").Parse(pacWrapTmpl))
-	return &PACWrapper{pacData{data, ""}, t, ""}
+	return &PACWrapper{data: pacData{data, ""}, tmpl: t}
 }
 
 func (pw *PACWrapper) Wrap(pacjs []byte) {
 	pac := string(pacjs)
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
 	if pac == pw.data.UpstreamPAC && pw.alpacaPAC != "" {
 		return
 	}
 	pw.data.UpstreamPAC = pac
 	b := &bytes.Buffer{}
 	if err := pw.tmpl.Execute(b, pw.data); err != nil {
-		log.Printf("error executing PAC wrap template: %v", err)
+		slog.Error("Error executing PAC wrap template", "error", err)
 		return
 	}
 	pw.alpacaPAC = b.String()
@@ -80,8 +86,11 @@ func (pw *PACWrapper) handlePAC(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	pw.mu.Lock()
+	pac := pw.alpacaPAC
+	pw.mu.Unlock()
 	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
-	if _, err := w.Write([]byte(pw.alpacaPAC)); err != nil {
-		log.Printf("Error writing PAC to response: %v", err)
+	if _, err := w.Write([]byte(pac)); err != nil {
+		slog.ErrorContext(req.Context(), "Error writing PAC to response", "error", err)
 	}
 }
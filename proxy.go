@@ -15,17 +15,18 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/net/proxy"
 )
@@ -99,9 +100,9 @@ type proxyAuthenticator interface {
 // authenticator's scheme() method are matched case-insensitively against
 // these constants and against the schemes advertised by the proxy.
 const (
-	schemeBasic     = "basic"     //nolint:unused // used by tests and intent docs
-	schemeNTLM      = "ntlm"      //nolint:unused // used by tests and intent docs
-	schemeNegotiate = "negotiate" //nolint:unused // used by tests and intent docs
+	schemeBasic     = "basic"
+	schemeNTLM      = "ntlm"
+	schemeNegotiate = "negotiate"
 )
 
 // isToken reports whether s satisfies the RFC 7230 §3.2.6 "token"
@@ -223,14 +224,19 @@ func splitChallengeNames(value string) []string {
 type ProxyHandler struct {
 	transport *http.Transport
 	auth      *authChain
-	block     func(string)
+	block     func(*url.URL)
+	h2        *h2Pool // HTTP/2 connections for CONNECT requests, if enabled
 }
 
 type proxyFunc func(*http.Request) (*url.URL, error)
 
-func NewProxyHandler(auth *authChain, proxy proxyFunc, block func(string)) ProxyHandler {
-	tr := &http.Transport{Proxy: proxy, TLSClientConfig: tlsClientConfig}
-	return ProxyHandler{tr, auth, block}
+func NewProxyHandler(auth *authChain, proxy proxyFunc, block func(*url.URL)) ProxyHandler {
+	tr := &http.Transport{
+		Proxy:           proxy,
+		DialContext:     netDialer.DialContext,
+		TLSClientConfig: tlsClientConfig,
+	}
+	return ProxyHandler{tr, auth, block, nil}
 }
 
 func (ph ProxyHandler) WrapHandler(next http.Handler) http.Handler {
@@ -251,33 +257,36 @@ func (ph ProxyHandler) WrapHandler(next http.Handler) http.Handler {
 }
 
 func (ph ProxyHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	upgrade := upgradeType(req.Header)
 	deleteRequestHeaders(req)
 	if req.Method == http.MethodConnect {
 		ph.handleConnect(w, req)
 	} else {
+		// Upgrade and Connection are hop-by-hop headers, but a request
+		// to switch protocols (e.g. to a WebSocket) has to be passed on
+		// for the switch to happen at all.
+		if upgrade != "" {
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", upgrade)
+		}
 		ph.proxyRequest(w, req, ph.auth)
 	}
 }
 
 func (ph ProxyHandler) handleConnect(w http.ResponseWriter, req *http.Request) {
 	// Establish a connection to the server, or an upstream proxy.
-	id := req.Context().Value(contextKeyID)
-	proxyURL, err := ph.transport.Proxy(req)
-	if err != nil {
-		log.Printf("[%d] Error finding proxy for request: %v", id, err)
-	}
-	var server net.Conn
-	if proxyURL == nil {
-		server, err = connectDirect(req)
-	} else {
-		server, err = connectViaProxy(req, proxyURL, ph.auth)
-		var oe *net.OpError
-		if errors.As(err, &oe) && oe.Op == "proxyconnect" {
-			log.Printf("[%d] Temporarily blocking proxy: %q", id, proxyURL.Host)
-			ph.block(proxyURL.Host)
-		}
+	ctx := req.Context()
+	start := time.Now()
+	release, ok := tunnelLimits.acquire(req.RemoteAddr)
+	if !ok {
+		slog.WarnContext(ctx, "Rejected CONNECT from client with too many open tunnels",
+			"client", req.RemoteAddr)
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
 	}
+	server, proxyURL, err := ph.connect(req)
 	if err != nil {
+		release()
 		// Without this line, an auth-chain refusal on the CONNECT
 		// path surfaces to the client as a bare 502 with nothing in
 		// alpaca's log explaining why — the most common cause of
@@ -285,28 +294,38 @@ func (ph ProxyHandler) handleConnect(w http.ResponseWriter, req *http.Request) {
 		// already logged WHICH host was excluded; this line links
 		// that to the 502 the client actually saw.
 		if errors.Is(err, errNoMatchingAuthMethod) {
-			log.Printf("[%d] No authenticator matched proxy %q; "+
-				"returning 502 to client", id, proxyURL.Host)
+			slog.WarnContext(ctx, "No authenticator matched proxy; "+
+				"returning 502 to client", "url", req.URL.String())
 		}
+		observeRequest(req, proxyURL, http.StatusBadGateway, start)
 		w.WriteHeader(http.StatusBadGateway)
 		return
 	}
+	observeRequest(req, proxyURL, http.StatusOK, start)
+	// The client's tunnel is counted until the connection to the server is
+	// closed, which happens on every path out of here (see splice).
+	server = &onCloseConn{server, release}
 	closeInDefer := true
 	defer func() {
 		if closeInDefer {
 			_ = server.Close()
 		}
 	}()
+	if req.ProtoMajor == 2 {
+		closeInDefer = false
+		tunnelH2(w, req, server)
+		return
+	}
 	// Take over the connection back to the client by hijacking the ResponseWriter.
 	h, ok := w.(http.Hijacker)
 	if !ok {
-		log.Printf("[%d] Error hijacking response writer", id)
+		slog.ErrorContext(ctx, "Error hijacking response writer")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	client, _, err := h.Hijack()
 	if err != nil {
-		log.Printf("[%d] Error hijacking connection: %v", id, err)
+		slog.ErrorContext(ctx, "Error hijacking connection", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -325,28 +344,174 @@ func (ph ProxyHandler) handleConnect(w http.ResponseWriter, req *http.Request) {
 		resp = []byte("HTTP/1.0 200 Connection Established\r\n\r\n")
 	}
 	if _, err := client.Write(resp); err != nil {
-		log.Printf("[%d] Error writing response: %v", id, err)
+		slog.ErrorContext(ctx, "Error writing response", "error", err)
+		return
+	}
+	closeInDefer = false
+	splice(client, server)
+}
+
+// tunnelH2 answers a CONNECT request that came over HTTP/2, and copies data
+// between its stream and server until the tunnel closes. An HTTP/2
+// connection can't be hijacked, since other requests share it, so the
+// tunnel is the request's stream (RFC 9113 §8.5), and only lasts as long as
+// the handler does.
+func tunnelH2(w http.ResponseWriter, req *http.Request, server net.Conn) {
+	ctx := req.Context()
+	client := &h2Stream{body: req.Body, w: w, rc: http.NewResponseController(w)}
+	w.WriteHeader(http.StatusOK)
+	if err := client.rc.Flush(); err != nil {
+		slog.ErrorContext(ctx, "Error writing response", "error", err)
+		_ = server.Close()
 		return
 	}
+	<-splice(client, server)
+	// Make sure that nothing touches the stream once the handler returns.
+	_ = client.Close()
+}
+
+// h2Stream is a client's tunnel over an HTTP/2 stream: reads come from the
+// request body, and writes go to the response.
+type h2Stream struct {
+	body io.ReadCloser
+	w    io.Writer
+	rc   *http.ResponseController
+
+	mu      sync.Mutex
+	writing bool // whether a Write is in progress
+	closed  bool
+}
+
+func (s *h2Stream) Read(b []byte) (int, error) { return s.body.Read(b) }
+
+func (s *h2Stream) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	s.writing = true
+	s.mu.Unlock()
+	n, err := s.w.Write(b)
+	if err == nil {
+		err = s.rc.Flush()
+	}
+	s.mu.Lock()
+	s.writing = false
+	s.mu.Unlock()
+	return n, err
+}
+
+// Close stops reading from the client, and writing to it. A Write that's
+// blocked (on a client that isn't reading) is unblocked by resetting the
+// stream; otherwise, the stream ends normally once the handler returns.
+func (s *h2Stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.writing {
+		_ = s.rc.SetWriteDeadline(time.Now())
+	}
+	return s.body.Close()
+}
+
+// splice copies data in each direction between client and server, in the
+// background, and closes both when done, or when no data has passed either
+// way for tunnelIdleTimeout. The tunnel is tracked in activeTunnels until
+// both copies have finished, at which point the returned channel is closed.
+func splice(client, server io.ReadWriteCloser) <-chan struct{} {
+	remove := activeTunnels.add(client, server)
+	idle := newIdleTimer(tunnelIdleTimeout, client, server)
+	done := make(chan struct{})
+	var copying sync.WaitGroup
+	copying.Add(2)
+	go func() {
+		copying.Wait()
+		idle.stop()
+		remove()
+		close(done)
+	}()
 	// Kick off goroutines to copy data in each direction. Whichever goroutine finishes first
 	// will close the Reader for the other goroutine, forcing any blocked copy to unblock. This
 	// prevents any goroutine from blocking indefinitely (which will leak a file descriptor).
-	closeInDefer = false
-	go func() { _, _ = io.Copy(server, client); _ = server.Close() }()
-	go func() { _, _ = io.Copy(client, server); _ = client.Close() }()
+	go func() {
+		defer copying.Done()
+		n, _ := io.Copy(server, idleReader{client, idle})
+		_ = server.Close()
+		tunnelBytesTotal.WithLabelValues("upstream").Add(float64(n))
+	}()
+	go func() {
+		defer copying.Done()
+		n, _ := io.Copy(client, idleReader{server, idle})
+		_ = client.Close()
+		tunnelBytesTotal.WithLabelValues("downstream").Add(float64(n))
+	}()
+	return done
+}
+
+// connect opens a tunnel to req.Host, either directly or through the
+// request's proxy, and returns the proxy that it used (nil for DIRECT). A
+// proxy that can't be reached is temporarily blocked.
+func (ph ProxyHandler) connect(req *http.Request) (net.Conn, *url.URL, error) {
+	proxyURL, err := ph.transport.Proxy(req)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error finding proxy for request", "error", err)
+	}
+	for {
+		var server net.Conn
+		if proxyURL == nil {
+			server, err = connectDirect(req)
+		} else {
+			server, err = ph.h2.connect(req, proxyURL, ph.auth)
+			if errors.Is(err, errHTTP11Required) {
+				server, err = connectViaProxy(req, proxyURL, ph.auth)
+			}
+		}
+		next, nextURL, ok := ph.failover(req, proxyURL, err)
+		if !ok {
+			return server, proxyURL, err
+		}
+		req, proxyURL = next, nextURL
+	}
+}
+
+// failover is called when a request through proxyURL has failed with err. If
+// the proxy couldn't be reached, or didn't complete the CONNECT handshake,
+// it's temporarily blocked, and failover returns a copy of req that uses the
+// next proxy that the PAC file gave for it, as a browser would. It returns
+// false if the request shouldn't be retried.
+func (ph ProxyHandler) failover(req *http.Request, proxyURL *url.URL, err error) (
+	*http.Request, *url.URL, bool) {
+
+	var oe *net.OpError
+	if proxyURL == nil || !errors.As(err, &oe) || oe.Op != "proxyconnect" {
+		return nil, nil, false
+	}
+	ctx := req.Context()
+	slog.WarnContext(ctx, "Temporarily blocking proxy", "proxy", proxyURL.Host,
+		"error", err)
+	ph.block(proxyURL)
+	ctx, next, ok := nextProxy(ctx)
+	if !ok {
+		return nil, nil, false
+	}
+	slog.InfoContext(ctx, "Trying next proxy", "proxy", proxyLabel(next))
+	return req.WithContext(ctx), next, true
 }
 
 func connectDirect(req *http.Request) (net.Conn, error) {
-	server, err := net.Dial("tcp", req.Host)
+	server, err := netDialer.DialContext(req.Context(), "tcp", req.Host)
 	if err != nil {
-		id := req.Context().Value(contextKeyID)
-		log.Printf("[%d] Error dialling host %s: %v", id, req.Host, err)
+		slog.ErrorContext(req.Context(), "Error dialling host",
+			"host", req.Host, "error", err)
 	}
 	return server, err
 }
 
 func connectViaProxy(req *http.Request, proxyURL *url.URL, auth *authChain) (net.Conn, error) {
-	id := req.Context().Value(contextKeyID)
 
 	// SOCKS5 short-circuit: SOCKS5 has its own authentication model
 	// (RFC 1928 §3) and never returns 407, so the HTTP-proxy auth
@@ -354,12 +519,12 @@ func connectViaProxy(req *http.Request, proxyURL *url.URL, auth *authChain) (net
 	// handleConnect for hijacking. Gated upstream by the
 	// `--enable-socks` flag (default off).
 	if proxyURL.Scheme == "socks5" {
-		dialer, err := proxy.SOCKS5("tcp", proxyURL.Host, nil, proxy.Direct)
+		dialer, err := proxy.SOCKS5("tcp", proxyURL.Host, nil, netDialer)
 		if err != nil {
 			return nil, &net.OpError{Op: "proxyconnect", Net: "tcp", Err: err}
 		}
-		log.Printf("[%d] CONNECT %s via SOCKS5 %s (HTTP auth chain bypassed)",
-			id, req.Host, proxyURL.Host)
+		slog.InfoContext(req.Context(), "CONNECT via SOCKS5 (HTTP auth chain bypassed)",
+			"host", req.Host)
 		conn, err := dialer.Dial("tcp", req.Host)
 		if err != nil {
 			return nil, &net.OpError{Op: "proxyconnect", Net: "tcp", Err: err}
@@ -374,56 +539,98 @@ func connectViaProxy(req *http.Request, proxyURL *url.URL, auth *authChain) (net
 	// proxyRequest, but CONNECT bypasses that middleware so we set it
 	// here.
 	req = req.WithContext(context.WithValue(req.Context(), contextKeyProxy, proxyURL))
+	ctx := req.Context()
 
 	var tr transport
 	defer tr.Close() //nolint:errcheck
+	tr.setDeadline(connectDeadline())
 	if err := tr.dial(proxyURL); err != nil {
-		log.Printf("[%d] Error dialling proxy %s: %v", id, proxyURL.Host, err)
+		slog.ErrorContext(ctx, "Error dialling proxy", "error", err)
 		return nil, err
 	}
-	resp, err := tr.RoundTrip(req)
+	// If we know which scheme the proxy wants, authenticate in the first
+	// request rather than waiting for a 407.
+	var resp *http.Response
+	var err error
+	method := auth.remembered(proxyURL)
+	if method == nil {
+		resp, err = tr.RoundTrip(req)
+	} else {
+		slog.DebugContext(ctx, "Authenticating proactively", "scheme", method.scheme())
+		req.Header.Del("Proxy-Authorization")
+		resp, err = method.do(req.WithContext(withChannelBinding(ctx, tr.tlsState())), &tr)
+		observeAuthAttempt(proxyLabel(proxyURL), method.scheme(), resp, err)
+	}
 	if err != nil {
-		log.Printf("[%d] Error reading CONNECT response: %v", id, err)
-		return nil, err
+		slog.ErrorContext(ctx, "Error reading CONNECT response", "error", err)
+		// The proxy accepted the connection, but didn't answer.
+		return nil, &net.OpError{Op: "proxyconnect", Net: "tcp", Err: err}
+	}
+	if method != nil && resp.StatusCode == http.StatusProxyAuthRequired {
+		auth.forget(proxyURL, method.scheme())
 	}
 	if resp.StatusCode == http.StatusProxyAuthRequired && auth != nil {
-		log.Printf("[%d] Got %q response, retrying with auth", id, resp.Status)
+		slog.InfoContext(ctx, "Retrying with auth", "status", resp.StatusCode)
 		schemes := parseProxyAuthenticateSchemes(resp.Header)
-		_ = resp.Body.Close()
+		// If the proxy kept the connection alive, the first method
+		// can do its handshake on it rather than on a new one, as
+		// long as no handshake has been started on it already.
+		reuse := drainBody(resp) && method == nil
 		// resp is now stale; the retry helper returns a fresh one.
-		authResp, err := retryConnectWithAuth(req, proxyURL, auth, schemes, &tr)
+		authResp, scheme, err := retryConnectWithAuth(req, proxyURL, auth, schemes, &tr, reuse)
 		if err != nil {
 			return nil, err
 		}
-		log.Printf("[%d] Got %q response", id, authResp.Status)
+		slog.InfoContext(ctx, "Got response to authenticated request",
+			"status", authResp.StatusCode)
+		auth.remember(proxyURL, scheme, schemes)
 		resp = authResp
 	}
 	_ = resp.Body.Close()
 	if resp.StatusCode == http.StatusProxyAuthRequired {
-		return nil, fmt.Errorf(
-			"[%d] all configured authentication methods rejected by proxy", id)
+		err := errors.New("all configured authentication methods rejected by proxy")
+		slog.WarnContext(ctx, "Error connecting via proxy", "error", err)
+		return nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("[%d] Unexpected response status: %s", id, resp.Status)
+		err := fmt.Errorf("unexpected response status: %s", resp.Status)
+		slog.WarnContext(ctx, "Error connecting via proxy", "error", err)
+		return nil, err
 	}
 	return tr.hijack(), nil
 }
 
+// maxDrainBytes is the largest response body that we'll read (and discard)
+// in order to reuse a connection.
+const maxDrainBytes = 64 << 10
+
+// drainBody reads and closes a response body, and reports whether the
+// connection that it came over can be used for another request.
+func drainBody(resp *http.Response) bool {
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, maxDrainBytes+1))
+	_ = resp.Body.Close()
+	return err == nil && n <= maxDrainBytes && !resp.Close
+}
+
 // retryConnectWithAuth iterates the configured auth chain over a CONNECT
 // request, redialling the proxy connection between methods. NTLM and
 // Negotiate are connection-bound (RFC 4559), so each method must run on
 // its own freshly-dialled socket; sharing one socket across methods
 // would mix authentication state machines and could leak credentials
 // onto a connection a different scheme had already negotiated against.
+// The one exception is the first method, which reuses tr's connection if
+// reuse is true (i.e. the proxy kept it alive after its 407, which hasn't
+// started any handshake).
 //
-// Returns the final response (caller closes Body) or an error. If every
-// candidate is rejected, the last 407 is returned to the caller.
+// Returns the final response (caller closes Body) and the scheme of the
+// method that produced it, or an error. If every candidate is rejected,
+// the last 407 is returned to the caller.
 func retryConnectWithAuth(req *http.Request, proxyURL *url.URL, auth *authChain,
-	schemes []string, tr *transport) (*http.Response, error) {
-	id := req.Context().Value(contextKeyID)
+	schemes []string, tr *transport, reuse bool) (*http.Response, string, error) {
+	ctx := req.Context()
 	candidates := auth.pick(schemes, proxyURL.Hostname())
 	if len(candidates) == 0 {
-		return nil, errNoMatchingAuthMethod
+		return nil, "", errNoMatchingAuthMethod
 	}
 	var lastResp *http.Response
 	for i, method := range candidates {
@@ -431,27 +638,33 @@ func retryConnectWithAuth(req *http.Request, proxyURL *url.URL, auth *authChain,
 		// require their entire challenge/response sequence to occur
 		// over a single, fresh TCP connection. Some proxies also close
 		// the socket on a 407.
-		if err := tr.dial(proxyURL); err != nil {
-			log.Printf("[%d] Error re-dialling %s for %s: %v",
-				id, proxyURL.Host, method.scheme(), err)
-			return nil, err
+		if i > 0 || !reuse {
+			if err := tr.dial(proxyURL); err != nil {
+				slog.ErrorContext(ctx, "Error re-dialling proxy",
+					"scheme", method.scheme(), "error", err)
+				return nil, "", err
+			}
 		}
 		// Defensive: ensure each method starts from a clean header
 		// state so that a header set by a prior method (or by the
 		// initial request) does not bleed into this attempt.
 		req.Header.Del("Proxy-Authorization")
-		log.Printf("[%d] Attempting %s authentication", id, method.scheme())
+		slog.InfoContext(ctx, "Attempting authentication", "scheme", method.scheme())
 		// NB: any error returned by method.do aborts the chain. This
 		// invariant prevents N-5 (header bleed across iterations on
 		// the error path) and is intentional; do not change to
 		// continue-on-error without revisiting the test that pins
 		// this contract.
-		resp, err := method.do(req, tr)
+		// Negotiate sends its token in the first request, so it needs
+		// the channel binding for the new connection up front.
+		methodReq := req.WithContext(withChannelBinding(ctx, tr.tlsState()))
+		resp, err := method.do(methodReq, tr)
+		observeAuthAttempt(proxyLabel(proxyURL), method.scheme(), resp, err)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		if resp.StatusCode != http.StatusProxyAuthRequired {
-			return resp, nil
+			return resp, method.scheme(), nil
 		}
 		if i < len(candidates)-1 {
 			_ = resp.Body.Close()
@@ -461,48 +674,91 @@ func retryConnectWithAuth(req *http.Request, proxyURL *url.URL, auth *authChain,
 		// open) to the caller so it can surface diagnostics.
 		lastResp = resp
 	}
-	return lastResp, nil
+	return lastResp, "", nil
 }
 
 func (ph ProxyHandler) proxyRequest(w http.ResponseWriter, req *http.Request, auth *authChain) {
-	// Make a copy of the request body, in case we have to replay it (for authentication)
-	var buf bytes.Buffer
-	id := req.Context().Value(contextKeyID)
-	if n, err := io.Copy(&buf, req.Body); err != nil {
-		log.Printf("[%d] Error copying request body (got %d/%d): %v",
-			id, n, req.ContentLength, err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	// Stream the request body to the proxy, but keep a copy in case we
+	// have to replay it (for authentication).
+	ctx := req.Context()
+	body := newReplayBuffer(req.Body)
+	defer body.Close() //nolint:errcheck
+	start := time.Now()
+	proxyURL, err := ph.transport.Proxy(req)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error finding proxy for request", "error", err)
+	}
+	var resp *http.Response
+	var method proxyAuthenticator
+	for {
+		// If we know which scheme the proxy wants, authenticate in the
+		// first request rather than waiting for a 407.
+		method = auth.remembered(proxyURL)
+		if method != nil {
+			slog.DebugContext(ctx, "Authenticating proactively",
+				"scheme", method.scheme())
+			// As in retryProxyRequestWithAuth, connection-bound
+			// schemes need a connection pool of their own.
+			methodRT := ph.transport.Clone()
+			resp, err = method.do(req, &replayTransport{methodRT, body, proactiveLimit(method)})
+			observeAuthAttempt(proxyLabel(proxyURL), method.scheme(), resp, err)
+			methodRT.CloseIdleConnections()
+		} else {
+			// Without an auth chain, there won't be a retry, so
+			// there's no need to keep a copy of the body.
+			var limit int64
+			if auth != nil {
+				limit = replayMaxBytes
+			}
+			rt := &replayTransport{ph.transport, body, limit}
+			resp, err = rt.RoundTrip(req)
+		}
+		// A proxy that can't be reached hasn't read any of the body,
+		// so it can be sent to the next one.
+		next, nextURL, ok := ph.failover(req, proxyURL, err)
+		if !ok {
+			break
+		}
+		req, proxyURL, ctx = next, nextURL, next.Context()
 	}
-	rd := bytes.NewReader(buf.Bytes())
-	req.Body = io.NopCloser(rd)
-	resp, err := ph.transport.RoundTrip(req)
 	if err != nil {
-		log.Printf("[%d] Error forwarding request: %v", id, err)
+		slog.ErrorContext(ctx, "Error forwarding request", "error", err)
+		observeRequest(req, proxyURL, http.StatusBadGateway, start)
 		w.WriteHeader(http.StatusBadGateway)
 		var oe *net.OpError
-		if errors.As(err, &oe) && oe.Op == "proxyconnect" {
-			proxyURL, err := ph.transport.Proxy(req)
-			if err != nil {
-				log.Printf("[%d] Proxy connect error to unknown proxy: %v", id, err)
-				return
-			}
-			log.Printf("[%d] Temporarily blocking proxy: %q", id, proxyURL.Host)
-			ph.block(proxyURL.Host)
+		if errors.As(err, &oe) && oe.Op == "proxyconnect" && proxyURL == nil {
+			slog.ErrorContext(ctx, "Proxy connect error to unknown proxy", "error", err)
 		}
 		return
 	}
+	if method != nil && resp.StatusCode == http.StatusProxyAuthRequired {
+		auth.forget(proxyURL, method.scheme())
+	}
 	if resp.StatusCode == http.StatusProxyAuthRequired && auth != nil {
 		schemes := parseProxyAuthenticateSchemes(resp.Header)
 		_ = resp.Body.Close()
-		log.Printf("[%d] Got %q response, retrying with auth", id, resp.Status)
-		resp, err = retryProxyRequestWithAuth(req, ph.transport, auth, schemes, rd)
+		slog.InfoContext(ctx, "Retrying with auth", "status", resp.StatusCode)
+		// The retries go over new connections, which will almost always
+		// reach the same proxy (and certificate) as this one. NTLM uses
+		// the binding of its own connection; this is for Negotiate,
+		// which has to send its token before it can see that.
+		req = req.WithContext(withChannelBinding(ctx, resp.TLS))
+		var scheme string
+		resp, scheme, err = retryProxyRequestWithAuth(req, ph.transport, auth, schemes, body)
 		if err != nil {
-			log.Printf("[%d] Error forwarding request (with auth): %v", id, err)
+			slog.ErrorContext(ctx, "Error forwarding request (with auth)", "error", err)
+			observeRequest(req, proxyURL, http.StatusBadGateway, start)
 			w.WriteHeader(http.StatusBadGateway)
 			return
 		}
-		log.Printf("[%d] Got %q response", id, resp.Status)
+		auth.remember(proxyURL, scheme, schemes)
+		slog.InfoContext(ctx, "Got response to authenticated request",
+			"status", resp.StatusCode)
+	}
+	observeRequest(req, proxyURL, resp.StatusCode, start)
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		switchProtocols(w, req, resp)
+		return
 	}
 	defer resp.Body.Close() //nolint:errcheck
 	copyResponseHeaders(w, resp)
@@ -511,11 +767,23 @@ func (ph ProxyHandler) proxyRequest(w http.ResponseWriter, req *http.Request, au
 	if err != nil {
 		// The response status has already been sent, so if copying fails, we can't return
 		// an error status to the client.  Instead, log the error.
-		log.Printf("[%d] Error copying response body: %v", id, err)
+		slog.ErrorContext(ctx, "Error copying response body", "error", err)
 		return
 	}
 }
 
+// proactiveLimit returns how much of the body to record when authenticating
+// proactively with method. The proxy accepted the scheme last time, so it's
+// unlikely to ask for the body again, and only what fits in memory is kept
+// for that case. A connection-bound method sends the body once for each leg
+// of its handshake, though, so it needs as much as any other retry.
+func proactiveLimit(method proxyAuthenticator) int64 {
+	if connectionBound(method) {
+		return replayMaxBytes
+	}
+	return replayMemoryBytes
+}
+
 // retryProxyRequestWithAuth iterates the configured auth chain over a
 // regular (non-CONNECT) HTTP request. Each method gets its OWN cloned
 // *http.Transport so that:
@@ -529,45 +797,54 @@ func (ph ProxyHandler) proxyRequest(w http.ResponseWriter, req *http.Request, au
 // CloseIdleConnections() on a shared *http.Transport is a hint, not a
 // guarantee, so it is insufficient on its own — the per-method clone is
 // the load-bearing primitive. See multiauth.go for the picker contract.
+//
+// Each method sends the body from the start of body. Only the last method's
+// requests aren't recorded for replaying, unless the method makes more than
+// one request (like NTLM). Either way, no more than replayMaxBytes is
+// recorded.
+//
+// Returns the final response and the scheme of the method that produced it
+// ("" if every method was rejected), like retryConnectWithAuth.
 func retryProxyRequestWithAuth(req *http.Request, rt *http.Transport, auth *authChain,
-	schemes []string, body *bytes.Reader) (*http.Response, error) {
-	id := req.Context().Value(contextKeyID)
+	schemes []string, body *replayBuffer) (*http.Response, string, error) {
+	ctx := req.Context()
 	proxyHost := ""
+	var proxyURL *url.URL
 	if value := req.Context().Value(contextKeyProxy); value != nil {
 		if u, ok := value.(*url.URL); ok {
 			proxyHost = u.Hostname()
+			proxyURL = u
 		}
 	}
 	candidates := auth.pick(schemes, proxyHost)
 	if len(candidates) == 0 {
-		return nil, errNoMatchingAuthMethod
+		return nil, "", errNoMatchingAuthMethod
 	}
 	var lastResp *http.Response
 	for i, method := range candidates {
-		if _, err := body.Seek(0, io.SeekStart); err != nil {
-			log.Printf("[%d] Error seeking request body for %s retry: %v",
-				id, method.scheme(), err)
-			return nil, err
-		}
-		req.Body = io.NopCloser(body)
 		req.Header.Del("Proxy-Authorization")
 		// Per-method transport clone gives us an isolated connection
 		// pool, so connection-bound auth (NTLM/Negotiate) cannot leak
 		// state across methods.
 		methodRT := rt.Clone()
-		log.Printf("[%d] Attempting %s authentication", id, method.scheme())
+		slog.InfoContext(ctx, "Attempting authentication", "scheme", method.scheme())
 		// NB: any error from method.do aborts the chain — see same
 		// comment in retryConnectWithAuth.
-		resp, err := method.do(req, methodRT)
+		var limit int64
+		if i < len(candidates)-1 || connectionBound(method) {
+			limit = replayMaxBytes
+		}
+		resp, err := method.do(req, &replayTransport{methodRT, body, limit})
+		observeAuthAttempt(proxyLabel(proxyURL), method.scheme(), resp, err)
 		// Free the cloned pool's idle connections regardless of
 		// outcome. This is best-effort; the real isolation comes
 		// from each method having its OWN pool.
 		methodRT.CloseIdleConnections()
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		if resp.StatusCode != http.StatusProxyAuthRequired {
-			return resp, nil
+			return resp, method.scheme(), nil
 		}
 		if i < len(candidates)-1 {
 			_ = resp.Body.Close()
@@ -575,7 +852,7 @@ func retryProxyRequestWithAuth(req *http.Request, rt *http.Transport, auth *auth
 		}
 		lastResp = resp
 	}
-	return lastResp, nil
+	return lastResp, "", nil
 }
 
 func deleteConnectionTokens(header http.Header) {
@@ -610,12 +887,16 @@ func copyResponseHeaders(w http.ResponseWriter, resp *http.Response) {
 			w.Header().Add(k, v)
 		}
 	}
+	deleteResponseHeaders(w.Header())
+}
+
+func deleteResponseHeaders(header http.Header) {
 	// Delete hop-by-hop headers (see https://tools.ietf.org/html/rfc2616#section-13.5.1)
-	deleteConnectionTokens(w.Header())
-	w.Header().Del("Connection")
-	w.Header().Del("Keep-Alive")
-	w.Header().Del("Proxy-Authenticate")
-	w.Header().Del("Trailer")
-	w.Header().Del("Transfer-Encoding")
-	w.Header().Del("Upgrade")
+	deleteConnectionTokens(header)
+	header.Del("Connection")
+	header.Del("Keep-Alive")
+	header.Del("Proxy-Authenticate")
+	header.Del("Trailer")
+	header.Del("Transfer-Encoding")
+	header.Del("Upgrade")
 }
@@ -26,7 +26,10 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -141,12 +144,12 @@ func TestProxyHTTP2(t *testing.T) {
 }
 
 func newDirectProxy() ProxyHandler {
-	return NewProxyHandler(nil, http.ProxyURL(nil), func(string) {})
+	return NewProxyHandler(nil, http.ProxyURL(nil), func(*url.URL) {})
 }
 
 func newChildProxy(parent *httptest.Server) http.Handler {
 	parentURL := &url.URL{Host: parent.Listener.Addr().String()}
-	childProxy := NewProxyHandler(nil, getProxyFromContext, func(string) {})
+	childProxy := NewProxyHandler(nil, getProxyFromContext, func(*url.URL) {})
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		ctx := context.WithValue(req.Context(), contextKeyProxy, parentURL)
 		reqWithProxy := req.WithContext(ctx)
@@ -355,6 +358,168 @@ func TestConnectResponseHasCorrectNewlines(t *testing.T) {
 	assert.NotContains(t, noCRLFs, "\n", "response contains unmatched LF")
 }
 
+func TestConnectTooManyTunnels(t *testing.T) {
+	tunnelLimits.mu.Lock()
+	tunnelLimits.max = 1
+	tunnelLimits.mu.Unlock()
+	defer func() {
+		tunnelLimits.mu.Lock()
+		tunnelLimits.max = 0
+		tunnelLimits.mu.Unlock()
+	}()
+	target := echoServer(t)
+	proxy := httptest.NewServer(newDirectProxy())
+	defer proxy.Close()
+	connect := func() (net.Conn, int) {
+		client, err := net.Dial("tcp", proxy.Listener.Addr().String())
+		require.NoError(t, err)
+		_, err = fmt.Fprintf(client, "CONNECT %s HTTP/1.1\r\n\r\n", target.Addr())
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+		require.NoError(t, err)
+		return client, resp.StatusCode
+	}
+	first, status := connect()
+	require.Equal(t, http.StatusOK, status)
+	second, status := connect()
+	_ = second.Close()
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	// Once the first tunnel has closed, the client can open another.
+	_ = first.Close()
+	assert.Eventually(t, func() bool {
+		client, status := connect()
+		_ = client.Close()
+		return status == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestFailoverToNextProxy(t *testing.T) {
+	// Nothing listens on the first proxy's port.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dead := l.Addr().String()
+	require.NoError(t, l.Close())
+	parent := httptest.NewServer(newDirectProxy())
+	defer parent.Close()
+	pac := fmt.Sprintf(`function FindProxyForURL(url, host) {
+		return "PROXY %s; PROXY %s";
+	}`, dead, parent.Listener.Addr())
+	pacServer := httptest.NewServer(pacjsHandler(pac))
+	defer pacServer.Close()
+	pf := NewProxyFinder(pacServer.URL, false, NewPACWrapper(PACData{Port: 1}), false)
+	ph := NewProxyHandler(nil, getProxyFromContext, pf.blockProxy)
+	alpaca := httptest.NewServer(pf.WrapHandler(ph.WrapHandler(http.NotFoundHandler())))
+	defer alpaca.Close()
+
+	t.Run("GET", func(t *testing.T) {
+		pf.health.reset()
+		origin := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) { _, _ = w.Write([]byte("ok")) }))
+		defer origin.Close()
+		client := http.Client{Transport: &http.Transport{Proxy: proxyServer(t, alpaca)}}
+		resp, err := client.Get(origin.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close() //nolint:errcheck
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.True(t, pf.health.isDown(dead))
+	})
+
+	t.Run("CONNECT", func(t *testing.T) {
+		pf.health.reset()
+		target := echoServer(t)
+		conn, err := net.Dial("tcp", alpaca.Listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close() //nolint:errcheck
+		_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\n\r\n", target.Addr())
+		require.NoError(t, err)
+		rd := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(rd, nil)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(rd, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(buf))
+		assert.True(t, pf.health.isDown(dead))
+	})
+}
+
+func TestConnectOverHTTP2(t *testing.T) {
+	// An echo server, which we'll reach through CONNECT tunnels.
+	server, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer server.Close() //nolint:errcheck
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close() //nolint:errcheck
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	s := createServer(newDirectProxy(), new(reloadableAccess), limits{}, true)
+	var conns atomic.Int32
+	s.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go func() { _ = s.Serve(l) }()
+	defer s.Close()
+
+	// A client that speaks HTTP/2 without TLS ("prior knowledge").
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	tr := &http.Transport{Protocols: &protocols}
+	defer tr.CloseIdleConnections()
+	tunnel := func() (io.WriteCloser, io.ReadCloser) {
+		pr, pw := io.Pipe()
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Scheme: "http", Host: l.Addr().String()},
+			Host:   server.Addr().String(),
+			Header: make(http.Header),
+			Body:   pr,
+		}
+		resp, err := tr.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, 2, resp.ProtoMajor)
+		return pw, resp.Body
+	}
+	echo := func(w io.Writer, r io.Reader, msg string) {
+		_, err := w.Write([]byte(msg))
+		require.NoError(t, err)
+		buf := make([]byte, len(msg))
+		_, err = io.ReadFull(r, buf)
+		require.NoError(t, err)
+		assert.Equal(t, msg, string(buf))
+	}
+	w1, r1 := tunnel()
+	w2, r2 := tunnel()
+	echo(w1, r1, "hello")
+	echo(w2, r2, "world")
+	assert.Equal(t, int32(1), conns.Load(), "tunnels should share a connection")
+
+	// Closing one tunnel leaves the other open.
+	require.NoError(t, w1.Close())
+	_, err = io.ReadAll(r1)
+	assert.NoError(t, err, "the stream should end normally")
+	echo(w2, r2, "again")
+	require.NoError(t, w2.Close())
+	_ = r2.Close()
+	_ = r1.Close()
+}
+
 func TestConnectToNonExistentHost(t *testing.T) {
 	proxy := httptest.NewServer(newDirectProxy())
 	defer proxy.Close()
@@ -388,7 +553,7 @@ func setupSOCKS5TestServers(t *testing.T) *httptest.Server {
 	// 3. Build minimal Alpaca handler
 	proxyHandler := NewProxyHandler(nil, func(*http.Request) (*url.URL, error) {
 		return url.Parse("socks5://" + socks5Addr)
-	}, func(string) {})
+	}, func(*url.URL) {})
 
 	handler := proxyHandler.WrapHandler(http.NotFoundHandler())
 
@@ -426,3 +591,110 @@ func TestSOCKS5Proxy(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, "/testpath", string(body))
 }
+
+// keepAliveProxy is a proxy that keeps connections alive after non-2xx
+// responses, and uses connection-bound authentication (like NTLM): once a
+// CONNECT on a connection has "Proxy-Authorization: Test ok", later requests
+// on that connection don't need it. It refuses to CONNECT to blocked.test.
+type keepAliveProxy struct {
+	listener net.Listener
+	mu       sync.Mutex
+	dials    int
+	conns    []net.Conn
+}
+
+func newKeepAliveProxy(t *testing.T) *keepAliveProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	p := &keepAliveProxy{listener: l}
+	t.Cleanup(func() {
+		_ = l.Close()
+		p.closeConns()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			p.mu.Lock()
+			p.dials++
+			p.conns = append(p.conns, conn)
+			p.mu.Unlock()
+			go p.handle(conn)
+		}
+	}()
+	return p
+}
+
+func (p *keepAliveProxy) URL() *url.URL {
+	return &url.URL{Scheme: "http", Host: p.listener.Addr().String()}
+}
+
+func (p *keepAliveProxy) dialCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dials
+}
+
+// closeConns closes all of the proxy's connections, as if they had timed
+// out.
+func (p *keepAliveProxy) closeConns() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.conns {
+		_ = conn.Close()
+	}
+	p.conns = nil
+}
+
+func (p *keepAliveProxy) handle(conn net.Conn) {
+	defer conn.Close() //nolint:errcheck
+	br := bufio.NewReader(conn)
+	authenticated := false
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		if req.Header.Get("Proxy-Authorization") == "Test ok" {
+			authenticated = true
+		}
+		switch {
+		case !authenticated:
+			_, _ = fmt.Fprint(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+				"Proxy-Authenticate: Test\r\nContent-Length: 4\r\n\r\nnope")
+		case req.Host == "blocked.test:443":
+			_, _ = fmt.Fprint(conn, "HTTP/1.1 403 Forbidden\r\n"+
+				"Content-Length: 7\r\n\r\nblocked")
+		default:
+			_, _ = fmt.Fprint(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+			return
+		}
+	}
+}
+
+func TestConnectViaProxyAuthenticatesOnKeptAliveConnection(t *testing.T) {
+	proxy := newKeepAliveProxy(t)
+	auth := realisticFake("Test", "Test ok")
+	chain := newAuthChain(auth)
+	connect := func(host string) error {
+		req, err := http.NewRequest(http.MethodConnect, "https://"+host, nil)
+		require.NoError(t, err)
+		conn, err := connectViaProxy(req, proxy.URL(), chain)
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err
+	}
+
+	// The proxy keeps the connection alive after its 407, so the
+	// handshake happens on that connection rather than a new one.
+	require.NoError(t, connect("example.test:443"))
+	assert.Equal(t, 1, proxy.dialCount())
+	assert.Equal(t, int32(1), auth.calls.Load())
+
+	// A refused CONNECT is reported as an error.
+	require.Error(t, connect("blocked.test:443"))
+	assert.Equal(t, 2, proxy.dialCount())
+}
@@ -17,15 +17,21 @@ package main
 import (
 	"context"
 	"errors"
-	"log"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-const contextKeyProxy = contextKey("proxy")
+const (
+	contextKeyProxy     = contextKey("proxy")
+	contextKeyFallbacks = contextKey("fallbacks")
+)
 
 func getProxyFromContext(req *http.Request) (*url.URL, error) {
 	if value := req.Context().Value(contextKeyProxy); value != nil {
@@ -36,74 +42,169 @@ func getProxyFromContext(req *http.Request) (*url.URL, error) {
 }
 
 type ProxyFinder struct {
-	runner      *PACRunner
+	// runner is swapped for a new one whenever the PAC script changes. It's
+	// nil if there's no PAC script to run.
+	runner      atomic.Pointer[PACRunner]
 	fetcher     *pacFetcher
 	wrapper     *PACWrapper
-	blocked     *blocklist
+	health      *proxyHealth
 	enableSocks bool
+	// canary is the host:port that health probes send a CONNECT request
+	// for (see probeProxy). If it's empty, probes only connect.
+	canary string
+	// wake asks the background worker (see refreshLoop) to check for a new
+	// PAC script, and done stops it.
+	wake chan struct{}
+	done chan struct{}
+	// The mutex is held while the PAC script is refreshed.
 	sync.Mutex
 }
 
-func NewProxyFinder(pacurl string, wrapper *PACWrapper, enableSocks bool) *ProxyFinder {
-	pf := &ProxyFinder{wrapper: wrapper, blocked: newBlocklist(), enableSocks: enableSocks}
-	pf.runner = new(PACRunner)
-	pf.fetcher = newPACFetcher(pacurl)
-	pf.checkForUpdates()
+func NewProxyFinder(pacurl string, wpad bool, wrapper *PACWrapper, enableSocks bool) *ProxyFinder {
+	pf := &ProxyFinder{
+		wrapper:     wrapper,
+		enableSocks: enableSocks,
+		wake:        make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	pf.health = newProxyHealth(func(proxy *url.URL) error {
+		return probeProxy(proxy, pf.canary)
+	})
+	pf.fetcher = newPACFetcher(pacurl, wpad)
+	// The first download happens up front, so that the first requests go
+	// to the right proxy.
+	pf.refresh()
+	go pf.refreshLoop()
 	return pf
 }
 
 func (pf *ProxyFinder) WrapHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		pf.checkForUpdates()
-		proxy, err := pf.findProxyForRequest(req)
+		proxies, err := pf.findProxiesForRequest(req)
 		if err != nil {
-			log.Printf("[%d] %v", req.Context().Value(contextKeyID), err)
+			slog.ErrorContext(req.Context(), "Error finding proxy for request",
+				"method", req.Method, "url", req.URL.String(), "error", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		if proxy != nil {
-			ctx := context.WithValue(req.Context(), contextKeyProxy, proxy)
-			req = req.WithContext(ctx)
-		}
-		next.ServeHTTP(w, req)
+		next.ServeHTTP(w, req.WithContext(withProxies(req.Context(), proxies)))
 	})
 }
 
+// withProxies returns a copy of ctx in which the first of proxies is the
+// request's proxy, and the rest are kept for failover (see nextProxy). A nil
+// proxy means DIRECT.
+func withProxies(ctx context.Context, proxies []*url.URL) context.Context {
+	var proxy any
+	if proxies[0] != nil {
+		proxy = proxies[0]
+	}
+	ctx = context.WithValue(ctx, contextKeyProxy, proxy)
+	return context.WithValue(ctx, contextKeyFallbacks, proxies[1:])
+}
+
+// nextProxy returns a copy of ctx that uses the next proxy that was kept for
+// failover by withProxies, or false if there are none left.
+func nextProxy(ctx context.Context) (context.Context, *url.URL, bool) {
+	fallbacks, _ := ctx.Value(contextKeyFallbacks).([]*url.URL)
+	if len(fallbacks) == 0 {
+		return ctx, nil, false
+	}
+	return withProxies(ctx, fallbacks), fallbacks[0], true
+}
+
+// checkForUpdates asks the background worker to check for a new PAC script
+// (e.g. because the network has changed). It doesn't wait for the check, so
+// requests are never held up by a PAC download.
 func (pf *ProxyFinder) checkForUpdates() {
+	select {
+	case pf.wake <- struct{}{}:
+	default:
+		// A check is already pending.
+	}
+}
+
+// refreshLoop is the background worker that keeps the PAC script up to date.
+// It refreshes the script when checkForUpdates asks it to, and when the
+// script is due to be revalidated, until the ProxyFinder is closed.
+func (pf *ProxyFinder) refreshLoop() {
+	for {
+		var expired <-chan time.Time
+		if expiry := pf.fetcher.expiresAt(); !expiry.IsZero() {
+			expired = time.After(time.Until(expiry))
+		}
+		select {
+		case <-pf.wake:
+		case <-expired:
+		case <-pf.done:
+			return
+		}
+		pf.refresh()
+	}
+}
+
+// refresh downloads the PAC script if it has changed, and swaps in a runner
+// for the new script. Requests carry on with the old runner until then, and
+// if the new script doesn't run.
+func (pf *ProxyFinder) refresh() {
 	pf.Lock()
 	defer pf.Unlock()
 	pacjs := pf.fetcher.download()
 	if pacjs == nil {
 		if !pf.fetcher.isConnected() {
-			pf.blocked = newBlocklist()
+			pf.runner.Store(nil)
+			pf.health.reset()
 			pf.wrapper.Wrap(nil)
 		}
 		return
 	}
-	pf.blocked = newBlocklist()
-	if err := pf.runner.Update(pacjs); err != nil {
-		log.Printf("Error running PAC JS: %q", err)
-	} else {
-		pf.wrapper.Wrap(pacjs)
+	runner := new(PACRunner)
+	if err := runner.Update(pacjs); err != nil {
+		slog.Error("Error running PAC JS", "error", err)
+		return
 	}
+	// A proxy that's down is likely to still be down, if the new PAC file
+	// still uses it.
+	pf.health.retain(func(host string) bool { return pacMentions(pacjs, host) })
+	pf.runner.Store(runner)
+	pf.wrapper.Wrap(pacjs)
+	pf.fetcher.persist(pacjs)
 }
 
+// findProxyForRequest returns the proxy to use for req, or nil for DIRECT.
 func (pf *ProxyFinder) findProxyForRequest(req *http.Request) (*url.URL, error) {
-	id := req.Context().Value(contextKeyID)
+	proxies, err := pf.findProxiesForRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	return proxies[0], nil
+}
+
+// findProxiesForRequest returns the proxies that the PAC file gives for req,
+// in the order that they should be tried, with nil for DIRECT. Like a
+// browser, it puts proxies that are blocked (because they failed recently)
+// last, rather than leaving them out, so that there's something to try even
+// if they've all failed. The list ends at DIRECT, since a request only fails
+// over when a proxy can't be reached, and it's never empty.
+func (pf *ProxyFinder) findProxiesForRequest(req *http.Request) ([]*url.URL, error) {
+	ctx := req.Context()
 	if pf.fetcher == nil {
-		log.Printf(`[%d] %s %s via "DIRECT"`, id, req.Method, req.URL)
-		return nil, nil
+		slog.DebugContext(ctx, "Found proxy for request",
+			"method", req.Method, "url", req.URL.String(), "proxy", "DIRECT")
+		return []*url.URL{nil}, nil
 	}
-	if !pf.fetcher.isConnected() {
-		log.Printf(`[%d] %s %s via "DIRECT" (not connected to PAC server)`,
-			id, req.Method, req.URL)
-		return nil, nil
+	runner := pf.runner.Load()
+	if !pf.fetcher.isConnected() || runner == nil {
+		slog.DebugContext(ctx, "Found proxy for request (not connected to PAC server)",
+			"method", req.Method, "url", req.URL.String(), "proxy", "DIRECT")
+		return []*url.URL{nil}, nil
 	}
-	str, err := pf.runner.FindProxyForURL(*req.URL)
+	str, err := runner.FindProxyForURL(*req.URL)
 	if err != nil {
 		return nil, err
 	}
-	var fallback *url.URL
+	var proxies, blocked []*url.URL
 	for _, elem := range strings.Split(str, ";") {
 		fields := strings.Fields(strings.TrimSpace(elem))
 		var scheme string
@@ -111,8 +212,8 @@ func (pf *ProxyFinder) findProxyForRequest(req *http.Request) (*url.URL, error)
 		if len(fields) == 0 {
 			continue
 		} else if fields[0] == "DIRECT" {
-			log.Printf("[%d] %s %s via %q", id, req.Method, req.URL, elem)
-			return nil, nil
+			proxies = append(proxies, nil)
+			break
 		} else if fields[0] == "PROXY" || fields[0] == "HTTP" {
 			scheme = "http"
 			defaultPort = "80"
@@ -121,40 +222,67 @@ func (pf *ProxyFinder) findProxyForRequest(req *http.Request) (*url.URL, error)
 			defaultPort = "443"
 		} else if fields[0] == "SOCKS5" {
 			if !pf.enableSocks {
-				log.Printf(
-					"[%d] Ignoring SOCKS5 proxy: %q "+
-						"(restart Alpaca with -enable-socks to allow SOCKS5 proxies from PAC files)",
-					id, elem,
-				)
+				slog.WarnContext(ctx, "Ignoring SOCKS5 proxy (restart Alpaca with "+
+					"-enable-socks to allow SOCKS5 proxies from PAC files)", "proxy", elem)
 				continue
 			}
 			scheme = "socks5"
 			defaultPort = "1080"
 		} else {
-			log.Printf("[%d] Couldn't parse proxy: %q", id, elem)
+			slog.WarnContext(ctx, "Couldn't parse proxy", "proxy", elem)
 			continue
 		}
 		proxy := &url.URL{Scheme: scheme, Host: fields[1]}
 		if proxy.Port() == "" {
 			proxy.Host = net.JoinHostPort(proxy.Host, defaultPort)
 		}
-		if pf.blocked.contains(proxy.Host) {
-			if fallback == nil {
-				fallback = proxy
-			}
+		if pf.health.isDown(proxy.Host) {
+			blocked = append(blocked, proxy)
 			continue
 		}
-		log.Printf("[%d] %s %s via %q", id, req.Method, req.URL, elem)
-		return proxy, nil
+		proxies = append(proxies, proxy)
+	}
+	// A request never fails over from DIRECT, so there's no point in
+	// putting the blocked proxies after it.
+	if n := len(proxies); n == 0 || proxies[n-1] != nil {
+		proxies = append(proxies, blocked...)
 	}
-	if fallback != nil {
-		// All the proxies are currently blocked. In this case, we'll temporarily ignore the
-		// blocklist and fall back to the first proxy that we saw (and skipped).
-		return fallback, nil
+	if len(proxies) == 0 {
+		return nil, errors.New("no proxies available")
 	}
-	return nil, errors.New("no proxies available")
+	slog.DebugContext(ctx, "Found proxy for request", "method", req.Method,
+		"url", req.URL.String(), "proxy", proxyLabel(proxies[0]))
+	return proxies, nil
 }
 
-func (pf *ProxyFinder) blockProxy(proxy string) {
-	pf.blocked.add(proxy)
+// status returns the PAC, proxy health and network parts of the /alpaca/status
+// document.
+func (pf *ProxyFinder) status() status {
+	var st status
+	st.Blocked = pf.health.snapshot()
+	if pf.fetcher != nil {
+		st.PAC = pf.fetcher.status()
+		st.Network.Addrs, st.Network.Routes = pf.fetcher.monitor.lastSeen()
+	}
+	return st
+}
+
+// blockProxy skips proxy for new requests until a probe finds that it's back
+// up.
+func (pf *ProxyFinder) blockProxy(proxy *url.URL) {
+	blockedProxiesTotal.WithLabelValues(proxy.Host).Inc()
+	pf.health.fail(proxy)
+}
+
+// close stops probing proxies, refreshing the PAC script, and watching for
+// network changes. It's called when the ProxyFinder is replaced by a reload.
+func (pf *ProxyFinder) close() {
+	pf.health.close()
+	if pf.fetcher == nil {
+		return
+	}
+	close(pf.done)
+	if c, ok := pf.fetcher.monitor.(io.Closer); ok {
+		_ = c.Close()
+	}
 }
@@ -19,7 +19,10 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -53,7 +56,7 @@ func TestFindProxyForRequest(t *testing.T) {
 			server := httptest.NewServer(http.HandlerFunc(pacjsHandler(js)))
 			defer server.Close()
 			pw := NewPACWrapper(PACData{Port: 1})
-			pf := NewProxyFinder(server.URL, pw, test.enableSocks)
+			pf := NewProxyFinder(server.URL, false, pw, test.enableSocks)
 			req := httptest.NewRequest(http.MethodGet, "https://www.test", nil)
 			ctx := context.WithValue(req.Context(), contextKeyID, i)
 			req = req.WithContext(ctx)
@@ -76,7 +79,7 @@ func TestFindProxyForRequest(t *testing.T) {
 func TestFallbackToDirectWhenNotConnected(t *testing.T) {
 	url := "http://pacserver.invalid/nonexistent.pac"
 	pw := NewPACWrapper(PACData{Port: 1})
-	pf := NewProxyFinder(url, pw, false)
+	pf := NewProxyFinder(url, false, pw, false)
 	req := httptest.NewRequest(http.MethodGet, "http://www.test", nil)
 	proxy, err := pf.findProxyForRequest(req)
 	require.NoError(t, err)
@@ -91,19 +94,113 @@ func TestSkipBadProxies(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(pacjsHandler(js)))
 	defer server.Close()
 	pw := NewPACWrapper(PACData{Port: 1})
-	pf := NewProxyFinder(server.URL, pw, false)
+	pf := NewProxyFinder(server.URL, false, pw, false)
 	req := httptest.NewRequest(http.MethodGet, "https://www.test", nil)
 	ctx := context.WithValue(req.Context(), contextKeyID, 0)
 	req = req.WithContext(ctx)
 	proxy, err := pf.findProxyForRequest(req)
 	require.NoError(t, err)
 	assert.Equal(t, "primary:80", proxy.Host)
-	pf.blocked.add("primary:80")
+	pf.health.fail(&url.URL{Host: "primary:80"})
 	proxy, err = pf.findProxyForRequest(req)
 	require.NoError(t, err)
 	assert.Equal(t, "backup:80", proxy.Host)
-	pf.blocked.add("backup:80")
+	pf.health.fail(&url.URL{Host: "backup:80"})
 	proxy, err = pf.findProxyForRequest(req)
 	require.NoError(t, err)
 	assert.Equal(t, "primary:80", proxy.Host)
 }
+
+func TestFindProxiesForRequest(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		result   string
+		blocked  []string
+		expected []string
+	}{
+		{"InOrder", "PROXY a:80; HTTPS b:443; DIRECT", nil, []string{"a:80", "b:443", "DIRECT"}},
+		{"StopsAtDirect", "PROXY a:80; DIRECT; PROXY b:80", nil, []string{"a:80", "DIRECT"}},
+		{"BlockedLast", "PROXY a:80; PROXY b:80", []string{"a:80"}, []string{"b:80", "a:80"}},
+		{"BlockedBeforeDirect", "PROXY a:80; DIRECT", []string{"a:80"}, []string{"DIRECT"}},
+		{"AllBlocked", "PROXY a:80; PROXY b:80", []string{"a:80", "b:80"},
+			[]string{"a:80", "b:80"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			js := fmt.Sprintf("function FindProxyForURL(url, host) { return %q }", test.result)
+			server := httptest.NewServer(pacjsHandler(js))
+			defer server.Close()
+			pf := NewProxyFinder(server.URL, false, NewPACWrapper(PACData{Port: 1}), false)
+			for _, host := range test.blocked {
+				pf.health.fail(&url.URL{Host: host})
+			}
+			req := httptest.NewRequest(http.MethodGet, "https://www.test", nil)
+			proxies, err := pf.findProxiesForRequest(req)
+			require.NoError(t, err)
+			var labels []string
+			for _, proxy := range proxies {
+				labels = append(labels, proxyLabel(proxy))
+			}
+			assert.Equal(t, test.expected, labels)
+		})
+	}
+}
+
+func TestNextProxy(t *testing.T) {
+	a, b := &url.URL{Host: "a:80"}, &url.URL{Host: "b:80"}
+	ctx := withProxies(context.Background(), []*url.URL{a, b, nil})
+	req := httptest.NewRequest(http.MethodGet, "https://www.test", nil).WithContext(ctx)
+	proxy, err := getProxyFromContext(req)
+	require.NoError(t, err)
+	assert.Equal(t, a, proxy)
+
+	ctx, next, ok := nextProxy(ctx)
+	require.True(t, ok)
+	assert.Equal(t, b, next)
+	ctx, next, ok = nextProxy(ctx)
+	require.True(t, ok)
+	assert.Nil(t, next)
+	proxy, err = getProxyFromContext(req.WithContext(ctx))
+	require.NoError(t, err)
+	assert.Nil(t, proxy, "DIRECT")
+	_, _, ok = nextProxy(ctx)
+	assert.False(t, ok)
+}
+
+func TestRefreshInBackground(t *testing.T) {
+	var mu sync.Mutex
+	pacjs := `function FindProxyForURL(url, host) { return "PROXY old.test:80" }`
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		_, _ = w.Write([]byte(pacjs))
+	}))
+	defer server.Close()
+	pf := NewProxyFinder(server.URL, false, NewPACWrapper(PACData{Port: 1}), false)
+	defer pf.close()
+	nm := &fakeNetMonitor{}
+	pf.fetcher.monitor = nm
+	req := httptest.NewRequest(http.MethodGet, "https://www.test", nil)
+	proxy, err := pf.findProxyForRequest(req)
+	require.NoError(t, err)
+	assert.Equal(t, "old.test:80", proxy.Host)
+
+	// Hold up the next download, and check that requests carry on using
+	// the old PAC script until it's done.
+	mu.Lock()
+	go func() {
+		<-release
+		pacjs = `function FindProxyForURL(url, host) { return "PROXY new.test:80" }`
+		mu.Unlock()
+	}()
+	nm.changed = true
+	pf.checkForUpdates()
+	proxy, err = pf.findProxyForRequest(req)
+	require.NoError(t, err)
+	assert.Equal(t, "old.test:80", proxy.Host)
+	close(release)
+	assert.Eventually(t, func() bool {
+		proxy, err := pf.findProxyForRequest(req)
+		return err == nil && proxy.Host == "new.test:80"
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,36 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// reloadableHandler is an http.Handler that delegates to a handler which can
+// be replaced while the server is running. Requests that are already in
+// progress finish on the handler they started with; CONNECT tunnels are
+// hijacked out of the server entirely, so they keep running after a swap.
+type reloadableHandler struct {
+	current atomic.Pointer[http.Handler]
+}
+
+func (rh *reloadableHandler) swap(handler http.Handler) {
+	rh.current.Store(&handler)
+}
+
+func (rh *reloadableHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	(*rh.current.Load()).ServeHTTP(w, req)
+}
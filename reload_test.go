@@ -0,0 +1,74 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloadKeepsTunnelsOpen(t *testing.T) {
+	// An echo server, which we'll reach through a CONNECT tunnel.
+	echo, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer echo.Close() //nolint:errcheck
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close() //nolint:errcheck
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	var handler reloadableHandler
+	handler.swap(newDirectProxy())
+	proxy := httptest.NewServer(createServer(&handler, new(reloadableAccess), limits{}, false).Handler)
+	defer proxy.Close()
+
+	client, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close() //nolint:errcheck
+	req, err := http.NewRequest(http.MethodConnect, "http://"+echo.Addr().String(), nil)
+	require.NoError(t, err)
+	require.NoError(t, req.Write(client))
+	rd := bufio.NewReader(client)
+	resp, err := http.ReadResponse(rd, req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Swap in a handler that rejects everything. New requests should see
+	// it, but the existing tunnel should be unaffected.
+	handler.swap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	resp, err = http.Get(proxy.URL)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	_, err = client.Write([]byte("ping\n"))
+	require.NoError(t, err)
+	line, err := rd.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ping\n", line)
+}
@@ -0,0 +1,241 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+const (
+	// replayMemoryBytes is how much of a request body is kept in memory
+	// for replaying; anything beyond that goes to a temporary file.
+	replayMemoryBytes = 1 << 20
+	// replayMaxBytes is the most of a request body that's kept for
+	// replaying. A proxy that asks for authentication usually does so
+	// before it has read much of the body, so a bigger body isn't
+	// copied to disk in full just in case; if it does have to be sent
+	// again, the request fails instead.
+	replayMaxBytes = 32 << 20
+)
+
+var (
+	errBodyNotReplayable = errors.New("request body has already been sent and can't be replayed")
+	errStaleBodyReader   = errors.New("request body is being replayed by a newer request")
+)
+
+// replayBuffer lets a request body be sent more than once (e.g. to retry a
+// request after a 407) without reading all of it up front. The body is
+// streamed from its source as it's read, and recorded as it goes: in memory
+// at first, and in a temporary file once it grows past replayMemoryBytes.
+// Each call to reader starts again from the beginning, replaying whatever
+// has been recorded and then carrying on from the source.
+//
+// Each reader has a limit on how much of the body it records. It's 0 for a
+// read that won't need to be replayed (typically the last attempt in the
+// auth chain), so that a large upload isn't copied to disk for nothing.
+// Once a reader reads past its limit, the buffer can't be replayed any more.
+type replayBuffer struct {
+	// srcMu is held while reading from src, which can block for as long
+	// as the client takes to send the body. It's separate from mu so that
+	// reader and Close don't have to wait for that.
+	srcMu sync.Mutex
+	src   io.Reader
+
+	mu     sync.Mutex
+	srcErr error    // sticky error from src, usually io.EOF
+	mem    []byte   // what's been recorded, until it outgrows memory
+	file   *os.File // what's been recorded, after that
+	size   int64    // number of bytes recorded
+	read   int64    // number of bytes read from src (more than size if not all recorded)
+	gen    int      // generation of the current reader
+	closed bool
+}
+
+func newReplayBuffer(src io.Reader) *replayBuffer {
+	return &replayBuffer{src: src}
+}
+
+// reader returns a reader over the body from the beginning, which records
+// what it reads from the source until the recording reaches limit bytes.
+// Readers returned by earlier calls stop working, so that a request that's
+// still being sent (e.g. by a Transport after it has returned a 407) can't
+// steal bytes from its replacement.
+func (b *replayBuffer) reader(limit int64) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.read > b.size {
+		return nil, errBodyNotReplayable
+	}
+	b.gen++
+	return &replayReader{b: b, gen: b.gen, limit: limit}, nil
+}
+
+// Close stops any remaining readers, and removes the temporary file (if
+// there is one).
+func (b *replayBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.gen++
+	b.closed = true
+	if b.file == nil {
+		return nil
+	}
+	name := b.file.Name()
+	err := b.file.Close()
+	b.file = nil
+	if rmErr := os.Remove(name); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// readAt reads recorded bytes starting at off. The caller must hold b.mu,
+// and off must be less than b.size.
+func (b *replayBuffer) readAt(p []byte, off int64) (int, error) {
+	if int64(len(p)) > b.size-off {
+		p = p[:b.size-off]
+	}
+	if b.file == nil {
+		return copy(p, b.mem[off:]), nil
+	}
+	n, err := b.file.ReadAt(p, off)
+	if n == len(p) {
+		err = nil
+	}
+	return n, err
+}
+
+// write records p, spilling to a temporary file if necessary. The caller
+// must hold b.mu.
+func (b *replayBuffer) write(p []byte) error {
+	if b.file == nil && len(b.mem)+len(p) > replayMemoryBytes {
+		f, err := os.CreateTemp("", "alpaca-body-*")
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(b.mem); err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+			return err
+		}
+		b.file, b.mem = f, nil
+	}
+	if b.file != nil {
+		if _, err := b.file.Write(p); err != nil {
+			return err
+		}
+	} else {
+		b.mem = append(b.mem, p...)
+	}
+	b.size += int64(len(p))
+	return nil
+}
+
+type replayReader struct {
+	b     *replayBuffer
+	gen   int
+	pos   int64
+	limit int64
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	b := r.b
+	if n, done, err := r.replay(p); done {
+		return n, err
+	}
+	// Only one reader at a time reads from the source. By the time this
+	// one gets its turn, another may have recorded more of the body, so
+	// check again.
+	b.srcMu.Lock()
+	defer b.srcMu.Unlock()
+	if n, done, err := r.replay(p); done {
+		return n, err
+	}
+	n, err := b.src.Read(p)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		b.srcErr = err
+	}
+	if n > 0 {
+		// Even if this reader has gone stale in the meantime, what it
+		// read has to be recorded (or not) for the next one.
+		recorded := b.read == b.size && b.size+int64(n) <= r.limit && !b.closed
+		b.read += int64(n)
+		if recorded {
+			if werr := b.write(p[:n]); werr != nil {
+				return 0, werr
+			}
+		}
+	}
+	if r.gen != b.gen {
+		return 0, errStaleBodyReader
+	}
+	r.pos += int64(n)
+	return n, err
+}
+
+// replay reads what has already been recorded, if this reader hasn't
+// caught up with it yet. It reports whether the read is done, or whether
+// the reader should carry on from the source.
+func (r *replayReader) replay(p []byte) (n int, done bool, err error) {
+	b := r.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case r.gen != b.gen:
+		return 0, true, errStaleBodyReader
+	case r.pos < b.size:
+		n, err := b.readAt(p, r.pos)
+		r.pos += int64(n)
+		return n, true, err
+	case r.pos != b.read:
+		// Something was read from the source without being
+		// recorded, so this reader can't carry on from there.
+		return 0, true, errBodyNotReplayable
+	case b.srcErr != nil:
+		return 0, true, b.srcErr
+	}
+	return 0, false, nil
+}
+
+// Close is a no-op: the buffer belongs to whoever created it, and a
+// Transport closes the request body as soon as it's done with it.
+func (r *replayReader) Close() error { return nil }
+
+// replayTransport sends every request with the body from the start of a
+// replayBuffer, so that an authenticator that makes several round trips
+// (like NTLM) sends the whole body each time.
+// limit is passed to replayBuffer.reader.
+type replayTransport struct {
+	rt    http.RoundTripper
+	body  *replayBuffer
+	limit int64
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rd, err := t.body.reader(t.limit)
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Body = rd
+	req.GetBody = func() (io.ReadCloser, error) { return t.body.reader(t.limit) }
+	return t.rt.RoundTrip(req)
+}
@@ -0,0 +1,275 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayBuffer(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		size  int
+		spill bool
+	}{
+		{"Empty", 0, false},
+		{"InMemory", 1000, false},
+		{"SpillsToFile", replayMemoryBytes + 1000, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			payload := bytes.Repeat([]byte("x"), test.size)
+			b := newReplayBuffer(bytes.NewReader(payload))
+			// Read half of the body, then start again.
+			rd, err := b.reader(replayMaxBytes)
+			require.NoError(t, err)
+			_, err = io.ReadFull(rd, make([]byte, test.size/2))
+			require.NoError(t, err)
+			rd, err = b.reader(replayMaxBytes)
+			require.NoError(t, err)
+			got, err := io.ReadAll(rd)
+			require.NoError(t, err)
+			assert.Equal(t, payload, got)
+			// And again, now that it has all been recorded.
+			rd, err = b.reader(0)
+			require.NoError(t, err)
+			got, err = io.ReadAll(rd)
+			require.NoError(t, err)
+			assert.Equal(t, payload, got)
+
+			assert.Equal(t, test.spill, b.file != nil)
+			var name string
+			if b.file != nil {
+				name = b.file.Name()
+			}
+			require.NoError(t, b.Close())
+			if name != "" {
+				_, err := os.Stat(name)
+				assert.ErrorIs(t, err, os.ErrNotExist, "temporary file wasn't removed")
+			}
+		})
+	}
+}
+
+func TestReplayBufferWithoutRecording(t *testing.T) {
+	b := newReplayBuffer(strings.NewReader("hello world"))
+	defer b.Close() //nolint:errcheck
+	rd, err := b.reader(replayMaxBytes)
+	require.NoError(t, err)
+	_, err = io.ReadFull(rd, make([]byte, 5))
+	require.NoError(t, err)
+	// The recorded part is replayed, and the rest comes from the source
+	// without being recorded.
+	rd, err = b.reader(0)
+	require.NoError(t, err)
+	got, err := io.ReadAll(rd)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(got))
+	_, err = b.reader(replayMaxBytes)
+	assert.ErrorIs(t, err, errBodyNotReplayable)
+}
+
+func TestReplayBufferStaleReader(t *testing.T) {
+	b := newReplayBuffer(strings.NewReader("hello world"))
+	defer b.Close() //nolint:errcheck
+	old, err := b.reader(replayMaxBytes)
+	require.NoError(t, err)
+	rd, err := b.reader(replayMaxBytes)
+	require.NoError(t, err)
+	_, err = old.Read(make([]byte, 5))
+	assert.ErrorIs(t, err, errStaleBodyReader)
+	got, err := io.ReadAll(rd)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(got))
+}
+
+func TestProxyRequestStreamsBody(t *testing.T) {
+	// The proxy reads the start of the body, and then waits for the
+	// client to send the rest. If alpaca buffered the whole body before
+	// forwarding it, the proxy would never see the start.
+	started := make(chan struct{})
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, err := io.ReadFull(req.Body, make([]byte, 5))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		close(started)
+		rest, err := io.ReadAll(req.Body)
+		if err != nil || string(rest) != " world" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+	ph := NewProxyHandler(nil, http.ProxyURL(proxyURL), func(*url.URL) {})
+	defer ph.transport.CloseIdleConnections()
+
+	pr, pw := io.Pipe()
+	req := httptest.NewRequest(http.MethodPut, "http://example.test/upload", pr)
+	req = req.WithContext(context.WithValue(req.Context(), contextKeyProxy, proxyURL))
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		ph.ServeHTTP(w, req)
+		close(done)
+	}()
+	_, err = pw.Write([]byte("hello"))
+	require.NoError(t, err)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy didn't receive the start of the body")
+	}
+	_, err = pw.Write([]byte(" world"))
+	require.NoError(t, err)
+	require.NoError(t, pw.Close())
+	<-done
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
+
+func TestReplayBufferLimit(t *testing.T) {
+	b := newReplayBuffer(strings.NewReader("hello world"))
+	defer b.Close() //nolint:errcheck
+	rd, err := b.reader(5)
+	require.NoError(t, err)
+	got, err := io.ReadAll(rd)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(got))
+	assert.LessOrEqual(t, b.size, int64(5))
+	_, err = b.reader(5)
+	assert.ErrorIs(t, err, errBodyNotReplayable)
+}
+
+// slowSource is a request body that the client sends a piece at a time.
+// Each Read signals reading, and then waits for the next piece.
+type slowSource struct {
+	reading chan struct{}
+	pieces  chan string
+}
+
+func newSlowSource() *slowSource {
+	return &slowSource{reading: make(chan struct{}, 1), pieces: make(chan string)}
+}
+
+func (s *slowSource) Read(p []byte) (int, error) {
+	s.reading <- struct{}{}
+	piece, ok := <-s.pieces
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(p, piece), nil
+}
+
+func TestReplayBufferSlowSource(t *testing.T) {
+	src := newSlowSource()
+	b := newReplayBuffer(src)
+	old, err := b.reader(replayMaxBytes)
+	require.NoError(t, err)
+	result := make(chan error, 1)
+	go func() {
+		_, err := old.Read(make([]byte, 5))
+		result <- err
+	}()
+	<-src.reading
+
+	// Starting again doesn't wait for the client to send anything, and
+	// what the old reader was waiting for still reaches the new one.
+	rd, err := b.reader(replayMaxBytes)
+	require.NoError(t, err)
+	src.pieces <- "hello"
+	assert.ErrorIs(t, <-result, errStaleBodyReader)
+	go func() {
+		<-src.reading
+		close(src.pieces)
+	}()
+	got, err := io.ReadAll(rd)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(got))
+
+	// Nor does closing the buffer.
+	src = newSlowSource()
+	defer close(src.pieces)
+	b = newReplayBuffer(src)
+	rd, err = b.reader(replayMaxBytes)
+	require.NoError(t, err)
+	go func() { _, _ = rd.Read(make([]byte, 5)) }()
+	<-src.reading
+	assert.NoError(t, b.Close())
+}
+
+func TestProactiveAuthDoesntSpillBody(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	payload := bytes.Repeat([]byte("x"), 4*replayMemoryBytes)
+	var spilled []bool
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil || !bytes.Equal(body, payload) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// The whole body has been sent, so if alpaca was going to
+		// copy it to disk, it has done so by now.
+		entries, err := os.ReadDir(tmp)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		spilled = append(spilled, len(entries) > 0)
+		if req.Header.Get("Proxy-Authorization") != "Basic ok" {
+			w.Header().Set("Proxy-Authenticate", "Basic")
+			w.WriteHeader(http.StatusProxyAuthRequired)
+		}
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+	chain := newAuthChain(realisticFake("Basic", "Basic ok"))
+	chain.known = newSchemeCache(time.Minute)
+	ph := NewProxyHandler(chain, http.ProxyURL(proxyURL), func(*url.URL) {})
+	defer ph.transport.CloseIdleConnections()
+	send := func() int {
+		req := httptest.NewRequest(http.MethodPut, "http://example.test/upload",
+			bytes.NewReader(payload))
+		req = req.WithContext(context.WithValue(req.Context(), contextKeyProxy, proxyURL))
+		w := httptest.NewRecorder()
+		ph.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Until the scheme is known, the body has to be kept in case of a
+	// 407, which it is.
+	require.Equal(t, http.StatusOK, send())
+	assert.Equal(t, []bool{true, true}, spilled)
+	// After that, it isn't copied to disk.
+	spilled = nil
+	require.Equal(t, http.StatusOK, send())
+	assert.Equal(t, []bool{false}, spilled)
+}
@@ -15,7 +15,7 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"net/http"
 )
 
@@ -33,12 +33,7 @@ func RequestLogger(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
 		next.ServeHTTP(sw, req)
-		log.Printf(
-			"[%v] %d %s %s",
-			req.Context().Value(contextKeyID),
-			sw.status,
-			req.Method,
-			req.URL,
-		)
+		slog.InfoContext(req.Context(), "Request",
+			"status", sw.status, "method", req.Method, "url", req.URL.String())
 	})
 }
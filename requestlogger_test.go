@@ -16,30 +16,45 @@ package main
 
 import (
 	"bytes"
-	"log"
+	"encoding/json"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
-	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+// captureLogs sends log output to a buffer, in JSON format, for the duration
+// of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	b := &bytes.Buffer{}
+	prev := slog.Default()
+	slog.SetDefault(newLogger(b, slog.LevelDebug, "json"))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return b
+}
+
 func TestRequestLogger(t *testing.T) {
 	tests := map[string]struct {
 		status  int
 		wrapper func(http.Handler) http.Handler
-		out     string
+		out     map[string]any
 	}{
-		"No Status":    {0, nil, "[<nil>] 200 GET /"},
-		"Given Status": {http.StatusNotFound, nil, "[<nil>] 404 GET /"},
-		"Context":      {http.StatusOK, AddContextID, "[1] 200 GET /"},
+		"No Status": {0, nil, map[string]any{
+			"status": 200.0, "method": "GET", "url": "/",
+		}},
+		"Given Status": {http.StatusNotFound, nil, map[string]any{
+			"status": 404.0, "method": "GET", "url": "/",
+		}},
+		"Context": {http.StatusOK, AddContextID, map[string]any{
+			"id": 1.0, "status": 200.0, "method": "GET", "url": "/",
+		}},
 	}
 	for name, tt := range tests {
 		t.Run(name, func(t *testing.T) {
-			b := &bytes.Buffer{}
-			log.SetOutput(b)
+			b := captureLogs(t)
 			hfunc := func(w http.ResponseWriter, req *http.Request) {
 				if tt.status != 0 {
 					w.WriteHeader(tt.status)
@@ -54,8 +69,16 @@ func TestRequestLogger(t *testing.T) {
 			defer server.Close()
 			_, err := http.Get(server.URL)
 			require.NoError(t, err)
-			log.SetOutput(os.Stderr)
-			assert.Contains(t, b.String(), tt.out)
+			server.Close()
+			var record map[string]any
+			require.NoError(t, json.Unmarshal(b.Bytes(), &record))
+			assert.Equal(t, "INFO", record["level"])
+			for key, value := range tt.out {
+				assert.Equal(t, value, record[key], key)
+			}
+			if tt.wrapper == nil {
+				assert.NotContains(t, record, "id")
+			}
 		})
 	}
 }
@@ -0,0 +1,158 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// schemeCache remembers which authentication scheme last succeeded against
+// each proxy, so that alpaca can authenticate in its first request to that
+// proxy instead of waiting for a 407 to find out what the proxy wants.
+// Entries expire after a fixed TTL, after which the next request goes
+// through the normal 407 discovery again (and so re-checks what the proxy
+// advertises).
+//
+// A scheme that the proxy rejects when it's sent proactively isn't
+// remembered again until the TTL has passed, even if it then succeeds after
+// a 407. That happens with Negotiate against an HTTPS proxy that enforces
+// channel binding (EPA): a proactive request can't include the binding,
+// since the token has to be made before the connection exists. Without
+// this, every request would cost a rejected proactive attempt as well as
+// the usual 407 exchange.
+type schemeCache struct {
+	ttl time.Duration
+	now func() time.Time // for testing
+
+	mu      sync.Mutex
+	entries map[string]schemeCacheEntry
+}
+
+type schemeCacheEntry struct {
+	scheme   string
+	rejected string // a scheme that the proxy rejected proactively
+	expires  time.Time
+}
+
+// newSchemeCache returns a cache whose entries last for ttl, or nil (which
+// remembers nothing) if ttl isn't positive.
+func newSchemeCache(ttl time.Duration) *schemeCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &schemeCache{ttl: ttl, now: time.Now, entries: make(map[string]schemeCacheEntry)}
+}
+
+// get returns the scheme that last succeeded against the given proxy, or ""
+// if there isn't one (or it has expired).
+func (sc *schemeCache) get(proxy *url.URL) string {
+	if sc == nil || proxy == nil {
+		return ""
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	entry, ok := sc.entries[proxy.Host]
+	if !ok {
+		return ""
+	} else if !sc.now().Before(entry.expires) {
+		delete(sc.entries, proxy.Host)
+		return ""
+	}
+	return entry.scheme
+}
+
+// set records that scheme succeeded against the given proxy, unless the
+// proxy has rejected it proactively (see reject).
+func (sc *schemeCache) set(proxy *url.URL, scheme string) {
+	if sc == nil || proxy == nil {
+		return
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	now := sc.now()
+	var rejected string
+	if entry, ok := sc.entries[proxy.Host]; ok && now.Before(entry.expires) {
+		if entry.rejected == scheme {
+			return
+		}
+		rejected = entry.rejected
+	}
+	sc.entries[proxy.Host] = schemeCacheEntry{scheme, rejected, now.Add(sc.ttl)}
+}
+
+// reject forgets the scheme for the given proxy, after the proxy rejected
+// it in a proactive request, and stops set from remembering it again until
+// the TTL has passed.
+func (sc *schemeCache) reject(proxy *url.URL, scheme string) {
+	if sc == nil || proxy == nil {
+		return
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.entries[proxy.Host] = schemeCacheEntry{"", scheme, sc.now().Add(sc.ttl)}
+}
+
+// remembered returns the authenticator to use in the first request to the
+// given proxy, or nil if alpaca should wait for a 407. The usual policies
+// still apply: the proxy must be in the allowlist, and the authenticator
+// must be applicable to it (e.g. Negotiate needs a ticket).
+func (c *authChain) remembered(proxy *url.URL) proxyAuthenticator {
+	if c == nil || proxy == nil {
+		return nil
+	}
+	scheme := c.known.get(proxy)
+	if scheme == "" || !c.allowedHost(proxy.Hostname()) {
+		return nil
+	}
+	for _, m := range c.methods {
+		if m.scheme() == scheme && m.applicableTo(proxy.Hostname()) {
+			return m
+		}
+	}
+	return nil
+}
+
+// remember records that scheme succeeded against the given proxy, in
+// response to a 407 that advertised the given schemes. Only a scheme that
+// the proxy actually advertised is remembered, so that (in particular)
+// Basic credentials are only ever sent proactively to a proxy that asked
+// for them.
+func (c *authChain) remember(proxy *url.URL, scheme string, advertised []string) {
+	if c == nil || scheme == "" {
+		return
+	}
+	for _, s := range advertised {
+		if strings.EqualFold(s, scheme) {
+			c.known.set(proxy, scheme)
+			return
+		}
+	}
+}
+
+// forget discards the remembered scheme for the given proxy, after the
+// proxy rejected it, and doesn't remember it again until the TTL has passed
+// (see schemeCache).
+func (c *authChain) forget(proxy *url.URL, scheme string) {
+	if c == nil || c.known == nil {
+		return
+	}
+	slog.Info("Proxy rejected remembered auth scheme; waiting for 407 from now on",
+		"proxy", proxy.Host, "scheme", scheme)
+	c.known.reject(proxy, scheme)
+}
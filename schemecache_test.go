@@ -0,0 +1,190 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemeCache(t *testing.T) {
+	proxy := &url.URL{Scheme: "http", Host: "proxy.test:3128"}
+	other := &url.URL{Scheme: "http", Host: "proxy.test:8080"}
+	now := time.Now()
+	sc := newSchemeCache(time.Minute)
+	sc.now = func() time.Time { return now }
+	assert.Equal(t, "", sc.get(proxy))
+	sc.set(proxy, "NTLM")
+	assert.Equal(t, "NTLM", sc.get(proxy))
+	assert.Equal(t, "", sc.get(other), "entries are per proxy")
+	now = now.Add(time.Minute)
+	assert.Equal(t, "", sc.get(proxy), "entry should have expired")
+	sc.set(proxy, "NTLM")
+	sc.reject(proxy, "NTLM")
+	assert.Equal(t, "", sc.get(proxy))
+	sc.set(proxy, "NTLM")
+	assert.Equal(t, "", sc.get(proxy), "rejected scheme shouldn't be remembered")
+	sc.set(proxy, "Basic")
+	assert.Equal(t, "Basic", sc.get(proxy), "other schemes can be remembered")
+	sc.set(proxy, "NTLM")
+	assert.Equal(t, "Basic", sc.get(proxy), "rejection should outlive other schemes")
+	now = now.Add(time.Minute)
+	sc.set(proxy, "NTLM")
+	assert.Equal(t, "NTLM", sc.get(proxy), "rejection should have expired")
+}
+
+func TestSchemeCacheDisabled(t *testing.T) {
+	proxy := &url.URL{Scheme: "http", Host: "proxy.test:3128"}
+	sc := newSchemeCache(0)
+	assert.Nil(t, sc)
+	sc.set(proxy, "NTLM")
+	assert.Equal(t, "", sc.get(proxy))
+	sc.reject(proxy, "NTLM")
+}
+
+func TestAuthChainRemembered(t *testing.T) {
+	proxy := &url.URL{Scheme: "http", Host: "proxy.corp.test:3128"}
+	basic := realisticFake("Basic", "Basic ok")
+	for _, test := range []struct {
+		name       string
+		advertised []string
+		allowlist  string
+		applicable bool
+		want       proxyAuthenticator
+	}{
+		{"Advertised", []string{"Negotiate", "Basic"}, "", true, basic},
+		{"NotAdvertised", []string{"Negotiate"}, "", true, nil},
+		{"NotAdvertisedAtAll", nil, "", true, nil},
+		{"CaseInsensitive", []string{"basic"}, "", true, basic},
+		{"Allowlisted", []string{"Basic"}, ".corp.test", true, basic},
+		{"NotAllowlisted", []string{"Basic"}, ".other.test", true, nil},
+		{"NotApplicable", []string{"Basic"}, "", false, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			chain := newAuthChain(basic)
+			chain.known = newSchemeCache(time.Minute)
+			chain.hostAllowlist = parseAuthAllowlist(test.allowlist)
+			basic.hostFilter = func(string) bool { return test.applicable }
+			chain.remember(proxy, "Basic", test.advertised)
+			assert.Equal(t, test.want, chain.remembered(proxy))
+		})
+	}
+}
+
+// schemeProxy is a proxy that advertises and accepts a single scheme (which
+// can be changed while it's running), and records the Proxy-Authorization
+// header of each request.
+type schemeProxy struct {
+	*httptest.Server
+	mu     sync.Mutex
+	scheme string
+	seen   []string
+}
+
+func newSchemeProxy(scheme string) *schemeProxy {
+	p := &schemeProxy{scheme: scheme}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.seen = append(p.seen, req.Header.Get("Proxy-Authorization"))
+		if req.Header.Get("Proxy-Authorization") != p.scheme+" ok" {
+			w.Header().Set("Proxy-Authenticate", p.scheme)
+			w.Header().Set("Connection", "close")
+			w.WriteHeader(http.StatusProxyAuthRequired)
+		}
+	}))
+	return p
+}
+
+func (p *schemeProxy) setScheme(scheme string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.scheme = scheme
+}
+
+// requests returns the Proxy-Authorization headers seen since the last
+// call.
+func (p *schemeProxy) requests() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	seen := p.seen
+	p.seen = nil
+	return seen
+}
+
+func TestProactiveAuth(t *testing.T) {
+	for _, method := range []string{http.MethodConnect, http.MethodGet} {
+		t.Run(method, func(t *testing.T) {
+			proxy := newSchemeProxy("Basic")
+			defer proxy.Close()
+			proxyURL, err := url.Parse(proxy.URL)
+			require.NoError(t, err)
+			chain := newAuthChain(
+				realisticFake("Negotiate", "Negotiate ok"),
+				realisticFake("Basic", "Basic ok"),
+			)
+			now := time.Now()
+			chain.known = newSchemeCache(time.Minute)
+			chain.known.now = func() time.Time { return now }
+			ph := NewProxyHandler(chain, http.ProxyURL(proxyURL), func(*url.URL) {})
+			defer ph.transport.CloseIdleConnections()
+			send := func() int {
+				if method == http.MethodConnect {
+					// A ResponseRecorder can't be hijacked, so
+					// skip handleConnect.
+					req := httptest.NewRequest(method, "example.test:443", nil)
+					conn, err := connectViaProxy(req, proxyURL, chain)
+					if err != nil {
+						return http.StatusBadGateway
+					}
+					_ = conn.Close()
+					return http.StatusOK
+				}
+				req := httptest.NewRequest(method, "http://example.test/", nil)
+				req = req.WithContext(context.WithValue(req.Context(),
+					contextKeyProxy, proxyURL))
+				w := httptest.NewRecorder()
+				ph.ServeHTTP(w, req)
+				return w.Code
+			}
+
+			// The first request discovers that the proxy wants Basic.
+			assert.Equal(t, http.StatusOK, send())
+			assert.Equal(t, []string{"", "Basic ok"}, proxy.requests())
+			// Now we know, so there's no need to wait for a 407.
+			assert.Equal(t, http.StatusOK, send())
+			assert.Equal(t, []string{"Basic ok"}, proxy.requests())
+			// If the proxy stops accepting Basic, fall back to 407
+			// discovery.
+			proxy.setScheme("Negotiate")
+			assert.Equal(t, http.StatusOK, send())
+			assert.Equal(t, []string{"Basic ok", "Negotiate ok"}, proxy.requests())
+			assert.Equal(t, http.StatusOK, send())
+			assert.Equal(t, []string{"Negotiate ok"}, proxy.requests())
+			// Once the entry has expired, wait for a 407 again.
+			now = now.Add(time.Minute)
+			assert.Equal(t, http.StatusOK, send())
+			assert.Equal(t, []string{"", "Negotiate ok"}, proxy.requests())
+		})
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// drainPollInterval is how often drain checks whether the open tunnels have
+// closed (http.Server.Shutdown polls its connections in the same way).
+const drainPollInterval = 100 * time.Millisecond
+
+// shutdown stops accepting connections, and then waits for the requests and
+// tunnels that are in progress to finish, until ctx is done. It returns the
+// exit status: 0 if everything finished in time, or 1 if some connections had
+// to be cut off.
+func shutdown(
+	ctx context.Context, s *http.Server, listeners []net.Listener, tunnels *tunnelTracker,
+) int {
+	// The HTTP server closes its own listeners, but the SOCKS5 server has
+	// no way to shut down.
+	for _, l := range listeners {
+		_ = l.Close()
+	}
+	status := 0
+	if err := s.Shutdown(ctx); err != nil {
+		slog.Warn("Closing requests that are still in progress", "error", err)
+		_ = s.Close()
+		status = 1
+	}
+	if n := tunnels.drain(ctx); n > 0 {
+		slog.Warn("Closed tunnels that were still open", "count", n)
+		status = 1
+	}
+	if status == 0 {
+		slog.Info("Shutdown complete")
+	}
+	return status
+}
+
+// activeTunnels tracks every tunnel that's open, across config reloads. Like
+// the metrics, it's package-level, since tunnels outlive the handlers that
+// opened them.
+var activeTunnels = newTunnelTracker()
+
+// tunnelTracker keeps track of open tunnels (including connections that have
+// switched protocols), so that they can be drained on shutdown. The HTTP
+// server can't do this itself, since their connections have been hijacked.
+type tunnelTracker struct {
+	mu   sync.Mutex
+	open map[*trackedTunnel]struct{}
+}
+
+type trackedTunnel struct {
+	closers []io.Closer
+}
+
+func newTunnelTracker() *tunnelTracker {
+	return &tunnelTracker{open: make(map[*trackedTunnel]struct{})}
+}
+
+// add starts tracking a tunnel, which is closed by closing each of closers.
+// The returned function must be called once the tunnel has closed.
+func (tt *tunnelTracker) add(closers ...io.Closer) (remove func()) {
+	t := &trackedTunnel{closers}
+	tt.mu.Lock()
+	tt.open[t] = struct{}{}
+	tt.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			tt.mu.Lock()
+			delete(tt.open, t)
+			tt.mu.Unlock()
+		})
+	}
+}
+
+func (tt *tunnelTracker) count() int {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	return len(tt.open)
+}
+
+// drain waits for the open tunnels to close by themselves, until ctx is done,
+// and then closes any that are still open. It returns the number of tunnels
+// that it had to close.
+func (tt *tunnelTracker) drain(ctx context.Context) int {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for tt.count() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return tt.closeAll()
+		}
+	}
+	return 0
+}
+
+func (tt *tunnelTracker) closeAll() int {
+	tt.mu.Lock()
+	open := make([]*trackedTunnel, 0, len(tt.open))
+	for t := range tt.open {
+		open = append(open, t)
+	}
+	tt.mu.Unlock()
+	for _, t := range open {
+		for _, c := range t.closers {
+			_ = c.Close()
+		}
+	}
+	return len(open)
+}
+
+// trackConn returns conn, tracked as a tunnel until it's closed. It's used for
+// the SOCKS5 server, which does its own copying.
+func trackConn(tt *tunnelTracker, conn net.Conn) net.Conn {
+	return &onCloseConn{conn, tt.add(conn)}
+}
+
+// onCloseConn is a connection that calls onClose when it's closed. onClose
+// may be called more than once, so it has to be idempotent.
+type onCloseConn struct {
+	net.Conn
+	onClose func()
+}
+
+func (c *onCloseConn) Close() error {
+	c.onClose()
+	return c.Conn.Close()
+}
@@ -0,0 +1,116 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelTrackerDrain(t *testing.T) {
+	tt := newTunnelTracker()
+	client, server := net.Pipe()
+	remove := tt.add(client, server)
+	assert.Equal(t, 1, tt.count())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		remove()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Equal(t, 0, tt.drain(ctx))
+	assert.Equal(t, 0, tt.count())
+	// The tunnel closed by itself, so it wasn't closed by drain.
+	go func() { _, _ = server.Write([]byte("x")) }()
+	_, err := client.Read(make([]byte, 1))
+	assert.NoError(t, err)
+}
+
+func TestTunnelTrackerDrainTimeout(t *testing.T) {
+	tt := newTunnelTracker()
+	client, server := net.Pipe()
+	remove := tt.add(client, server)
+	defer remove()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, 1, tt.drain(ctx))
+	_, err := client.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+func TestTrackedConn(t *testing.T) {
+	tt := newTunnelTracker()
+	client, server := net.Pipe()
+	defer server.Close() //nolint:errcheck
+	conn := trackConn(tt, client)
+	assert.Equal(t, 1, tt.count())
+	require.NoError(t, conn.Close())
+	assert.Equal(t, 0, tt.count())
+}
+
+func TestShutdown(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		delay   time.Duration
+		timeout time.Duration
+		status  int
+	}{
+		{"Drained", 50 * time.Millisecond, 5 * time.Second, 0},
+		{"TimedOut", 5 * time.Second, 50 * time.Millisecond, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			started := make(chan struct{})
+			s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				close(started)
+				select {
+				case <-time.After(test.delay):
+				case <-req.Context().Done():
+				}
+			})}
+			go func() { _ = s.Serve(l) }()
+			done := make(chan error, 1)
+			go func() {
+				resp, err := http.Get("http://" + l.Addr().String())
+				if err == nil {
+					_ = resp.Body.Close()
+				}
+				done <- err
+			}()
+			<-started
+
+			tt := newTunnelTracker()
+			ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+			defer cancel()
+			assert.Equal(t, test.status, shutdown(ctx, s, []net.Listener{l}, tt))
+			err = <-done
+			if test.status == 0 {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+			// New connections are refused.
+			_, err = net.Dial("tcp", l.Addr().String())
+			assert.Error(t, err)
+		})
+	}
+}
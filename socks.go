@@ -0,0 +1,84 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/things-go/go-socks5"
+)
+
+var errTooManyTunnels = errors.New("client has too many open tunnels")
+
+// newSocksServer returns a SOCKS5 server (RFC 1928) that supports the
+// CONNECT command only. UDP ASSOCIATE and BIND aren't supported, since an
+// HTTP proxy has no way to carry them, and relaying them directly would
+// bypass the PAC file. If credentials isn't nil, clients have to log in with
+// a user name and password (RFC 1929).
+func newSocksServer(
+	dial func(context.Context, string, string) (net.Conn, error),
+	credentials socks5.CredentialStore,
+) *socks5.Server {
+	opts := []socks5.Option{
+		socks5.WithDialAndRequest(func(
+			ctx context.Context, network, addr string, req *socks5.Request,
+		) (net.Conn, error) {
+			release, ok := tunnelLimits.acquire(req.RemoteAddr.String())
+			if !ok {
+				slog.Warn("Rejected SOCKS5 request from client with too many "+
+					"open tunnels", "client", req.RemoteAddr.String())
+				return nil, errTooManyTunnels
+			}
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				release()
+				return nil, err
+			}
+			// The server closes the connection once the client has
+			// gone, so tracking it tracks the whole tunnel.
+			conn = &onCloseConn{conn, release}
+			return trackConn(activeTunnels, watchIdle(conn, tunnelIdleTimeout)), nil
+		}),
+		socks5.WithResolver(socksResolver{}),
+		socks5.WithRule(&socks5.PermitCommand{EnableConnect: true}),
+		socks5.WithLogger(socksLogger{}),
+	}
+	if credentials != nil {
+		opts = append(opts, socks5.WithCredential(credentials))
+	}
+	return socks5.NewServer(opts...)
+}
+
+// socksResolver leaves host names unresolved, so that the PAC file sees the
+// name that the client asked for, and so that a proxy can resolve a name
+// that only it knows about.
+type socksResolver struct{}
+
+func (socksResolver) Resolve(ctx context.Context, _ string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
+}
+
+// socksLogger sends the SOCKS5 server's logs to slog. They're mostly about
+// clients going away, and failed dials (which have already been logged), so
+// they're only logged at debug level.
+type socksLogger struct{}
+
+func (socksLogger) Errorf(format string, args ...any) {
+	slog.Debug("SOCKS5 server error", "error", fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,141 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+// echoServer accepts TCP connections and echoes everything back.
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close() //nolint:errcheck
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+// tunnelProxy is a proxy that asks for "Test" auth, and then tunnels every
+// CONNECT to target, whatever host was asked for. It records the hosts.
+type tunnelProxy struct {
+	*httptest.Server
+	mu    sync.Mutex
+	hosts []string
+}
+
+func newTunnelProxy(t *testing.T, target string) *tunnelProxy {
+	p := &tunnelProxy{}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Proxy-Authorization") != "Test ok" {
+			w.Header().Set("Proxy-Authenticate", "Test")
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		p.mu.Lock()
+		p.hosts = append(p.hosts, req.Host)
+		p.mu.Unlock()
+		server, err := net.Dial("tcp", target)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		client, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			_ = server.Close()
+			return
+		}
+		_, _ = fmt.Fprint(client, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		splice(client, server)
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+func TestSocksListener(t *testing.T) {
+	target := echoServer(t)
+	upstream := newTunnelProxy(t, target.Addr().String())
+	pac := fmt.Sprintf(`function FindProxyForURL(url, host) {
+		if (host == "127.0.0.1") return "DIRECT";
+		return "PROXY %s";
+	}`, upstream.Listener.Addr())
+	pacServer := httptest.NewServer(pacjsHandler(pac))
+	defer pacServer.Close()
+
+	pw := NewPACWrapper(PACData{Port: 1})
+	pf := NewProxyFinder(pacServer.URL, false, pw, false)
+	auth := realisticFake("Test", "Test ok")
+	ph := NewProxyHandler(newAuthChain(auth), getProxyFromContext, pf.blockProxy)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close() //nolint:errcheck
+	go func() { _ = newSocksServer((&tunnelDialer{pf, ph}).dial, nil).Serve(l) }()
+	client, err := proxy.SOCKS5("tcp", l.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(target.Addr().String())
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		name  string
+		host  string
+		calls int32
+		hosts []string
+	}{
+		// The host name isn't resolved, so the PAC file sees it (and
+		// sends it to the proxy).
+		{"ViaProxy", "target.test", 1, []string{"target.test:" + port}},
+		{"Direct", "127.0.0.1", 0, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			auth.calls.Store(0)
+			upstream.mu.Lock()
+			upstream.hosts = nil
+			upstream.mu.Unlock()
+			conn, err := client.Dial("tcp", net.JoinHostPort(test.host, port))
+			require.NoError(t, err)
+			defer conn.Close() //nolint:errcheck
+			_, err = conn.Write([]byte("hello"))
+			require.NoError(t, err)
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(conn, buf)
+			require.NoError(t, err)
+			assert.Equal(t, "hello", string(buf))
+			assert.Equal(t, test.calls, auth.calls.Load())
+			upstream.mu.Lock()
+			defer upstream.mu.Unlock()
+			assert.Equal(t, test.hosts, upstream.hosts)
+		})
+	}
+}
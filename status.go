@@ -0,0 +1,91 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// status is the JSON document served at /alpaca/status. It's meant to answer
+// "why did my request go DIRECT (or via that proxy)?" without digging through
+// the logs. It must never contain secrets: authenticators are described by
+// their scheme only.
+type status struct {
+	PAC     pacStatus            `json:"pac"`
+	Blocked map[string]time.Time `json:"blocked"`
+	Auth    authStatus           `json:"auth"`
+	Network networkStatus        `json:"network"`
+}
+
+type pacStatus struct {
+	URL       string    `json:"url"`
+	Fetched   time.Time `json:"fetched,omitzero"`
+	Expires   time.Time `json:"expires,omitzero"`
+	Connected bool      `json:"connected"`
+	// Stale is set if the PAC script came from the disk cache, because
+	// the PAC server couldn't be reached.
+	Stale bool `json:"stale,omitempty"`
+}
+
+type authStatus struct {
+	Methods   []string `json:"methods"`
+	Allowlist []string `json:"allowlist"`
+}
+
+type networkStatus struct {
+	Addrs  []string          `json:"addrs"`
+	Routes map[string]string `json:"routes"`
+}
+
+type statusHandler struct {
+	finder *ProxyFinder
+	auth   *authChain
+}
+
+func newStatusHandler(finder *ProxyFinder, auth *authChain) *statusHandler {
+	return &statusHandler{finder: finder, auth: auth}
+}
+
+func (sh *statusHandler) SetupHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/alpaca/status", sh.handleStatus)
+}
+
+func (sh *statusHandler) status() status {
+	st := sh.finder.status()
+	st.Auth.Methods = []string{}
+	if sh.auth != nil {
+		for _, method := range sh.auth.methods {
+			st.Auth.Methods = append(st.Auth.Methods, method.scheme())
+		}
+		st.Auth.Allowlist = sh.auth.hostAllowlist
+	}
+	return st
+}
+
+func (sh *statusHandler) handleStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(sh.status()); err != nil {
+		slog.ErrorContext(req.Context(), "Error writing status to response", "error", err)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatus(t *testing.T) {
+	js := `function FindProxyForURL(url, host) { return "PROXY proxy.test:3128" }`
+	pacServer := httptest.NewServer(pacjsHandler(js))
+	defer pacServer.Close()
+	finder := NewProxyFinder(pacServer.URL, false, NewPACWrapper(PACData{Port: 1}), false)
+	finder.blockProxy(&url.URL{Host: "proxy.test:3128"})
+	auth := newAuthChain(newBasicAuthenticator("malory:guest"))
+	auth.hostAllowlist = parseAuthAllowlist(".test")
+	mux := http.NewServeMux()
+	newStatusHandler(finder, auth).SetupHandlers(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/alpaca/status")
+	require.NoError(t, err)
+	defer resp.Body.Close() //nolint:errcheck
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.NotContains(t, string(body), "guest")
+	assert.NotContains(t, string(body), newBasicAuthenticator("malory:guest").encoded)
+
+	var st status
+	require.NoError(t, json.Unmarshal(body, &st))
+	assert.Equal(t, pacServer.URL, st.PAC.URL)
+	assert.True(t, st.PAC.Connected)
+	assert.False(t, st.PAC.Fetched.IsZero())
+	assert.Contains(t, st.Blocked, "proxy.test:3128")
+	assert.Equal(t, []string{"Basic"}, st.Auth.Methods)
+	assert.Equal(t, []string{".test"}, st.Auth.Allowlist)
+}
+
+func TestStatusWithoutAuth(t *testing.T) {
+	finder := NewProxyFinder("http://pacserver.invalid/nonexistent.pac", false,
+		NewPACWrapper(PACData{Port: 1}), false)
+	st := newStatusHandler(finder, nil).status()
+	assert.False(t, st.PAC.Connected)
+	assert.Empty(t, st.Blocked)
+	assert.Empty(t, st.Auth.Methods)
+}
+
+func TestStatusMethodNotAllowed(t *testing.T) {
+	finder := NewProxyFinder("http://pacserver.invalid/nonexistent.pac", false,
+		NewPACWrapper(PACData{Port: 1}), false)
+	mux := http.NewServeMux()
+	newStatusHandler(finder, nil).SetupHandlers(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/alpaca/status", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
@@ -0,0 +1,265 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const contextKeyOriginalDst = contextKey("originalDst")
+
+// transparentSniffTimeout is how long a redirected client has to send the
+// first bytes of its request (or its TLS ClientHello), which are needed to
+// find out the host that it's trying to reach.
+const transparentSniffTimeout = 10 * time.Second
+
+// recordTypeHandshake is the first byte of a TLS connection (RFC 8446 §5.1).
+const recordTypeHandshake = 0x16
+
+var errTransparentUnsupported = errors.New("transparent mode is only supported on Linux")
+
+// transparentListener accepts connections that a firewall rule (e.g. the
+// iptables REDIRECT target) has sent to alpaca from clients that don't know
+// that they're using a proxy. TLS connections are tunnelled to the host named
+// in the ClientHello's SNI extension, and anything else is returned from
+// Accept, for the HTTP server to proxy like any other request.
+type transparentListener struct {
+	net.Listener
+	dial        func(context.Context, string, string) (net.Conn, error)
+	originalDst func(net.Conn) (netip.AddrPort, error)
+	conns       chan net.Conn
+	done        chan struct{}
+	closeOnce   sync.Once
+	err         error
+}
+
+func newTransparentListener(
+	l net.Listener,
+	originalDst func(net.Conn) (netip.AddrPort, error),
+	dial func(context.Context, string, string) (net.Conn, error),
+) *transparentListener {
+	tl := &transparentListener{
+		Listener:    l,
+		dial:        dial,
+		originalDst: originalDst,
+		conns:       make(chan net.Conn),
+		done:        make(chan struct{}),
+	}
+	go tl.run()
+	return tl
+}
+
+func (l *transparentListener) run() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.close(err)
+			return
+		}
+		// Sniffing waits for the client, so it mustn't hold up Accept.
+		go l.handle(conn)
+	}
+}
+
+func (l *transparentListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *transparentListener) Close() error {
+	return l.close(net.ErrClosed)
+}
+
+func (l *transparentListener) close(err error) error {
+	var closeErr error
+	l.closeOnce.Do(func() {
+		l.err = err
+		close(l.done)
+		closeErr = l.Listener.Close()
+	})
+	return closeErr
+}
+
+func (l *transparentListener) handle(conn net.Conn) {
+	dst, err := l.originalDst(conn)
+	if err != nil {
+		slog.Error("Error getting original destination", "error", err)
+		_ = conn.Close()
+		return
+	}
+	// Without a REDIRECT rule, the original destination is alpaca itself;
+	// tunnelling that would loop forever.
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if ok && unmap(local.AddrPort()) == unmap(dst) {
+		slog.Warn("Rejecting connection that wasn't redirected",
+			"client", conn.RemoteAddr().String())
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(transparentSniffTimeout))
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	if first[0] != recordTypeHandshake {
+		_ = conn.SetReadDeadline(time.Time{})
+		select {
+		case l.conns <- &transparentConn{hijackedConn{conn, br}, dst}:
+		case <-l.done:
+			_ = conn.Close()
+		}
+		return
+	}
+	// Keep a copy of everything that's read while looking for the server
+	// name, so that it can be sent on once the tunnel is open.
+	var hello bytes.Buffer
+	sni, err := readSNI(io.TeeReader(br, &hello))
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		slog.Debug("Error reading TLS ClientHello", "client", conn.RemoteAddr().String(),
+			"error", err)
+		_ = conn.Close()
+		return
+	}
+	host := sni
+	if host == "" {
+		host = dst.Addr().Unmap().String()
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(dst.Port())))
+	release, ok := tunnelLimits.acquire(conn.RemoteAddr().String())
+	if !ok {
+		slog.Warn("Rejected connection from client with too many open tunnels",
+			"client", conn.RemoteAddr().String())
+		_ = conn.Close()
+		return
+	}
+	server, err := l.dial(context.Background(), "tcp", addr)
+	if err != nil {
+		release()
+		slog.Error("Error opening tunnel for redirected connection", "host", addr,
+			"error", err)
+		_ = conn.Close()
+		return
+	}
+	server = &onCloseConn{server, release}
+	if _, err := server.Write(hello.Bytes()); err != nil {
+		slog.Error("Error writing TLS ClientHello", "host", addr, "error", err)
+		_ = server.Close()
+		_ = conn.Close()
+		return
+	}
+	splice(&hijackedConn{conn, br}, server)
+}
+
+func unmap(addr netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
+
+// transparentConn is a redirected connection that's served as HTTP. It
+// remembers where the client was trying to connect to, for requests that
+// don't have a Host header.
+type transparentConn struct {
+	hijackedConn
+	dst netip.AddrPort
+}
+
+// transparentContext is the http.Server's ConnContext hook. It records the
+// original destination of connections from a transparentListener.
+func transparentContext(ctx context.Context, conn net.Conn) context.Context {
+	if tc, ok := conn.(*transparentConn); ok {
+		return context.WithValue(ctx, contextKeyOriginalDst, tc.dst)
+	}
+	return ctx
+}
+
+// transparentHTTP turns requests from redirected connections, which are in
+// origin form (e.g. "GET /index.html"), into proxy requests by filling in the
+// scheme and host, so that they're routed by the PAC file like any other
+// request. Other requests are passed on unchanged.
+func transparentHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		dst, ok := req.Context().Value(contextKeyOriginalDst).(netip.AddrPort)
+		if ok && req.URL.Scheme == "" && req.Method != http.MethodConnect {
+			req.URL.Scheme = "http"
+			req.URL.Host = transparentHost(req.Host, dst)
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// transparentHost returns the host (and port, unless it's 80) that a
+// redirected HTTP request was for. HTTP/1.0 clients may not send a Host
+// header, in which case the original destination address is used.
+func transparentHost(host string, dst netip.AddrPort) string {
+	if host == "" {
+		addr := dst.Addr().Unmap()
+		host = addr.String()
+		if addr.Is6() {
+			host = "[" + host + "]"
+		}
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil || dst.Port() == 80 {
+		return host
+	}
+	return host + ":" + strconv.Itoa(int(dst.Port()))
+}
+
+// readSNI reads a TLS ClientHello from r, and returns the server name that
+// it asks for, or "" if it doesn't include one (e.g. when the client is
+// connecting to an IP address).
+func readSNI(r io.Reader) (string, error) {
+	var sni string
+	seen := false
+	errDone := errors.New("read ClientHello")
+	err := tls.Server(sniffConn{r: r}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni, seen = hello.ServerName, true
+			return nil, errDone
+		},
+	}).Handshake()
+	if seen {
+		return sni, nil
+	}
+	return "", err
+}
+
+// sniffConn is the read-only connection that readSNI hands to the TLS
+// server. Only Read and Write are ever called on it; anything the server
+// tries to write (i.e. an alert) is dropped.
+type sniffConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c sniffConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c sniffConn) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
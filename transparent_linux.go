@@ -0,0 +1,79 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+
+	"golang.org/x/sys/unix"
+)
+
+const transparentSupported = true
+
+// ip6tSoOriginalDst is IP6T_SO_ORIGINAL_DST from <linux/netfilter_ipv6/ip6_tables.h>,
+// which golang.org/x/sys/unix doesn't define.
+const ip6tSoOriginalDst = 80
+
+// originalDst returns the address that a connection which was redirected to
+// alpaca by netfilter (e.g. with iptables' REDIRECT target) was originally
+// sent to, using the SO_ORIGINAL_DST socket option.
+func originalDst(conn net.Conn) (netip.AddrPort, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return netip.AddrPort{}, errors.New("not a TCP connection")
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	var dst netip.AddrPort
+	var sockErr error
+	local, _ := tc.LocalAddr().(*net.TCPAddr)
+	err = rc.Control(func(fd uintptr) {
+		if local != nil && local.IP.To4() != nil {
+			// The option fills in a struct sockaddr_in, which is the same
+			// size as a struct ipv6_mreq.
+			var mreq *unix.IPv6Mreq
+			mreq, sockErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+			if sockErr == nil {
+				sa := mreq.Multiaddr
+				dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(sa[4:8])),
+					binary.BigEndian.Uint16(sa[2:4]))
+			}
+			return
+		}
+		// Likewise, a struct sockaddr_in6 is the same size as a struct
+		// ip6_mtuinfo, which starts with one.
+		var info *unix.IPv6MTUInfo
+		info, sockErr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSoOriginalDst)
+		if sockErr == nil {
+			// The port is in network byte order.
+			port := binary.NativeEndian.AppendUint16(nil, info.Addr.Port)
+			dst = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr),
+				binary.BigEndian.Uint16(port))
+		}
+	})
+	if err != nil {
+		return netip.AddrPort{}, err
+	} else if errors.Is(sockErr, unix.ENOENT) {
+		// There's no conntrack entry, e.g. because the client connected
+		// to alpaca's port directly.
+		return netip.AddrPort{}, errors.New("connection wasn't redirected by netfilter")
+	}
+	return dst, sockErr
+}
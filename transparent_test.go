@@ -0,0 +1,171 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadSNI(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		serverName string
+	}{
+		{"WithName", "example.test"},
+		{"WithoutName", ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close() //nolint:errcheck
+			go func() {
+				tlsClient := tls.Client(client, &tls.Config{
+					ServerName:         test.serverName,
+					InsecureSkipVerify: true, //nolint:gosec
+				})
+				_ = tlsClient.Handshake()
+			}()
+			sni, err := readSNI(server)
+			_ = server.Close()
+			require.NoError(t, err)
+			assert.Equal(t, test.serverName, sni)
+		})
+	}
+}
+
+func TestReadSNINotTLS(t *testing.T) {
+	_, err := readSNI(io.LimitReader(neverEnding('x'), 1024))
+	assert.Error(t, err)
+}
+
+type neverEnding byte
+
+func (b neverEnding) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(b)
+	}
+	return len(p), nil
+}
+
+func TestTransparentHost(t *testing.T) {
+	for _, test := range []struct {
+		host, dst, want string
+	}{
+		{"example.test", "192.0.2.1:80", "example.test"},
+		{"example.test", "192.0.2.1:8080", "example.test:8080"},
+		{"example.test:8080", "192.0.2.1:8080", "example.test:8080"},
+		{"", "192.0.2.1:80", "192.0.2.1"},
+		{"", "192.0.2.1:8080", "192.0.2.1:8080"},
+		{"", "[2001:db8::1]:80", "[2001:db8::1]"},
+		{"", "[::ffff:192.0.2.1]:80", "192.0.2.1"},
+		{"[2001:db8::1]", "[2001:db8::1]:8080", "[2001:db8::1]:8080"},
+	} {
+		dst := netip.MustParseAddrPort(test.dst)
+		assert.Equal(t, test.want, transparentHost(test.host, dst),
+			"Host: %q, destination: %s", test.host, test.dst)
+	}
+}
+
+func TestTransparentListener(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = fmt.Fprintf(w, "hello %s", req.Host)
+	}))
+	defer target.Close()
+	upstream := newTunnelProxy(t, target.Listener.Addr().String())
+	httpProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = fmt.Fprint(w, req.URL.String())
+	}))
+	defer httpProxy.Close()
+	pac := fmt.Sprintf(`function FindProxyForURL(url, host) {
+		if (url.substring(0, 5) == "http:") return "PROXY %s";
+		return "PROXY %s";
+	}`, httpProxy.Listener.Addr(), upstream.Listener.Addr())
+	pacServer := httptest.NewServer(pacjsHandler(pac))
+	defer pacServer.Close()
+
+	pw := NewPACWrapper(PACData{Port: 1})
+	pf := NewProxyFinder(pacServer.URL, false, pw, false)
+	auth := realisticFake("Test", "Test ok")
+	ph := NewProxyHandler(newAuthChain(auth), getProxyFromContext, pf.blockProxy)
+	defer ph.transport.CloseIdleConnections()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	// There's no REDIRECT rule here, so pretend that every connection was
+	// redirected from dst.
+	var dst atomic.Pointer[netip.AddrPort]
+	tl := newTransparentListener(l, func(net.Conn) (netip.AddrPort, error) {
+		return *dst.Load(), nil
+	}, (&tunnelDialer{pf, ph}).dial)
+	handler := pf.WrapHandler(ph.WrapHandler(http.NotFoundHandler()))
+	s := createServer(handler, new(reloadableAccess), limits{}, false)
+	go func() { _ = s.Serve(tl) }()
+	defer s.Close() //nolint:errcheck
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, l.Addr().String())
+		},
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true}, //nolint:gosec
+		DisableKeepAlives: true,
+	}}
+
+	for _, test := range []struct {
+		name  string
+		dst   string
+		url   string
+		want  string
+		hosts []string
+	}{
+		{"TLS", "192.0.2.1:443", "https://target.test/", "hello target.test",
+			[]string{"target.test:443"}},
+		{"TLSWithoutSNI", "192.0.2.1:443", "https://192.0.2.1/", "hello 192.0.2.1",
+			[]string{"192.0.2.1:443"}},
+		{"HTTP", "192.0.2.1:80", "http://target.test/path", "http://target.test/path", nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			addr := netip.MustParseAddrPort(test.dst)
+			dst.Store(&addr)
+			upstream.mu.Lock()
+			upstream.hosts = nil
+			upstream.mu.Unlock()
+			resp, err := client.Get(test.url)
+			require.NoError(t, err)
+			defer resp.Body.Close() //nolint:errcheck
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, test.want, string(body))
+			upstream.mu.Lock()
+			defer upstream.mu.Unlock()
+			assert.Equal(t, test.hosts, upstream.hosts)
+		})
+	}
+
+	t.Run("NotRedirected", func(t *testing.T) {
+		addr := netip.MustParseAddrPort(l.Addr().String())
+		dst.Store(&addr)
+		_, err := client.Get("http://target.test/")
+		assert.Error(t, err)
+	})
+}
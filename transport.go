@@ -21,6 +21,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"time"
 )
 
 // transport creates and manages the lifetime of a net.Conn. Between the time that a remote server
@@ -29,6 +30,9 @@ import (
 type transport struct {
 	conn   net.Conn
 	reader *bufio.Reader
+	// deadline applies to every connection that's dialled, until the
+	// connection is hijacked (see setDeadline).
+	deadline time.Time
 }
 
 func (t *transport) dial(proxy *url.URL) error {
@@ -41,13 +45,14 @@ func (t *transport) dial(proxy *url.URL) error {
 	var conn net.Conn
 	var err error
 	if proxy.Scheme == "https" {
-		conn, err = tls.Dial("tcp", proxy.Host, tlsClientConfig)
+		conn, err = tls.DialWithDialer(netDialer, "tcp", proxy.Host, tlsClientConfig)
 	} else {
-		conn, err = net.Dial("tcp", proxy.Host)
+		conn, err = netDialer.Dial("tcp", proxy.Host)
 	}
 	if err != nil {
 		return &net.OpError{Op: "proxyconnect", Net: "tcp", Err: err}
 	}
+	_ = conn.SetDeadline(t.deadline)
 	t.conn = conn
 	t.reader = bufio.NewReader(conn)
 	return nil
@@ -60,14 +65,47 @@ func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	if err := req.Write(t.conn); err != nil {
 		return nil, err
 	}
-	return http.ReadResponse(t.reader, req)
+	resp, err := http.ReadResponse(t.reader, req)
+	if err != nil {
+		return nil, err
+	}
+	// Like http.Transport, record the TLS connection that the response
+	// came over, which authenticators need for channel binding.
+	resp.TLS = t.tlsState()
+	return resp, nil
 }
 
+// tlsState returns the state of the TLS connection to the proxy, or nil if
+// the proxy doesn't use TLS.
+func (t *transport) tlsState() *tls.ConnectionState {
+	conn, ok := t.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := conn.ConnectionState()
+	return &state
+}
+
+// setDeadline sets a deadline for reading and writing on the connection,
+// and on any connection that's dialled later. The zero time means no
+// deadline.
+func (t *transport) setDeadline(deadline time.Time) {
+	t.deadline = deadline
+	if t.conn != nil {
+		_ = t.conn.SetDeadline(deadline)
+	}
+}
+
+// hijack takes the connection away from the transport, without any deadline
+// that was set.
 func (t *transport) hijack() net.Conn {
 	defer func() {
 		t.conn = nil
 		t.reader = nil
 	}()
+	if t.conn != nil {
+		_ = t.conn.SetDeadline(time.Time{})
+	}
 	return t.conn
 }
 
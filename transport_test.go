@@ -17,10 +17,12 @@ package main
 import (
 	"bufio"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -85,3 +87,35 @@ func TestTransportErrors(t *testing.T) {
 		assert.NoError(t, tr.Close())
 	})
 }
+
+func TestTransportDeadline(t *testing.T) {
+	// A proxy that accepts connections, but never answers.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close() //nolint:errcheck
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close() //nolint:errcheck
+		}
+	}()
+	var tr transport
+	defer tr.Close() //nolint:errcheck
+	tr.setDeadline(time.Now().Add(100 * time.Millisecond))
+	require.NoError(t, tr.dial(&url.URL{Host: l.Addr().String()}))
+	req, err := http.NewRequest(http.MethodConnect, "http://alpaca.test", nil)
+	require.NoError(t, err)
+	_, err = tr.RoundTrip(req)
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+	// Once hijacked, the connection has no deadline.
+	tr.setDeadline(time.Now().Add(-time.Second))
+	conn := tr.hijack()
+	defer conn.Close() //nolint:errcheck
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+}
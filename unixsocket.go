@@ -0,0 +1,149 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// listenUnix listens on a unix socket at path, with the given mode and (if
+// owner isn't empty) owner. A socket that was left behind by an earlier run
+// is replaced, as long as nothing is listening on it.
+//
+// The socket is created in a private directory next to path, and only moved
+// into place once it has the right mode and owner. Otherwise, it would get
+// its permissions from the umask at first, and other users could connect
+// before it was chmodded.
+func listenUnix(path string, mode fs.FileMode, owner string) (net.Listener, error) {
+	uid, gid := -1, -1
+	if owner != "" {
+		var err error
+		if uid, gid, err = lookupOwner(owner); err != nil {
+			return nil, err
+		}
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode().Type() == fs.ModeSocket {
+		if conn, err := net.Dial("unix", path); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("unix socket %s is already in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	// Keep the names short, since a socket's path can't be much longer
+	// than 100 bytes.
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".alpaca")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir) //nolint:errcheck
+	tmp := filepath.Join(dir, "s")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket won't be at tmp by the time the listener is closed.
+	l.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, mode); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(tmp, uid, gid); err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	return &unixListener{l, path}, nil
+}
+
+// unixListener is a listener on a unix socket that was moved to path after
+// it was created. It removes the socket when it's closed, as a
+// net.UnixListener would have done if it hadn't been moved.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	if err == nil {
+		_ = os.Remove(l.path)
+	}
+	return err
+}
+
+// lookupOwner parses an owner in chown(1)'s "user[:group]" form, where
+// either part may be a name or a numeric ID, and returns the user and group
+// IDs. It returns -1 for a part that's left out.
+func lookupOwner(owner string) (uid, gid int, err error) {
+	userPart, groupPart, _ := strings.Cut(owner, ":")
+	uid, gid = -1, -1
+	if userPart != "" {
+		if uid, err = lookupID(userPart, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		}); err != nil {
+			return -1, -1, err
+		}
+	}
+	if groupPart != "" {
+		if gid, err = lookupID(groupPart, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		}); err != nil {
+			return -1, -1, err
+		}
+	}
+	if uid == -1 && gid == -1 {
+		return -1, -1, errors.New("invalid unix socket owner: " + strconv.Quote(owner))
+	}
+	return uid, gid, nil
+}
+
+func lookupID(nameOrID string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(nameOrID); err == nil && id >= 0 {
+		return id, nil
+	}
+	id, err := lookup(nameOrID)
+	if err != nil {
+		return -1, err
+	}
+	// On Windows, the IDs are SIDs, which can't be used with os.Chown.
+	return strconv.Atoi(id)
+}
@@ -0,0 +1,123 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// socketPath returns a path for a unix socket. It doesn't use t.TempDir(),
+// since the test name would make the path too long on macOS.
+func socketPath(t *testing.T) string {
+	dir, err := os.MkdirTemp("", "alpaca")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return filepath.Join(dir, "alpaca.sock")
+}
+
+func TestListenUnix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket permissions aren't supported on Windows")
+	}
+	path := socketPath(t)
+	l, err := listenUnix(path, 0o660, "")
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o660), info.Mode().Perm())
+
+	assert.Equal(t, path, l.Addr().String())
+	// The socket was created in a private directory and then moved into
+	// place, and the directory has been removed.
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "alpaca.sock", entries[0].Name())
+
+	// A second listener on the same path is refused while the first is
+	// still listening.
+	_, err = listenUnix(path, 0o600, "")
+	assert.Error(t, err)
+	require.NoError(t, l.Close())
+	_, err = os.Lstat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist, "socket wasn't removed")
+}
+
+func TestListenUnixReplacesStaleSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket permissions aren't supported on Windows")
+	}
+	path := socketPath(t)
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	// Leave the socket file behind, as a crashed process would.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, l.Close())
+
+	l, err = listenUnix(path, 0o600, "")
+	require.NoError(t, err)
+	defer l.Close() //nolint:errcheck
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	_ = conn.Close()
+}
+
+func TestLookupOwner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("user and group IDs are SIDs on Windows")
+	}
+	me, err := user.Current()
+	require.NoError(t, err)
+	group, err := user.LookupGroupId(me.Gid)
+	require.NoError(t, err)
+	uid, err := strconv.Atoi(me.Uid)
+	require.NoError(t, err)
+	gid, err := strconv.Atoi(me.Gid)
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		owner    string
+		uid, gid int
+	}{
+		{me.Username, uid, -1},
+		{me.Username + ":" + group.Name, uid, gid},
+		{":" + group.Name, -1, gid},
+		{me.Uid + ":" + me.Gid, uid, gid},
+	} {
+		gotUID, gotGID, err := lookupOwner(test.owner)
+		require.NoError(t, err, test.owner)
+		assert.Equal(t, test.uid, gotUID, test.owner)
+		assert.Equal(t, test.gid, gotGID, test.owner)
+	}
+	for _, owner := range []string{":", "no-such-user.test"} {
+		_, _, err := lookupOwner(owner)
+		assert.Error(t, err, owner)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// upgradeType returns the protocol that a request (or response) asks to
+// switch to, e.g. "websocket", or "" if it isn't an Upgrade request.
+func upgradeType(header http.Header) string {
+	if !httpguts.HeaderValuesContainsToken(header["Connection"], "Upgrade") {
+		return ""
+	}
+	return header.Get("Upgrade")
+}
+
+// switchProtocols completes a switch to another protocol (RFC 9110 §7.8):
+// it sends the proxy's 101 (Switching Protocols) response on to the client,
+// and then splices the client's connection to the proxy's, like
+// handleConnect does for a tunnel. It takes ownership of resp.Body.
+func switchProtocols(w http.ResponseWriter, req *http.Request, resp *http.Response) {
+	ctx := req.Context()
+	want, got := upgradeType(req.Header), upgradeType(resp.Header)
+	server, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok || want == "" || !strings.EqualFold(want, got) {
+		_ = resp.Body.Close()
+		slog.ErrorContext(ctx, "Unexpected protocol switch",
+			"requested", want, "switched", got)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	closeInDefer := true
+	defer func() {
+		if closeInDefer {
+			_ = server.Close()
+		}
+	}()
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		slog.ErrorContext(ctx, "Error hijacking response writer")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error hijacking connection", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// The client may have sent data in the new protocol straight after
+	// its request, which the server may have already buffered.
+	client := &hijackedConn{conn, brw.Reader}
+	header := resp.Header.Clone()
+	deleteResponseHeaders(header)
+	header.Set("Connection", "Upgrade")
+	header.Set("Upgrade", got)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/1.1 %s\r\n", resp.Status)
+	_ = header.Write(&buf)
+	buf.WriteString("\r\n")
+	if _, err := client.Write(buf.Bytes()); err != nil {
+		slog.ErrorContext(ctx, "Error writing response", "error", err)
+		_ = client.Close()
+		return
+	}
+	slog.DebugContext(ctx, "Switched protocols", "protocol", got)
+	closeInDefer = false
+	splice(client, server)
+}
+
+// hijackedConn is a hijacked client connection that reads through the
+// server's bufio.Reader, so that nothing that it had buffered is lost.
+type hijackedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *hijackedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
@@ -0,0 +1,134 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpgradeType(t *testing.T) {
+	for _, test := range []struct {
+		connection, upgrade, want string
+	}{
+		{"Upgrade", "websocket", "websocket"},
+		{"keep-alive, upgrade", "h2c", "h2c"},
+		{"keep-alive", "websocket", ""},
+		{"", "websocket", ""},
+	} {
+		header := http.Header{}
+		if test.connection != "" {
+			header.Set("Connection", test.connection)
+		}
+		header.Set("Upgrade", test.upgrade)
+		assert.Equal(t, test.want, upgradeType(header), "Connection: %s", test.connection)
+	}
+}
+
+// upgradeProxy is a proxy that asks for Basic auth, and then switches to
+// the requested protocol, which it implements by echoing everything back.
+func upgradeProxy(t *testing.T, switchTo string) *url.URL {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Proxy-Authorization") != "Basic ok" {
+			w.Header().Set("Proxy-Authenticate", "Basic")
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		if upgradeType(req.Header) != "websocket" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close() //nolint:errcheck
+		_, _ = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Connection: Upgrade\r\nUpgrade: %s\r\n\r\n", switchTo)
+		_, _ = io.Copy(conn, brw)
+	}))
+	t.Cleanup(proxy.Close)
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+	return proxyURL
+}
+
+// alpacaServer serves ph, with every request going through proxyURL.
+func alpacaServer(t *testing.T, ph ProxyHandler, proxyURL *url.URL) net.Conn {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), contextKeyProxy, proxyURL)
+		ph.ServeHTTP(w, req.WithContext(ctx))
+	}))
+	t.Cleanup(server.Close)
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestUpgrade(t *testing.T) {
+	proxyURL := upgradeProxy(t, "websocket")
+	chain := newAuthChain(realisticFake("Basic", "Basic ok"))
+	ph := NewProxyHandler(chain, http.ProxyURL(proxyURL), func(*url.URL) {})
+	defer ph.transport.CloseIdleConnections()
+	conn := alpacaServer(t, ph, proxyURL)
+
+	// Send some data straight after the request, without waiting for the
+	// response, to check that it isn't lost.
+	_, err := fmt.Fprint(conn, "GET http://example.test/chat HTTP/1.1\r\n"+
+		"Host: example.test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\nhello")
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "websocket", upgradeType(resp.Header))
+	assert.Empty(t, resp.Header.Get("Proxy-Authenticate"))
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(br, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	_, err = conn.Write([]byte("world"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(br, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(buf))
+}
+
+func TestUpgradeToWrongProtocol(t *testing.T) {
+	proxyURL := upgradeProxy(t, "h2c")
+	chain := newAuthChain(realisticFake("Basic", "Basic ok"))
+	ph := NewProxyHandler(chain, http.ProxyURL(proxyURL), func(*url.URL) {})
+	defer ph.transport.CloseIdleConnections()
+	conn := alpacaServer(t, ph, proxyURL)
+
+	_, err := fmt.Fprint(conn, "GET http://example.test/chat HTTP/1.1\r\n"+
+		"Host: example.test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
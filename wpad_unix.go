@@ -0,0 +1,217 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build aix || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// wpadLeaseGlobs match the lease files of the DHCP clients that WPAD
+// discovery knows about: dhclient (on its own, or run by NetworkManager),
+// NetworkManager's internal client, and systemd-networkd.
+var wpadLeaseGlobs = []string{
+	"/var/lib/dhcp/dhclient*.leases",
+	"/var/lib/dhclient/*.lease",
+	"/var/lib/dhclient/*.leases",
+	"/var/lib/NetworkManager/*.lease",
+	"/run/systemd/netif/leases/*",
+}
+
+const wpadSupported = true
+
+// lookupHost is a variable so that tests can replace it.
+var lookupHost = net.LookupHost
+
+// discoverWPAD looks for a PAC URL with the Web Proxy Auto-Discovery
+// protocol. Like Windows, it first looks for one from DHCP (option 252), in
+// the DHCP clients' lease files. Failing that, it tries wpad.<domain> for
+// each of the DNS search domains, and each of their parents (e.g.
+// wpad.eng.example.com and then wpad.example.com), and uses the first that
+// resolves. It returns "" if it doesn't find anything.
+func discoverWPAD() (string, error) {
+	if pacurl, lease := wpadFromLeases(wpadLeaseGlobs, time.Now()); pacurl != "" {
+		slog.Info("Discovered PAC URL using WPAD (DHCP)", "url", pacurl, "lease", lease)
+		return pacurl, nil
+	}
+	domains, err := searchDomains(resolvConfPath)
+	if err != nil {
+		return "", err
+	}
+	for _, host := range wpadHosts(domains) {
+		if _, err := lookupHost(host); err != nil {
+			slog.Debug("WPAD host doesn't resolve", "host", host, "error", err)
+			continue
+		}
+		pacurl := "http://" + host + "/wpad.dat"
+		slog.Info("Discovered PAC URL using WPAD (DNS)", "url", pacurl)
+		return pacurl, nil
+	}
+	slog.Info("No PAC URL discovered using WPAD")
+	return "", nil
+}
+
+// wpadFromLeases returns the WPAD URL from the most recently updated lease
+// file that has one, and the path of that file.
+func wpadFromLeases(globs []string, now time.Time) (pacurl, lease string) {
+	var newest time.Time
+	for _, glob := range globs {
+		paths, _ := filepath.Glob(glob)
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() || !info.ModTime().After(newest) {
+				continue
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				slog.Debug("Error reading DHCP lease", "path", path, "error", err)
+				continue
+			}
+			var found string
+			if bytes.Contains(data, []byte("lease {")) {
+				found = parseDhclientLeases(data, now)
+			} else {
+				found = parseNetworkdLease(data)
+			}
+			if found != "" {
+				pacurl, lease, newest = found, path, info.ModTime()
+			}
+		}
+	}
+	return pacurl, lease
+}
+
+// parseDhclientLeases returns the WPAD URL from the last lease that hasn't
+// expired in a dhclient lease file. dhclient only records option 252 if it's
+// told to ask for it in dhclient.conf, in which case it's usually named
+// "wpad"; otherwise, it appears as "unknown-252".
+func parseDhclientLeases(data []byte, now time.Time) string {
+	var pacurl, current string
+	expired := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSuffix(strings.TrimSpace(scanner.Text()), ";")
+		fields := strings.Fields(line)
+		switch {
+		case line == "lease {":
+			current, expired = "", false
+		case line == "}":
+			if current != "" && !expired {
+				pacurl = current
+			}
+		case len(fields) >= 3 && fields[0] == "option":
+			switch fields[1] {
+			case "wpad", "wpad-url", "unknown-252":
+				value := strings.TrimSpace(strings.TrimPrefix(line, "option "+fields[1]))
+				current = wpadURL(decodeDhclientValue(value))
+			}
+		case len(fields) == 4 && fields[0] == "expire":
+			// e.g. "expire 4 2026/10/15 12:00:00", in UTC.
+			t, err := time.Parse("2006/01/02 15:04:05", fields[2]+" "+fields[3])
+			expired = err == nil && t.Before(now)
+		}
+	}
+	return pacurl
+}
+
+// decodeDhclientValue decodes an option value from a dhclient lease, which
+// is either a quoted string or colon-separated hex bytes.
+func decodeDhclientValue(value string) []byte {
+	if strings.HasPrefix(value, `"`) {
+		s, err := strconv.Unquote(value)
+		if err != nil {
+			return nil
+		}
+		return []byte(s)
+	}
+	b, err := hex.DecodeString(strings.ReplaceAll(value, ":", ""))
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// parseNetworkdLease returns the WPAD URL from a systemd-networkd (or
+// NetworkManager) lease file, which is a list of KEY=VALUE lines. networkd
+// records option 252 as hex, since it's in the range for private options.
+func parseNetworkdLease(data []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "OPTION_252":
+			if b, err := hex.DecodeString(value); err == nil {
+				return wpadURL(b)
+			}
+		case "WPAD":
+			return wpadURL([]byte(value))
+		}
+	}
+	return ""
+}
+
+// wpadURL returns the URL from an option 252 value, or "" if it isn't an
+// HTTP(S) URL. Some DHCP servers NUL-terminate the URL.
+func wpadURL(value []byte) string {
+	s := strings.TrimSpace(strings.TrimRight(string(value), "\x00"))
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return s
+}
+
+// wpadHosts returns the WPAD host names to try for domains, in order. Each
+// domain is devolved one label at a time, but never as far as a public
+// suffix, since wpad.com or wpad.co.uk (say) could belong to anyone.
+func wpadHosts(domains []string) []string {
+	var hosts []string
+	seen := make(map[string]bool)
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		registered, err := publicsuffix.EffectiveTLDPlusOne(domain)
+		if err != nil {
+			continue
+		}
+		for {
+			host := "wpad." + domain
+			if !seen[host] {
+				seen[host] = true
+				hosts = append(hosts, host)
+			}
+			if domain == registered {
+				break
+			}
+			_, domain, _ = strings.Cut(domain, ".")
+		}
+	}
+	return hosts
+}
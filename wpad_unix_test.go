@@ -0,0 +1,155 @@
+// Copyright 2026 The Alpaca Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build aix || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const dhclientLeases = `lease {
+  interface "eth0";
+  fixed-address 192.0.2.10;
+  option wpad "http://old.example.com/wpad.dat";
+  renew 4 2026/10/15 09:00:00;
+  expire 4 2026/10/15 12:00:00;
+}
+lease {
+  interface "eth0";
+  fixed-address 192.0.2.10;
+  option unknown-252 "http://wpad.example.com/wpad.dat\000";
+  renew 5 2026/10/16 09:00:00;
+  expire 5 2026/10/16 12:00:00;
+}
+`
+
+func TestParseDhclientLeases(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		leases   string
+		now      time.Time
+		expected string
+	}{
+		{"LastLease", dhclientLeases, time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC),
+			"http://wpad.example.com/wpad.dat"},
+		{"Expired", dhclientLeases, time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC), ""},
+		{"Hex", "lease {\n  option wpad " +
+			"68:74:74:70:3a:2f:2f:77:70:61:64:2f:77:70:61:64:2e:64:61:74;\n}\n",
+			time.Time{}, "http://wpad/wpad.dat"},
+		{"NotAURL", "lease {\n  option wpad \"wpad.example.com\";\n}\n", time.Time{}, ""},
+		{"NoOption", "lease {\n  fixed-address 192.0.2.10;\n}\n", time.Time{}, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, parseDhclientLeases([]byte(test.leases), test.now))
+		})
+	}
+}
+
+func TestParseNetworkdLease(t *testing.T) {
+	lease := "# This is private data. Do not parse.\nADDRESS=192.0.2.10\n" +
+		"OPTION_252=687474703a2f2f777061642e6578616d706c652e636f6d2f777061642e646174\n"
+	assert.Equal(t, "http://wpad.example.com/wpad.dat", parseNetworkdLease([]byte(lease)))
+	assert.Empty(t, parseNetworkdLease([]byte("ADDRESS=192.0.2.10\n")))
+}
+
+func TestWPADFromLeases(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string, modified time.Time) {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		require.NoError(t, os.Chtimes(path, modified, modified))
+	}
+	now := time.Now()
+	write("dhclient.eth0.leases",
+		"lease {\n  option wpad \"http://wpad.old.example.com/wpad.dat\";\n}\n",
+		now.Add(-time.Hour))
+	write("2", "ADDRESS=192.0.2.10\nWPAD=http://wpad.new.example.com/wpad.dat\n",
+		now.Add(-time.Minute))
+	write("3", "ADDRESS=192.0.2.10\n", now)
+
+	pacurl, lease := wpadFromLeases([]string{filepath.Join(dir, "*")}, now)
+	assert.Equal(t, "http://wpad.new.example.com/wpad.dat", pacurl)
+	assert.Equal(t, filepath.Join(dir, "2"), lease)
+	pacurl, _ = wpadFromLeases([]string{filepath.Join(dir, "*.leases")}, now)
+	assert.Equal(t, "http://wpad.old.example.com/wpad.dat", pacurl)
+	pacurl, _ = wpadFromLeases([]string{filepath.Join(dir, "nonexistent")}, now)
+	assert.Empty(t, pacurl)
+}
+
+func TestWPADHosts(t *testing.T) {
+	assert.Equal(t, []string{
+		"wpad.eng.corp.example.com", "wpad.corp.example.com", "wpad.example.com",
+		"wpad.example.co.uk", "wpad.corp.internal",
+	}, wpadHosts([]string{
+		"eng.corp.example.com", "example.com.", "Example.co.uk", "co.uk", "corp.internal",
+	}))
+}
+
+func TestDiscoverWPADWithDNS(t *testing.T) {
+	oldGlobs, oldResolvConf, oldLookupHost := wpadLeaseGlobs, resolvConfPath, lookupHost
+	defer func() {
+		wpadLeaseGlobs, resolvConfPath, lookupHost = oldGlobs, oldResolvConf, oldLookupHost
+	}()
+	dir := t.TempDir()
+	wpadLeaseGlobs = []string{filepath.Join(dir, "*.leases")}
+	resolvConfPath = filepath.Join(dir, "resolv.conf")
+	require.NoError(t, os.WriteFile(resolvConfPath,
+		[]byte("search eng.corp.example.com\n"), 0600))
+	var lookups []string
+	lookupHost = func(host string) ([]string, error) {
+		lookups = append(lookups, host)
+		if host == "wpad.corp.example.com" {
+			return []string{"192.0.2.80"}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	pacurl, err := discoverWPAD()
+	require.NoError(t, err)
+	assert.Equal(t, "http://wpad.corp.example.com/wpad.dat", pacurl)
+	assert.Equal(t, []string{"wpad.eng.corp.example.com", "wpad.corp.example.com"}, lookups)
+
+	// A lease takes precedence over DNS.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "dhclient.leases"),
+		[]byte("lease {\n  option wpad \"http://dhcp.example.com/wpad.dat\";\n}\n"), 0600))
+	pacurl, err = discoverWPAD()
+	require.NoError(t, err)
+	assert.Equal(t, "http://dhcp.example.com/wpad.dat", pacurl)
+}
+
+func TestNewHandlerWithWPADAndNoAuth(t *testing.T) {
+	isolatePACSources(t)
+	t.Setenv("PATH", t.TempDir()) // no gsettings
+	oldGlobs, oldResolvConf := wpadLeaseGlobs, resolvConfPath
+	defer func() { wpadLeaseGlobs, resolvConfPath = oldGlobs, oldResolvConf }()
+	dir := t.TempDir()
+	wpadLeaseGlobs = []string{filepath.Join(dir, "*.leases")}
+	resolvConfPath = filepath.Join(dir, "resolv.conf")
+
+	// Without any credentials, buildAuthChain returns a nil chain.
+	cfg := defaultConfig()
+	cfg.WPAD = true
+	var dialer *tunnelDialer
+	require.NotPanics(t, func() { _, dialer = newHandler(cfg, nil) })
+	dialer.finder.close()
+}